@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/doraemonkeys/monster-pipe-core/internal/forwarder"
+	"github.com/doraemonkeys/monster-pipe-core/pkg/protocol"
+)
+
+// listFlag is a flag that can be repeated, each value may also hold several comma separated items.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+func newListFlag(name string, usage string) *listFlag {
+	l := &listFlag{}
+	flag.Var(l, name, usage)
+	return l
+}
+
+var (
+	allowCmd     *listFlag      = newListFlag("allow", "only accept clients matching pattern[@protocol][#identity], can be repeated, e.g. 10.0.0.0/8, 192.0.2.1:8000-9000@tcp, *#backup-*")
+	denyCmd      *listFlag      = newListFlag("deny", "refuse clients matching pattern[@protocol], checked before -allow, can be repeated")
+	allowFileCmd *string        = flag.String("allow-file", "", "file with one -allow pattern per line, a line starting with \"# \" is a comment, #id is an identity pattern")
+	denyFileCmd  *string        = flag.String("deny-file", "", "file with one -deny pattern per line, a line starting with \"# \" is a comment, #id is an identity pattern")
+	aclReloadCmd *time.Duration = flag.Duration("acl-reload", 5*time.Second, "how often the -allow-file and -deny-file are checked for changes, 0 disables it. SIGHUP reloads them too")
+
+	banWindowCmd   *time.Duration = flag.Duration("ban-window", time.Minute, "sliding window the events of a client are counted in for the automatic bans")
+	banAcceptsCmd  *int           = flag.Int("ban-max-accepts", 0, "ban a client that opens more connections in the window, 0 disables it")
+	banShortCmd    *int           = flag.Int("ban-max-short", 0, "ban a client that has more short tunnels in the window, 0 disables it")
+	banShortAgeCmd *time.Duration = flag.Duration("ban-short-tunnel", time.Second, "lifetime under which a tunnel counts as short")
+	banErrorsCmd   *int           = flag.Int("ban-max-errors", 0, "ban a client whose tunnels hit more output read/write errors in the window, failed dials and shadows excluded, an output down mid-tunnel still counts, 0 disables it")
+	banDurationCmd *time.Duration = flag.Duration("ban-duration", 10*time.Minute, "how long an automatic ban lasts")
+)
+
+// 10.0.0.0/8, [2001:db8::1]:443@tcp, #alice
+func parseMatchHost(pattern string) (forwarder.MatchHostConfig, error) {
+	match, identity, hasIdentity := strings.Cut(strings.TrimSpace(pattern), "#")
+	if hasIdentity && identity == "" {
+		return forwarder.MatchHostConfig{}, fmt.Errorf("empty identity in access list pattern: %q", pattern)
+	}
+	match, proto, hasProto := strings.Cut(match, "@")
+	if match == "" {
+		if !hasIdentity {
+			return forwarder.MatchHostConfig{}, fmt.Errorf("empty access list pattern: %q", pattern)
+		}
+		// An identity alone matches the client wherever it connects from.
+		match = "*"
+	}
+	if !hasProto {
+		return forwarder.MatchHostConfig{Match: match, AnyProto: true, Identity: identity}, nil
+	}
+	netProtocol, err := protocol.ParseNetProtocol(proto)
+	if err != nil {
+		return forwarder.MatchHostConfig{}, fmt.Errorf("invalid access list pattern %q: %w", pattern, err)
+	}
+	return forwarder.MatchHostConfig{Match: match, Protocol: netProtocol, Identity: identity}, nil
+}
+
+// readListFile returns the lines of the file, the empty lines and the comments are skipped.
+// A comment is a line that is just # or starts with "# ", so that "#alice" is still an identity pattern.
+func readListFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line == "#" || strings.HasPrefix(line, "# ") || strings.HasPrefix(line, "#\t") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, scanner.Err()
+}
+
+func parseAccessList(patterns []string, file string) ([]forwarder.MatchHostConfig, error) {
+	if file != "" {
+		filePatterns, err := readListFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("read access list: %w", err)
+		}
+		patterns = append(append([]string{}, patterns...), filePatterns...)
+	}
+	list := make([]forwarder.MatchHostConfig, 0, len(patterns))
+	for _, pattern := range patterns {
+		matchHost, err := parseMatchHost(pattern)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, matchHost)
+	}
+	return list, nil
+}
+
+// parseAccessLists returns the blacklist and the whitelist of the -deny and -allow flags and files.
+func parseAccessLists() (blacklist, whitelist []forwarder.MatchHostConfig, err error) {
+	if blacklist, err = parseAccessList(*denyCmd, *denyFileCmd); err != nil {
+		return nil, nil, err
+	}
+	if whitelist, err = parseAccessList(*allowCmd, *allowFileCmd); err != nil {
+		return nil, nil, err
+	}
+	return blacklist, whitelist, nil
+}
+
+// parseAutoBan returns nil if none of the automatic ban checks is enabled.
+func parseAutoBan() (*forwarder.AutoBanConfig, error) {
+	if *banAcceptsCmd < 0 || *banShortCmd < 0 || *banErrorsCmd < 0 {
+		return nil, fmt.Errorf("automatic ban thresholds must not be negative")
+	}
+	if *banAcceptsCmd == 0 && *banShortCmd == 0 && *banErrorsCmd == 0 {
+		return nil, nil
+	}
+	return &forwarder.AutoBanConfig{
+		Window:          *banWindowCmd,
+		MaxAccepts:      *banAcceptsCmd,
+		MaxShortTunnels: *banShortCmd,
+		ShortTunnel:     *banShortAgeCmd,
+		MaxOutputErrors: *banErrorsCmd,
+		BanDuration:     *banDurationCmd,
+	}, nil
+}
+
+// watchAccessLists reloads the access lists of the input when the files change or on SIGHUP.
+func watchAccessLists(ctx context.Context, input *forwarder.ForwardInput) {
+	files := []string{}
+	for _, file := range []string{*denyFileCmd, *allowFileCmd} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	if len(files) == 0 {
+		return
+	}
+	modTimes := func() string {
+		var stamps []string
+		for _, file := range files {
+			if info, err := os.Stat(file); err == nil {
+				stamps = append(stamps, info.ModTime().String())
+			} else {
+				stamps = append(stamps, err.Error())
+			}
+		}
+		return strings.Join(stamps, "|")
+	}
+	lastModTimes := modTimes()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	var tick <-chan time.Time
+	if *aclReloadCmd > 0 {
+		ticker := time.NewTicker(*aclReloadCmd)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			lastModTimes = modTimes()
+		case <-tick:
+			current := modTimes()
+			if current == lastModTimes {
+				continue
+			}
+			lastModTimes = current
+		}
+		blacklist, whitelist, err := parseAccessLists()
+		if err == nil {
+			err = input.UpdateAccessList(blacklist, whitelist)
+		}
+		if err != nil {
+			fmt.Println(red("Reload access lists failed, the previous lists are kept:"), err)
+			continue
+		}
+		fmt.Printf("%s %d deny, %d allow\n", green("Access lists reloaded:"), len(blacklist), len(whitelist))
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/doraemonkeys/monster-pipe-core/pkg/protocol/psk"
+)
+
+var (
+	inPSKCmd  *string = flag.String("in-psk", "", "file with the pre-shared key the clients of the input must prove they know")
+	outPSKCmd *string = flag.String("out-psk", "", "file with the pre-shared key used to authenticate to the outputs, which run mpipe with -in-psk")
+	pskIDCmd  *string = flag.String("psk-id", "", "client id sent with the -out-psk handshake")
+)
+
+type listenFunc = func(ctx context.Context, network string, address string) (net.Listener, error)
+type dialFunc = func(ctx context.Context, network string, address string) (net.Conn, error)
+
+// readPSK reads the key file, the surrounding white space is not part of the key.
+func readPSK(file string) ([]byte, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read psk file: %w", err)
+	}
+	key := bytes.TrimSpace(content)
+	if len(key) < 16 {
+		return nil, fmt.Errorf("psk in %s is shorter than 16 bytes", file)
+	}
+	return key, nil
+}
+
+func loadPSK(file string) (*psk.Config, error) {
+	key, err := readPSK(file)
+	if err != nil {
+		return nil, err
+	}
+	return &psk.Config{Key: key, ID: *pskIDCmd}, nil
+}
+
+func wrapInputListen(listen listenFunc, isUDP bool) (listenFunc, error) {
+	if *inPSKCmd == "" {
+		return listen, nil
+	}
+	if isUDP {
+		return nil, fmt.Errorf("-in-psk needs a tcp input")
+	}
+	config, err := loadPSK(*inPSKCmd)
+	if err != nil {
+		return nil, err
+	}
+	return psk.WrapListen(listen, config), nil
+}
+
+func wrapOutputDial(dial dialFunc, isUDP bool) (dialFunc, error) {
+	if *outPSKCmd == "" {
+		return dial, nil
+	}
+	if isUDP {
+		return nil, fmt.Errorf("-out-psk needs tcp outputs")
+	}
+	config, err := loadPSK(*outPSKCmd)
+	if err != nil {
+		return nil, err
+	}
+	return psk.WrapDial(dial, config), nil
+}
@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/chzyer/readline"
+	"github.com/doraemonkeys/monster-pipe-core/internal/config"
 	"github.com/doraemonkeys/monster-pipe-core/internal/forwarder"
 	"github.com/doraemonkeys/monster-pipe-core/pkg/protocol"
 	"github.com/kevinburke/ssh_config"
@@ -30,6 +31,42 @@ var (
 	sshPwdFileCmd    *string = flag.String("ssh-pwd-file", "", "ssh password file")
 )
 
+var (
+	modeCmd          *string        = flag.String("mode", "fanout", "forward mode: fanout, round-robin, weighted, least-conn, hash")
+	checkIntervalCmd *time.Duration = flag.Duration("check-interval", 5*time.Second, "interval of the output health checks")
+	checkTimeoutCmd  *time.Duration = flag.Duration("check-timeout", 2*time.Second, "timeout of an output health check")
+	dialTimeoutCmd   *time.Duration = flag.Duration("dial-timeout", 10*time.Second, "timeout of a dial to an output")
+	dialRetriesCmd   *int           = flag.Int("dial-retries", 0, "number of retries of a failed dial to an output")
+	dialBackoffCmd   *time.Duration = flag.Duration("dial-backoff", 100*time.Millisecond, "delay before the first dial retry, doubled after each retry")
+	breakerCmd       *int           = flag.Int("breaker-threshold", 0, "consecutive dial failures that open the circuit breaker of an output, 0 disables it")
+	breakerCoolCmd   *time.Duration = flag.Duration("breaker-cooldown", 30*time.Second, "how long an open circuit breaker fails the dials fast")
+	bufferSizeCmd    *string        = flag.String("buffer-size", "32K", "size of the read buffers of a tunnel")
+	memoryBudgetCmd  *string        = flag.String("memory-budget", "0", "limit of the memory used by the read buffers, 0 means no limit")
+	memoryActionCmd  *string        = flag.String("memory-action", "backpressure", "what to do with new connections when the memory budget is exhausted: backpressure, reject")
+	idleTimeoutCmd   *time.Duration = flag.Duration("idle-timeout", 0, "close a tunnel without data in either direction for this long, 0 disables it")
+	maxLifetimeCmd   *time.Duration = flag.Duration("max-lifetime", 0, "close a tunnel open for this long, 0 disables it")
+	drainTimeoutCmd  *time.Duration = flag.Duration("drain-timeout", 0, "on SIGINT or SIGTERM, stop accepting and wait this long for the running tunnels")
+	maxConnsCmd      *int           = flag.Int("max-conns", 0, "limit of the concurrent tunnels, 0 means no limit")
+	maxConnsIPCmd    *int           = flag.Int("max-conns-per-ip", 0, "limit of the concurrent tunnels of a client IP, 0 means no limit")
+	connLimitCmd     *string        = flag.String("conn-limit-action", "reject", "what to do with connections over the limits: reject, queue")
+	connQueueCmd     *time.Duration = flag.Duration("conn-queue-timeout", 10*time.Second, "how long a queued connection waits for a free slot, 0 means no timeout")
+	rateUpCmd        *string        = flag.String("rate-up", "", "upstream bandwidth limit of a tunnel in bytes per second, rate[:burst], e.g. 1M:4M")
+	rateDownCmd      *string        = flag.String("rate-down", "", "downstream bandwidth limit of a tunnel in bytes per second, rate[:burst]")
+	clientUpCmd      *string        = flag.String("client-rate-up", "", "upstream bandwidth limit of all the tunnels of a client IP, rate[:burst]")
+	clientDownCmd    *string        = flag.String("client-rate-down", "", "downstream bandwidth limit of all the tunnels of a client IP, rate[:burst]")
+	totalUpCmd       *string        = flag.String("total-rate-up", "", "upstream bandwidth limit of the forwarder, rate[:burst]")
+	totalDownCmd     *string        = flag.String("total-rate-down", "", "downstream bandwidth limit of the forwarder, rate[:burst]")
+	quotaCmd         *string        = flag.String("quota", "", "traffic quota of a client, its identity once authenticated or else its IP, bytes[/period], e.g. 10G/24h")
+	quotaStateCmd    *string        = flag.String("quota-state", "", "file that keeps the quota usage across restarts")
+	udpIdleCmd       *time.Duration = flag.Duration("udp-idle-timeout", 2*time.Minute, "expire the session of a UDP client without datagrams in either direction for this long, a negative value keeps it until its tunnel closes")
+	udpSessionsCmd   *int           = flag.Int("udp-max-sessions", 0, "limit of the concurrent UDP sessions, the datagrams of new clients over it are dropped. 0 means no limit")
+	udpQueueCmd      *int           = flag.Int("udp-queue", 100, "datagrams a UDP session holds until its tunnel reads them, the datagrams over it are dropped")
+	udpMemoryCmd     *string        = flag.String("udp-memory", "32M", "limit of the memory used by the datagrams held by all the UDP sessions")
+	udpDatagramCmd   *string        = flag.String("udp-max-datagram", "64K", "largest datagram accepted from the UDP clients, at most 64K. The larger ones are dropped and counted as oversized")
+	udpRcvBufCmd     *string        = flag.String("udp-rcvbuf", "0", "SO_RCVBUF of the UDP input socket, 0 keeps the system default")
+	udpSndBufCmd     *string        = flag.String("udp-sndbuf", "0", "SO_SNDBUF of the UDP input socket, 0 keeps the system default")
+)
+
 type SSHConfig struct {
 	Host         string
 	Port         int
@@ -40,13 +77,13 @@ type SSHConfig struct {
 }
 
 func parseNeedConnectSSH(inputStr string, outputsStr string) bool {
-	if strings.HasPrefix(inputStr, "ssh:") {
+	if isSSHAddr(inputStr) {
 		return true
 	}
 	outputsStr = strings.TrimSpace(outputsStr)
 	parts := strings.Split(outputsStr, ",")
 	for _, part := range parts {
-		if strings.HasPrefix(part, "ssh:") {
+		if isSSHAddr(part) {
 			return true
 		}
 	}
@@ -215,7 +252,7 @@ func parseNetAddrConfig(addr string, isInput bool) (*forwarder.NetAddrConfig, er
 	if err != nil {
 		return nil, fmt.Errorf("invalid protocol: %s", pt)
 	}
-	if host == "" && !isInput {
+	if host == "" && !isInput && hostPort[0] != "ssh" {
 		host = "localhost"
 	}
 	return &forwarder.NetAddrConfig{
@@ -225,11 +262,30 @@ func parseNetAddrConfig(addr string, isInput bool) (*forwarder.NetAddrConfig, er
 	}, nil
 }
 
-// host:port@protocol=
+// host:port@protocol=#option#option
 func parseNetOutputConfig(output string) (*forwarder.ForwardOutputConfig, error) {
 	output = strings.TrimSpace(output)
 
 	var cfg forwarder.ForwardOutputConfig
+	cfg.Dial = forwarder.ForwardOutputDialConfig{
+		Timeout:          *dialTimeoutCmd,
+		Retries:          *dialRetriesCmd,
+		Backoff:          *dialBackoffCmd,
+		BreakerThreshold: *breakerCmd,
+		BreakerCooldown:  *breakerCoolCmd,
+	}
+	options := strings.Split(output, "#")
+	output = options[0]
+	var serverName string
+	for _, option := range options[1:] {
+		if key, value, _ := strings.Cut(strings.TrimSpace(option), "="); strings.EqualFold(key, "sni") {
+			serverName = value
+			continue
+		}
+		if err := parseNetOutputOption(&cfg, option); err != nil {
+			return nil, err
+		}
+	}
 	cfg.Readable = true
 	cfg.Writable = true
 	hasSuffix := strings.HasSuffix(output, "<") || strings.HasSuffix(output, ">") || strings.HasSuffix(output, "=")
@@ -245,6 +301,21 @@ func parseNetOutputConfig(output string) (*forwarder.ForwardOutputConfig, error)
 	if hasSuffix {
 		output = output[:len(output)-1]
 	}
+	// @tls is a tcp output dialed with TLS, @wss is dialed with TLS before the WebSocket upgrade.
+	isTLS := strings.HasSuffix(strings.ToLower(output), "@tls")
+	if isTLS || strings.HasSuffix(strings.ToLower(output), "@wss") {
+		if isTLS {
+			output = output[:len(output)-len("@tls")] + "@tcp"
+		}
+		tlsConfig, err := newOutputTLS()
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ServerName = serverName
+		cfg.TLS = tlsConfig
+	} else if serverName != "" {
+		return nil, fmt.Errorf("#sni needs a @tls or @wss output")
+	}
 	input, err := parseNetAddrConfig(output, false)
 	if err != nil {
 		return nil, err
@@ -252,10 +323,111 @@ func parseNetOutputConfig(output string) (*forwarder.ForwardOutputConfig, error)
 	cfg.Host = input.Host
 	cfg.Port = input.Port
 	cfg.Protocol = input.Protocol
+	if cfg.Protocol == protocol.NetProtocolSecure {
+		if cfg.Secure, err = parseSecureConfig(true); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Protocol.IsWebSocket() {
+		if cfg.WebSocket, err = parseWebSocketConfig(); err != nil {
+			return nil, err
+		}
+	}
 	// return &cfg, nil
 	return &cfg, nil
 }
 
+// primary, shadow, queue=64, overflow=drop-oldest, weight=2, backup, check=tcp
+func parseNetOutputOption(cfg *forwarder.ForwardOutputConfig, option string) error {
+	option = strings.TrimSpace(option)
+	key, value, _ := strings.Cut(option, "=")
+	switch strings.ToLower(key) {
+	case "primary", "shadow":
+		role, err := forwarder.ParseForwardOutputRole(key)
+		if err != nil {
+			return err
+		}
+		cfg.Role = role
+		return nil
+	case "queue":
+		size, err := strconv.Atoi(value)
+		if err != nil || size <= 0 {
+			return fmt.Errorf("invalid output queue size: %s", value)
+		}
+		cfg.WriteQueueSize = size
+		return nil
+	case "backup":
+		cfg.Backup = true
+		return nil
+	case "check":
+		check, err := parseHealthCheck(value)
+		if err != nil {
+			return err
+		}
+		cfg.HealthCheck = check
+		return nil
+	case "weight":
+		weight, err := strconv.Atoi(value)
+		if err != nil || weight <= 0 {
+			return fmt.Errorf("invalid output weight: %s", value)
+		}
+		cfg.Weight = weight
+		return nil
+	case "overflow":
+		policy, err := forwarder.ParseForwardOutputOverflowPolicy(value)
+		if err != nil {
+			return err
+		}
+		cfg.OverflowPolicy = policy
+		return nil
+	}
+	return fmt.Errorf("invalid output option: %s", option)
+}
+
+// tcp, http, http:/healthz, expect:PING\r\n:+PONG
+func parseHealthCheck(check string) (*forwarder.HealthCheckConfig, error) {
+	cfg := forwarder.HealthCheckConfig{
+		Interval: *checkIntervalCmd,
+		Timeout:  *checkTimeoutCmd,
+	}
+	kind, arg, _ := strings.Cut(check, ":")
+	switch strings.ToLower(kind) {
+	case "", "tcp":
+		cfg.Type = forwarder.HealthCheckTCP
+	case "http":
+		cfg.Type = forwarder.HealthCheckHTTP
+		cfg.HTTPPath = arg
+	case "expect":
+		cfg.Type = forwarder.HealthCheckExpect
+		send, expect, ok := strings.Cut(arg, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid expect health check, want expect:<send>:<expect>: %s", check)
+		}
+		var err error
+		if cfg.Send, err = unescapeHealthCheckData(send); err != nil {
+			return nil, err
+		}
+		if cfg.Expect, err = unescapeHealthCheckData(expect); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid health check: %s", check)
+	}
+	return &cfg, nil
+}
+
+func unescapeHealthCheckData(data string) ([]byte, error) {
+	unquoted, err := strconv.Unquote(`"` + strings.ReplaceAll(data, `"`, `\"`) + `"`)
+	if err != nil {
+		return nil, fmt.Errorf("invalid health check data: %s", data)
+	}
+	return []byte(unquoted), nil
+}
+
+func isSSHAddr(addr string) bool {
+	return strings.HasPrefix(strings.TrimSpace(addr), "ssh:")
+}
+
 func parseNetOutputsConfig(outputs string) ([]forwarder.ForwardOutputConfig, error) {
 	outputs = strings.TrimSpace(outputs)
 	parts := strings.Split(outputs, ",")
@@ -286,23 +458,201 @@ func GetDefaultSSHConfigPath() string {
 	return filepath.Join(home, ".ssh", "config")
 }
 
+func parseUDPConfig() (forwarder.UDPConfig, error) {
+	sizes := make([]int64, 4)
+	for i, size := range []string{*udpMemoryCmd, *udpDatagramCmd, *udpRcvBufCmd, *udpSndBufCmd} {
+		var err error
+		if sizes[i], err = parseByteSize(size); err != nil {
+			return forwarder.UDPConfig{}, err
+		}
+	}
+	if sizes[1] > forwarder.MaxUDPDatagramSize {
+		return forwarder.UDPConfig{}, fmt.Errorf("-udp-max-datagram %s is over 64K", *udpDatagramCmd)
+	}
+	return forwarder.UDPConfig{
+		IdleTimeout:     *udpIdleCmd,
+		MaxSessions:     *udpSessionsCmd,
+		QueueSize:       *udpQueueCmd,
+		MemoryBudget:    sizes[0],
+		MaxDatagramSize: int(sizes[1]),
+		ReadBuffer:      int(sizes[2]),
+		WriteBuffer:     int(sizes[3]),
+	}, nil
+}
+
 func parseInputCmd(inputCmd string, sshClient *ssh.Client) (*forwarder.ForwardInput, error) {
 	cfg, err := parseNetInputConfig(inputCmd)
 	if err != nil {
 		return nil, err
 	}
+	if cfg.Blacklist, cfg.Whitelist, err = parseAccessLists(); err != nil {
+		return nil, err
+	}
+	if cfg.AutoBan, err = parseAutoBan(); err != nil {
+		return nil, err
+	}
+	if cfg.TLS, err = parseInputTLS(cfg.NetAddrConfig); err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(string(cfg.Protocol), "udp") {
+		if cfg.UDP, err = parseUDPConfig(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Protocol == protocol.NetProtocolSecure {
+		if cfg.Secure, err = parseSecureConfig(false); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Protocol.IsWebSocket() {
+		if cfg.WebSocket, err = parseWebSocketConfig(); err != nil {
+			return nil, err
+		}
+	}
 
-	if !strings.HasPrefix(inputCmd, "ssh:") {
-		input := forwarder.NewForwardInput(*cfg, nil)
-		return input, nil
+	listen := forwarder.DefaultListen
+	if strings.HasPrefix(inputCmd, "ssh:") && strings.HasPrefix(string(cfg.Protocol), "udp") {
+		return nil, fmt.Errorf("ssh inputs listen on tcp only, udp goes through the ssh server with the ssh:...@udp outputs")
+	}
+	if strings.HasPrefix(inputCmd, "ssh:") {
+		listen = func(_ context.Context, network string, address string) (net.Listener, error) {
+			// fmt.Println("sshClient.Listen(network, address): ", network, address)
+			return sshClient.Listen(network, address)
+		}
+	}
+	if listen, err = wrapInputListen(listen, strings.HasPrefix(string(cfg.Protocol), "udp")); err != nil {
+		return nil, err
 	}
-	input := forwarder.NewForwardInput(*cfg, func(_ context.Context, network string, address string) (net.Listener, error) {
-		// fmt.Println("sshClient.Listen(network, address): ", network, address)
-		return sshClient.Listen(network, address)
-	})
+	input := forwarder.NewForwardInput(*cfg, listen)
 	return input, nil
 }
 
+func parseForwarderConfig() (forwarder.ForwarderConfig, error) {
+	var cfg forwarder.ForwarderConfig
+	mode, err := forwarder.ParseForwardMode(*modeCmd)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Mode = mode
+	// Without -verbose the data of the chunks is never printed.
+	cfg.ConnEventsOnly = !*verboseCmd
+	bufferSize, err := parseByteSize(*bufferSizeCmd)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.BufferSize = int(bufferSize)
+	if cfg.MemoryBudget, err = parseByteSize(*memoryBudgetCmd); err != nil {
+		return cfg, err
+	}
+	if cfg.MemoryBudgetAction, err = forwarder.ParseMemoryBudgetAction(*memoryActionCmd); err != nil {
+		return cfg, err
+	}
+	if *idleTimeoutCmd < 0 || *maxLifetimeCmd < 0 || *drainTimeoutCmd < 0 {
+		return cfg, fmt.Errorf("idle timeout, max lifetime and drain timeout must not be negative")
+	}
+	cfg.IdleTimeout = *idleTimeoutCmd
+	cfg.MaxLifetime = *maxLifetimeCmd
+	cfg.DrainTimeout = *drainTimeoutCmd
+	if *maxConnsCmd < 0 || *maxConnsIPCmd < 0 {
+		return cfg, fmt.Errorf("connection limits must not be negative")
+	}
+	cfg.MaxConns = *maxConnsCmd
+	cfg.MaxConnsPerIP = *maxConnsIPCmd
+	if cfg.ConnLimitAction, err = forwarder.ParseConnLimitAction(*connLimitCmd); err != nil {
+		return cfg, err
+	}
+	cfg.ConnQueueTimeout = *connQueueCmd
+	rates := []struct {
+		limit *forwarder.RateLimit
+		value string
+	}{
+		{&cfg.TunnelRate.Up, *rateUpCmd},
+		{&cfg.TunnelRate.Down, *rateDownCmd},
+		{&cfg.ClientRate.Up, *clientUpCmd},
+		{&cfg.ClientRate.Down, *clientDownCmd},
+		{&cfg.TotalRate.Up, *totalUpCmd},
+		{&cfg.TotalRate.Down, *totalDownCmd},
+	}
+	for _, rate := range rates {
+		if *rate.limit, err = parseRateLimit(rate.value); err != nil {
+			return cfg, err
+		}
+	}
+	if cfg.Quota, err = parseQuota(*quotaCmd); err != nil {
+		return cfg, err
+	}
+	if *quotaStateCmd != "" {
+		cfg.Quota.Store = config.NewStateFile(*quotaStateCmd)
+	}
+	return cfg, nil
+}
+
+// 10G, 10G/24h
+func parseQuota(quota string) (forwarder.QuotaConfig, error) {
+	var cfg forwarder.QuotaConfig
+	if strings.TrimSpace(quota) == "" {
+		return cfg, nil
+	}
+	size, period, hasPeriod := strings.Cut(quota, "/")
+	var err error
+	if cfg.Bytes, err = parseByteSize(size); err != nil {
+		return cfg, fmt.Errorf("invalid quota %s: %w", quota, err)
+	}
+	if hasPeriod {
+		if cfg.Period, err = time.ParseDuration(strings.TrimSpace(period)); err != nil || cfg.Period <= 0 {
+			return cfg, fmt.Errorf("invalid quota period %s", quota)
+		}
+	}
+	return cfg, nil
+}
+
+// 1M, 1M:4M
+func parseRateLimit(rate string) (forwarder.RateLimit, error) {
+	var limit forwarder.RateLimit
+	if strings.TrimSpace(rate) == "" {
+		return limit, nil
+	}
+	bytesPerSecond, burst, hasBurst := strings.Cut(rate, ":")
+	var err error
+	if limit.BytesPerSecond, err = parseByteSize(bytesPerSecond); err != nil {
+		return limit, fmt.Errorf("invalid rate limit %s: %w", rate, err)
+	}
+	if hasBurst {
+		if limit.Burst, err = parseByteSize(burst); err != nil {
+			return limit, fmt.Errorf("invalid rate limit burst %s: %w", rate, err)
+		}
+	}
+	return limit, nil
+}
+
+// 512, 32K, 1.5M, 2GiB
+func parseByteSize(size string) (int64, error) {
+	size = strings.TrimSpace(size)
+	upper := strings.ToUpper(size)
+	upper = strings.TrimSuffix(strings.TrimSuffix(upper, "B"), "I")
+	var unit int64 = 1
+	if len(upper) > 0 {
+		switch upper[len(upper)-1] {
+		case 'K':
+			unit = 1 << 10
+		case 'M':
+			unit = 1 << 20
+		case 'G':
+			unit = 1 << 30
+		case 'T':
+			unit = 1 << 40
+		}
+		if unit != 1 {
+			upper = upper[:len(upper)-1]
+		}
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(upper), 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size: %s", size)
+	}
+	return int64(value * float64(unit)), nil
+}
+
 func parseSSHCmdConfigAndConnectSSH() (*ssh.Client, error) {
 	cfg, err := parseSSHCmdConfig()
 	if err != nil {
@@ -512,10 +862,18 @@ func PrintUsage() {
 		"Usage: mpipe -ssh user@example.com:22 127.0.0.1:6379@tcp  ssh:6379@tcp",
 		"\n",
 		"Usage: mpipe :7890  192.168.1.100:7890",
+		"Usage(BALANCE): mpipe -mode least-conn :8080 '10.0.0.1:8080#weight=2,10.0.0.2:8080'",
+		"Usage(FAILOVER): mpipe -mode round-robin :6379 '10.0.0.1:6379#check=expect:PING\\r\\n:+PONG,10.0.0.2:6379#check=tcp#backup'",
+		"Usage(MIRROR): mpipe :8080 '10.0.0.1:8080#primary,10.0.0.2:8080#shadow#queue=256#overflow=drop-oldest'",
 		"Usage: mpipe -verbose localhost:7890@udp 192.168.1.100:7890@tcp",
+		"Usage(TLS): mpipe :6379 'redis.internal:6380@tls#sni=redis.example.com'",
+		"Usage(UDP OVER TCP): mpipe :53@udp server:5353@framed  and  mpipe :5353@framed 1.1.1.1:53@udp",
+		"Usage(WEBSOCKET): mpipe -in-tls-self-signed -ws-path /tunnel :443@wss 127.0.0.1:22  and  mpipe -ws-path /tunnel :2222 proxy.example.com:443@wss",
+		"Usage(SECURE): mpipe -secure-psk key.txt :7000@secure 127.0.0.1:22  and  mpipe -secure-psk key.txt :2222 server:7000@secure",
 		"Usage: mpipe -ssh user@example.com 127.0.0.1:6379@tcp  ssh:127.0.0.1:6379@tcp",
 		"Usage(SSH MYSQL): mpipe -ssh sshName :6379 ssh:6379",
 		"Usage(SSH PROXY): mpipe -ssh sshName ssh:7890 127.0.0.1:7890",
+		"Usage(SSH UDP): mpipe -ssh bastion :53@udp ssh:10.0.0.2:53@udp  (mpipe must be installed on the bastion, see -ssh-udp-cmd)",
 		"\n",
 	}, "\n")
 	fmt.Println(Usages)
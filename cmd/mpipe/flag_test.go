@@ -1,6 +1,9 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
+	"slices"
 	"testing"
 
 	"github.com/doraemonkeys/monster-pipe-core/internal/forwarder"
@@ -79,6 +82,13 @@ func Test_parseNetInput(t *testing.T) {
 				Protocol: protocol.NetProtocolTCP,
 			},
 		}, false},
+		{"11", ":6789@framed", &forwarder.ForwardInputConfig{
+			NetAddrConfig: forwarder.NetAddrConfig{
+				Host:     "",
+				Port:     6789,
+				Protocol: protocol.NetProtocolFramed,
+			},
+		}, false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -216,3 +226,223 @@ func Test_parseNetOutput(t *testing.T) {
 		})
 	}
 }
+
+func Test_parseNetOutputRole(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		want     forwarder.ForwardOutputRole
+		readable bool
+		wantErr  bool
+	}{
+		{"1", "192.168.1.1:6789", forwarder.ForwardOutputRoleNormal, true, false},
+		{"2", "192.168.1.1:6789@tcp#primary", forwarder.ForwardOutputRolePrimary, true, false},
+		{"3", "192.168.1.1:6789#shadow", forwarder.ForwardOutputRoleShadow, true, false},
+		{"4", "192.168.1.1:6789@tcp<#shadow", forwarder.ForwardOutputRoleShadow, false, false},
+		{"5", "192.168.1.1:6789@tcp#unknown", forwarder.ForwardOutputRoleNormal, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseNetOutputConfig(tt.output)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseNetOutputConfig() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			if got.Role != tt.want || got.Readable != tt.readable {
+				t.Errorf("parseNetOutputConfig() = %v, want role %v readable %v", got, tt.want, tt.readable)
+			}
+			if got.Port != 6789 || got.Host != "192.168.1.1" {
+				t.Errorf("parseNetOutputConfig() = %v", got)
+			}
+		})
+	}
+}
+
+func Test_parseNetOutputTLS(t *testing.T) {
+	tests := []struct {
+		output     string
+		serverName string
+		wantErr    bool
+	}{
+		{"redis.internal:6380@tls", "", false},
+		{"redis.internal:6380@TLS<#sni=redis.example.com", "redis.example.com", false},
+		{"redis.internal:6380@tcp#sni=redis.example.com", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.output, func(t *testing.T) {
+			got, err := parseNetOutputConfig(tt.output)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseNetOutputConfig() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			if got.TLS == nil || got.TLS.ServerName != tt.serverName || got.Protocol != protocol.NetProtocolTCP || got.Port != 6380 {
+				t.Errorf("parseNetOutputConfig() = %+v, tls %+v", got, got.TLS)
+			}
+		})
+	}
+}
+
+func Test_parseNetOutputWebSocket(t *testing.T) {
+	tests := []struct {
+		output   string
+		protocol protocol.NetProtocol
+		tls      bool
+		wantErr  bool
+	}{
+		{"gw.example.com:80@ws", protocol.NetProtocolWS, false, false},
+		{"gw.example.com:443@WSS#sni=edge.example.com", protocol.NetProtocolWSS, true, false},
+		{"gw.example.com:80@ws#sni=edge.example.com", "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.output, func(t *testing.T) {
+			got, err := parseNetOutputConfig(tt.output)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseNetOutputConfig() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			if got.Protocol != tt.protocol || (got.TLS != nil) != tt.tls || got.WebSocket == nil || got.WebSocket.Path != "/" {
+				t.Errorf("parseNetOutputConfig() = %+v, websocket %+v", got, got.WebSocket)
+			}
+		})
+	}
+}
+
+func Test_parseHealthCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		check   string
+		want    forwarder.HealthCheckConfig
+		wantErr bool
+	}{
+		{"1", "tcp", forwarder.HealthCheckConfig{Type: forwarder.HealthCheckTCP}, false},
+		{"2", "http:/healthz", forwarder.HealthCheckConfig{Type: forwarder.HealthCheckHTTP, HTTPPath: "/healthz"}, false},
+		{"3", `expect:PING\r\n:+PONG`, forwarder.HealthCheckConfig{Type: forwarder.HealthCheckExpect, Send: []byte("PING\r\n"), Expect: []byte("+PONG")}, false},
+		{"4", "expect:PING", forwarder.HealthCheckConfig{}, true},
+		{"5", "icmp", forwarder.HealthCheckConfig{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHealthCheck(tt.check)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseHealthCheck() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			if got.Type != tt.want.Type || got.HTTPPath != tt.want.HTTPPath ||
+				string(got.Send) != string(tt.want.Send) || string(got.Expect) != string(tt.want.Expect) {
+				t.Errorf("parseHealthCheck() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseByteSize(t *testing.T) {
+	tests := []struct {
+		size    string
+		want    int64
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"512", 512, false},
+		{"32K", 32 * 1024, false},
+		{"32kb", 32 * 1024, false},
+		{"1.5M", 1536 * 1024, false},
+		{"2GiB", 2 << 30, false},
+		{"abc", 0, true},
+		{"-1K", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.size, func(t *testing.T) {
+			got, err := parseByteSize(tt.size)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseByteSize() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("parseByteSize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseRateLimit(t *testing.T) {
+	tests := []struct {
+		rate    string
+		want    forwarder.RateLimit
+		wantErr bool
+	}{
+		{"", forwarder.RateLimit{}, false},
+		{"1M", forwarder.RateLimit{BytesPerSecond: 1 << 20}, false},
+		{"512K:4M", forwarder.RateLimit{BytesPerSecond: 512 << 10, Burst: 4 << 20}, false},
+		{"1M:", forwarder.RateLimit{}, true},
+		{"fast", forwarder.RateLimit{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rate, func(t *testing.T) {
+			got, err := parseRateLimit(tt.rate)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseRateLimit() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parseRateLimit() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseMatchHost(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    forwarder.MatchHostConfig
+		wantErr bool
+	}{
+		{"10.0.0.0/8", forwarder.MatchHostConfig{Match: "10.0.0.0/8", AnyProto: true}, false},
+		{"192.0.2.1:8000-9000@tcp", forwarder.MatchHostConfig{Match: "192.0.2.1:8000-9000", Protocol: protocol.NetProtocolTCP}, false},
+		{"[2001:db8::1]:53@UDP", forwarder.MatchHostConfig{Match: "[2001:db8::1]:53", Protocol: protocol.NetProtocolUDP}, false},
+		{"192.0.2.1@sctp", forwarder.MatchHostConfig{}, true},
+		{"@tcp", forwarder.MatchHostConfig{}, true},
+		{"10.0.0.0/8@tcp#backup-*", forwarder.MatchHostConfig{Match: "10.0.0.0/8", Protocol: protocol.NetProtocolTCP, Identity: "backup-*"}, false},
+		{"#alice", forwarder.MatchHostConfig{Match: "*", AnyProto: true, Identity: "alice"}, false},
+		{"10.0.0.1#", forwarder.MatchHostConfig{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			got, err := parseMatchHost(tt.pattern)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseMatchHost() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("parseMatchHost() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_readListFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allow.txt")
+	content := "# office\n10.0.0.0/8\n\n#\n  # indented comment\n#alice\n\t#bob@tcp\n#\tcomment\n192.0.2.1#carol\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readListFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.0/8", "#alice", "#bob@tcp", "192.0.2.1#carol"}
+	if !slices.Equal(got, want) {
+		t.Errorf("readListFile() = %q, want %q", got, want)
+	}
+}
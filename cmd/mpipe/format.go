@@ -6,6 +6,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/doraemonkeys/monster-pipe-core/internal/config"
 	"github.com/doraemonkeys/monster-pipe-core/internal/forwarder"
 	"github.com/fatih/color"
 )
@@ -49,6 +50,14 @@ func printMessage(message forwarder.ForwardMessage) {
 		)
 	case forwarder.ForwardMsgTypeAcceptError:
 		fmt.Printf("[%s] %s: %s\n", red(timestamp), red("Connection Accepted Error"), red(message.Err))
+	case forwarder.ForwardMsgTypeMemoryExhausted, forwarder.ForwardMsgTypeConnLimited, forwarder.ForwardMsgTypeQuotaExceeded:
+		fmt.Printf("[%s] %s: %s | %s\n", red(timestamp), red("Connection Refused"), blue(message.ConnAddr.String()), red(message.Err))
+	case forwarder.ForwardMsgTypeClientBanned:
+		fmt.Printf("[%s] %s: %s | %s\n", red(timestamp), red("Client Banned"), blue(message.ConnAddr.String()), red(message.Err))
+	case forwarder.ForwardMsgTypeHandshakeError:
+		fmt.Printf("[%s] %s: %s | %s\n", red(timestamp), red("Handshake Error"), blue(message.ConnAddr.String()), red(message.Err))
+	case forwarder.ForwardMsgTypeAuthenticated:
+		fmt.Printf("[%s] %s: %s as %s\n", green(timestamp), green("Client Authenticated"), blue(message.ConnAddr.String()), magenta(message.ClientIdentity))
 	case forwarder.ForwardMsgTypeTunnel:
 		if message.TunnelMsg != nil {
 			tunnelMsg := message.TunnelMsg
@@ -61,10 +70,24 @@ func printMessage(message forwarder.ForwardMessage) {
 				fmt.Printf("[%s] %s: %s <- %s | %s\n", red(timestamp), red("Write -> Output Error"), blue(message.ConnAddr.String()), yellow(tunnelMsg.Address()), red(tunnelMsg.Err))
 			case forwarder.ForwardConnMsgTypeOutputReadError:
 				fmt.Printf("[%s] %s: %s <- %s | %s\n", red(timestamp), red("Read <- Output Error"), blue(message.ConnAddr.String()), yellow(tunnelMsg.Address()), red(tunnelMsg.Err))
+			case forwarder.ForwardConnMsgTypeOutputQueueDisconnect:
+				fmt.Printf("[%s] %s: %s -> %s | %s\n", red(timestamp), red("Output Queue Full, Disconnected"), blue(message.ConnAddr.String()), yellow(tunnelMsg.Address()), red(tunnelMsg.Err))
+			case forwarder.ForwardConnMsgTypeDialRetry:
+				fmt.Printf("[%s] %s: %s -> %s | %s\n", yellow(timestamp), yellow("Dial Output Retry"), blue(message.ConnAddr.String()), yellow(tunnelMsg.Address()), red(tunnelMsg.Err))
+			case forwarder.ForwardConnMsgTypeCircuitOpen:
+				fmt.Printf("[%s] %s: %s -> %s | %s\n", red(timestamp), red("Output Circuit Open"), blue(message.ConnAddr.String()), yellow(tunnelMsg.Address()), red(tunnelMsg.Err))
+			case forwarder.ForwardConnMsgTypeIdleTimeout, forwarder.ForwardConnMsgTypeLifetimeExceeded, forwarder.ForwardConnMsgTypeForceClosed:
+				fmt.Printf("[%s] %s: %s | %s\n", yellow(timestamp), yellow(tunnelLimitTitle(tunnelMsg.MessageType)), blue(message.ConnAddr.String()), yellow(tunnelMsg.Err))
 			case forwarder.ForwardConnMsgTypeTunnelClosed:
-				fmt.Printf("[%s] %s : %s by %s\n", yellow(timestamp), yellow("Tunnel Closed"), blue(message.ConnAddr.String()), closedBy(message.TunnelMsg.ClosedByOutput))
+				fmt.Printf("[%s] %s : %s by %s | %s\n", yellow(timestamp), yellow("Tunnel Closed"), blue(message.ConnAddr.String()), closedBy(message.TunnelMsg.ClosedByOutput), transferred(tunnelMsg))
 			}
 		}
+	case forwarder.ForwardMsgTypeOutputHealth:
+		printHealthMessage(timestamp, message.HealthMsg)
+	case forwarder.ForwardMsgTypeUDPSession:
+		printUDPSessionMessage(timestamp, message, false)
+	case forwarder.ForwardMsgTypeDraining:
+		fmt.Printf("[%s] %s: %s\n", yellow(timestamp), yellow("Draining"), yellow(message.Err))
 	case forwarder.ForwardMsgTypeCommonError:
 		fmt.Printf("[%s] %s: %s\n", red(timestamp), red("Error"), red(message.Err))
 	}
@@ -87,6 +110,18 @@ func printMessageVerbose(message forwarder.ForwardMessage) {
 			red("Connection Accept Error"),
 			red(message.Err),
 		)
+	case forwarder.ForwardMsgTypeMemoryExhausted, forwarder.ForwardMsgTypeConnLimited, forwarder.ForwardMsgTypeQuotaExceeded:
+		fmt.Printf("[%s] %s: %s | %s\n",
+			red(timestamp), red("Connection Refused"), blue(message.ConnAddr.String()), red(message.Err))
+	case forwarder.ForwardMsgTypeClientBanned:
+		fmt.Printf("[%s] %s: %s | %s\n",
+			red(timestamp), red("Client Banned"), blue(message.ConnAddr.String()), red(message.Err))
+	case forwarder.ForwardMsgTypeHandshakeError:
+		fmt.Printf("[%s] %s: %s | %s\n",
+			red(timestamp), red("Handshake Error"), blue(message.ConnAddr.String()), red(message.Err))
+	case forwarder.ForwardMsgTypeAuthenticated:
+		fmt.Printf("[%s] %s: %s as %s\n",
+			green(timestamp), green("Client Authenticated"), blue(message.ConnAddr.String()), magenta(message.ClientIdentity))
 	case forwarder.ForwardMsgTypeTunnel:
 		if message.TunnelMsg != nil {
 			tunnelMsg := message.TunnelMsg
@@ -118,17 +153,101 @@ func printMessageVerbose(message forwarder.ForwardMessage) {
 			case forwarder.ForwardConnMsgTypeWriteToOutputError:
 				fmt.Printf("[%s] %s: %s -> %s | %s\n",
 					red(timestamp), red("Write -> Output Error"), connAddrStr, outputAddrStr, red(tunnelMsg.Err))
+			case forwarder.ForwardConnMsgTypeOutputQueueDropped:
+				fmt.Printf("[%s] %s: %s -> %s | %d bytes, %d chunks dropped\n",
+					red(timestamp), red("Output Queue Full, Dropped"), connAddrStr, outputAddrStr, tunnelMsg.DroppedBytes, tunnelMsg.Dropped)
+			case forwarder.ForwardConnMsgTypeOutputQueueDisconnect:
+				fmt.Printf("[%s] %s: %s -> %s | %s\n",
+					red(timestamp), red("Output Queue Full, Disconnected"), connAddrStr, outputAddrStr, red(tunnelMsg.Err))
+			case forwarder.ForwardConnMsgTypeDialRetry:
+				fmt.Printf("[%s] %s: %s -> %s | %s\n",
+					yellow(timestamp), yellow("Dial Output Retry"), connAddrStr, outputAddrStr, red(tunnelMsg.Err))
+			case forwarder.ForwardConnMsgTypeCircuitOpen:
+				fmt.Printf("[%s] %s: %s -> %s | %s\n",
+					red(timestamp), red("Output Circuit Open"), connAddrStr, outputAddrStr, red(tunnelMsg.Err))
+			case forwarder.ForwardConnMsgTypeIdleTimeout, forwarder.ForwardConnMsgTypeLifetimeExceeded, forwarder.ForwardConnMsgTypeForceClosed:
+				fmt.Printf("[%s] %s: %s | %s\n",
+					yellow(timestamp), yellow(tunnelLimitTitle(tunnelMsg.MessageType)), connAddrStr, yellow(tunnelMsg.Err))
 			case forwarder.ForwardConnMsgTypeTunnelClosed:
-				fmt.Printf("[%s] %s : %s by %s\n",
-					yellow(timestamp), yellow("Tunnel Closed"), connAddrStr, closedBy(message.TunnelMsg.ClosedByOutput))
+				fmt.Printf("[%s] %s : %s by %s | %s\n",
+					yellow(timestamp), yellow("Tunnel Closed"), connAddrStr, closedBy(message.TunnelMsg.ClosedByOutput), transferred(tunnelMsg))
 			}
 		}
+	case forwarder.ForwardMsgTypeOutputHealth:
+		printHealthMessage(timestamp, message.HealthMsg)
+	case forwarder.ForwardMsgTypeUDPSession:
+		printUDPSessionMessage(timestamp, message, true)
+	case forwarder.ForwardMsgTypeDraining:
+		fmt.Printf("[%s] %s: %s\n",
+			yellow(timestamp), yellow("Draining"), yellow(message.Err))
 	case forwarder.ForwardMsgTypeCommonError:
 		fmt.Printf("[%s] %s: %s\n",
 			red(timestamp), red("Common Error"), red(message.Err))
 	}
 }
 
+func printHealthMessage(timestamp string, healthMsg *forwarder.ForwardHealthMessage) {
+	if healthMsg == nil {
+		return
+	}
+	if healthMsg.Healthy {
+		fmt.Printf("[%s] %s: %s\n", green(timestamp), green("Output Healthy"), yellow(healthMsg.Output.Target()))
+		return
+	}
+	fmt.Printf("[%s] %s: %s | %s\n", red(timestamp), red("Output Unhealthy"), yellow(healthMsg.Output.Target()), red(healthMsg.Err))
+}
+
+// printUDPSessionMessage prints the expired and rejected sessions, the created ones are only printed in verbose mode
+// since their Connection Accepted follows, and the closed ones when they lost datagrams.
+func printUDPSessionMessage(timestamp string, message forwarder.ForwardMessage, verbose bool) {
+	udpMsg := message.UDPSession
+	if udpMsg == nil {
+		return
+	}
+	switch udpMsg.Event {
+	case forwarder.UDPSessionCreated:
+		if verbose {
+			fmt.Printf("[%s] %s: %s | %d sessions\n", green(timestamp), green("UDP Session Created"), blue(message.ConnAddr.String()), udpMsg.Sessions)
+		}
+	case forwarder.UDPSessionExpired:
+		fmt.Printf("[%s] %s: %s | %d sessions left%s\n", yellow(timestamp), yellow("UDP Session Expired"), blue(message.ConnAddr.String()), udpMsg.Sessions, lostDatagrams(udpMsg))
+	case forwarder.UDPSessionClosed:
+		if verbose || udpMsg.Dropped > 0 || udpMsg.Oversized > 0 {
+			fmt.Printf("[%s] %s: %s | %d sessions left%s\n", yellow(timestamp), yellow("UDP Session Closed"), blue(message.ConnAddr.String()), udpMsg.Sessions, lostDatagrams(udpMsg))
+		}
+	case forwarder.UDPSessionRejected:
+		fmt.Printf("[%s] %s: %s | %s, %d datagrams\n", red(timestamp), red("UDP Session Rejected"), blue(message.ConnAddr.String()), red(message.Err), udpMsg.Dropped)
+	}
+}
+
+func lostDatagrams(udpMsg *forwarder.UDPSessionMessage) string {
+	var lost string
+	if udpMsg.Dropped > 0 {
+		lost += fmt.Sprintf(", %d datagrams dropped", udpMsg.Dropped)
+	}
+	if udpMsg.Oversized > 0 {
+		lost += fmt.Sprintf(", %d datagrams over the size limit", udpMsg.Oversized)
+	}
+	if lost == "" {
+		return ""
+	}
+	return red(lost)
+}
+
+func tunnelLimitTitle(messageType forwarder.ForwardConnMessageType) string {
+	switch messageType {
+	case forwarder.ForwardConnMsgTypeIdleTimeout:
+		return "Tunnel Idle Timeout"
+	case forwarder.ForwardConnMsgTypeLifetimeExceeded:
+		return "Tunnel Max Lifetime"
+	}
+	return "Tunnel Force Closed"
+}
+
+func transferred(tunnelMsg *forwarder.ForwardConnMessage) string {
+	return fmt.Sprintf("%d bytes in, %d bytes out", tunnelMsg.InputBytes, tunnelMsg.OutputBytes)
+}
+
 func closedBy(byOutput bool) string {
 	if byOutput {
 		return yellow("output")
@@ -139,7 +258,7 @@ func closedBy(byOutput bool) string {
 // prettyPrintConfig formats and prints the input and output configurations.
 // It assumes ForwardInputConfig and ForwardOutputConfig have fields like
 // Host, Port, Protocol, Blacklist, Whitelist, Readable, Writable.
-func prettyPrintConfig(input forwarder.ForwardInputConfig, outputs []forwarder.ForwardOutputConfig) {
+func prettyPrintConfig(input forwarder.ForwardInputConfig, outputs []forwarder.ForwardOutputConfig, outputParts []string) {
 	fmt.Println(green("--- Configuration Summary ---"))
 
 	// --- Input Configuration ---
@@ -151,6 +270,16 @@ func prettyPrintConfig(input forwarder.ForwardInputConfig, outputs []forwarder.F
 	}
 	listenAddr := net.JoinHostPort(listenHost, strconv.Itoa(input.Port))
 	fmt.Printf("  %-12s %s (%s)\n", white("Address:"), blue(listenAddr), cyan(input.Protocol.String()))
+	if input.TLS != nil && selfSignedCert != nil {
+		fmt.Printf("  %-12s %s%s\n", white("TLS:"), cyan("self-signed, valid until "+selfSignedCert.Leaf().NotAfter.Format(time.DateTime)), iif(input.TLS.ClientCAFile != "", green(" (mutual)"), ""))
+		fmt.Printf("  %-12s SHA-256 %s\n", white("CA:"), magenta(config.Fingerprint(selfSignedCert.CA())))
+		fmt.Printf("  %-12s SHA-256 %s\n", white("Certificate:"), magenta(config.Fingerprint(selfSignedCert.Leaf())))
+	} else if input.TLS != nil {
+		fmt.Printf("  %-12s %s%s\n", white("TLS:"), cyan(input.TLS.CertFile), iif(input.TLS.ClientCAFile != "", green(" (mutual)"), ""))
+	}
+	if input.WebSocket != nil {
+		fmt.Printf("  %-12s %s\n", white("WebSocket:"), cyan(input.WebSocket.Path))
+	}
 
 	// Print Blacklist/Whitelist if they exist and are non-empty
 	// Assuming Blacklist/Whitelist are slices of a type with a String() method, or just []string
@@ -181,8 +310,10 @@ func prettyPrintConfig(input forwarder.ForwardInputConfig, outputs []forwarder.F
 
 		targetHost := output.Host
 		targetDesc := ""
-		if targetHost == "ssh" {
-			targetHost = "localhost (via SSH)" // Clarify SSH forwarding
+		if isSSHAddr(outputParts[i]) {
+			if targetHost == "" {
+				targetHost = "localhost (via SSH)" // Clarify SSH forwarding
+			}
 			targetDesc = yellow(" (SSH Tunnel)")
 		}
 		targetAddr := net.JoinHostPort(targetHost, strconv.Itoa(output.Port))
@@ -198,6 +329,32 @@ func prettyPrintConfig(input forwarder.ForwardInputConfig, outputs []forwarder.F
 		writableStr := iif(output.Writable, green("Yes"), red("No"))
 		fmt.Printf("    %-10s %s\n", white("Readable:"), readableStr)
 		fmt.Printf("    %-10s %s\n", white("Writable:"), writableStr)
+		if output.Role != forwarder.ForwardOutputRoleNormal {
+			fmt.Printf("    %-10s %s\n", white("Role:"), cyan(output.Role.String()))
+		}
+		if output.TLS != nil {
+			serverName := output.TLS.ServerName
+			if serverName == "" {
+				serverName = output.Host
+			}
+			fmt.Printf("    %-10s %s%s\n", white("TLS:"), cyan(serverName), iif(output.TLS.InsecureSkipVerify, red(" (insecure)"), ""))
+		}
+		if output.WebSocket != nil {
+			fmt.Printf("    %-10s %s\n", white("WebSocket:"), cyan(output.WebSocket.Path))
+		}
+		if output.Backup {
+			fmt.Printf("    %-10s %s\n", white("Backup:"), green("Yes"))
+		}
+		if output.HealthCheck != nil {
+			fmt.Printf("    %-10s %s every %s\n", white("Check:"), cyan(output.HealthCheck.Type.String()), output.HealthCheck.Interval)
+		}
+		if output.Weight > 0 {
+			fmt.Printf("    %-10s %d\n", white("Weight:"), output.Weight)
+		}
+		if output.WriteQueueSize > 0 || output.OverflowPolicy != forwarder.ForwardOutputOverflowDefault {
+			queueSize := iif(output.WriteQueueSize > 0, strconv.Itoa(output.WriteQueueSize), "default")
+			fmt.Printf("    %-10s %s chunks, %s on overflow\n", white("Queue:"), queueSize, cyan(output.OverflowPolicy.String()))
+		}
 	}
 
 	fmt.Println(green("-----------------------------")) // Footer
@@ -6,6 +6,10 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/doraemonkeys/monster-pipe-core/internal/forwarder"
 	"golang.org/x/crypto/ssh"
@@ -13,7 +17,22 @@ import (
 
 func main() {
 	flag.Parse()
+	if *secureGenKeyCmd {
+		if err := printSecureKeyPair(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	args := flag.Args()
+	if *stdioCmd {
+		if len(args) != 1 {
+			log.Fatal("-stdio needs one address, e.g. mpipe -stdio 127.0.0.1:53@udp")
+		}
+		if err := runStdio(args[0]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	// for _, arg := range args {
 	// 	fmt.Println(arg)
 	// }
@@ -44,26 +63,48 @@ func main() {
 		fmt.Println(err)
 		return
 	}
+	outputParts := strings.Split(strings.TrimSpace(outputCmd), ",")
+	if err := checkSSHUDPRelay(*sshUDPRelayCmd, outputs, outputParts); err != nil {
+		fmt.Println(err)
+		return
+	}
 	var ForwardOutputs []*forwarder.ForwardOutput = make([]*forwarder.ForwardOutput, 0, len(outputs))
-	for _, output := range outputs {
-		if output.Host == "ssh" && sshClient == nil {
+	for i, output := range outputs {
+		viaSSH := isSSHAddr(outputParts[i])
+		if viaSSH && sshClient == nil {
 			log.Fatal("ssh client config not found")
 		}
-		if output.Host == "ssh" && sshClient != nil {
-			ForwardOutputs = append(ForwardOutputs,
-				forwarder.NewForwardOutput(output, func(_ context.Context, network string, address string) (net.Conn, error) {
-					// fmt.Println("sshClient.Dial(network, address): ", network, address)
-					return sshClient.Dial(network, address)
-				}))
-		} else {
-			ForwardOutputs = append(ForwardOutputs, forwarder.NewForwardOutput(output, nil))
+		dial := forwarder.DefaultDial
+		if viaSSH && sshClient != nil {
+			dial = func(_ context.Context, network string, address string) (net.Conn, error) {
+				// fmt.Println("sshClient.Dial(network, address): ", network, address)
+				return sshClient.Dial(network, address)
+			}
+			if strings.HasPrefix(string(output.Protocol), "udp") {
+				dial = sshUDPDial(sshClient)
+			}
+		}
+		dial, err = wrapOutputDial(dial, strings.HasPrefix(string(output.Protocol), "udp"))
+		if err != nil {
+			fmt.Println(err)
+			return
 		}
+		ForwardOutputs = append(ForwardOutputs, forwarder.NewForwardOutput(output, dial))
 		// fmt.Printf("Output(%d): %#v\n", i, output)
 	}
 
-	prettyPrintConfig(input.Config, outputs)
+	forwarderConfig, err := parseForwarderConfig()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	prettyPrintConfig(input.Config, outputs, outputParts)
+	if forwarderConfig.Mode != forwarder.ForwardModeFanOut {
+		fmt.Printf("%s %s\n", yellow("Mode:"), cyan(forwarderConfig.Mode.String()))
+	}
 
-	f := forwarder.NewForwarder(input, ForwardOutputs, func(message forwarder.ForwardMessage) {
+	f := forwarder.NewForwarderWithConfig(forwarderConfig, input, ForwardOutputs, func(message forwarder.ForwardMessage) {
 		// fmt.Println("message: ", message)
 		// print message
 		if *verboseCmd {
@@ -75,7 +116,18 @@ func main() {
 
 	fmt.Println(green("\nStarting forwarder..."))
 
-	err = f.Run(context.Background())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		// A second signal exits without waiting for the drain.
+		stop()
+		fmt.Println(yellow("\nDraining, press Ctrl+C again to force exit..."))
+	}()
+
+	go watchAccessLists(ctx, input)
+
+	err = f.Run(ctx)
 	if err != nil {
 		fmt.Println(red("Forwarder stopped with error:"), err)
 	} else {
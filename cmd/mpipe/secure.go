@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/doraemonkeys/monster-pipe-core/pkg/protocol/secure"
+)
+
+var (
+	securePSKCmd            *string        = flag.String("secure-psk", "", "file with the pre-shared key of the @secure inputs and outputs")
+	secureKeyCmd            *string        = flag.String("secure-key", "", "file with the private key of this side of the @secure links, see -secure-genkey")
+	securePeerCmd           *string        = flag.String("secure-peer", "", "public key of the @secure server the outputs connect to")
+	secureAuthorizedKeysCmd *string        = flag.String("secure-authorized-keys", "", "file with the public keys of the clients allowed on the @secure input, one per line")
+	secureRekeyBytesCmd     *string        = flag.String("secure-rekey-bytes", "1GiB", "replace the keys of a @secure link after this many bytes")
+	secureRekeyIntervalCmd  *time.Duration = flag.Duration("secure-rekey-interval", 15*time.Minute, "replace the keys of a @secure link after this long")
+	secureGenKeyCmd         *bool          = flag.Bool("secure-genkey", false, "print a new key pair for -secure-key and -secure-peer and exit")
+)
+
+func printSecureKeyPair() error {
+	privateKey, publicKey, err := secure.GenerateKey()
+	if err != nil {
+		return err
+	}
+	fmt.Println("private key:", secure.EncodeKey(privateKey))
+	fmt.Println("public key: ", secure.EncodeKey(publicKey))
+	return nil
+}
+
+// parseSecureConfig returns the config of the @secure outputs if isClient, of the @secure input otherwise.
+func parseSecureConfig(isClient bool) (*secure.Config, error) {
+	rekeyBytes, err := parseByteSize(*secureRekeyBytesCmd)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &secure.Config{
+		RekeyBytes:    rekeyBytes,
+		RekeyInterval: *secureRekeyIntervalCmd,
+	}
+	if *securePSKCmd != "" {
+		if cfg.PSK, err = readPSK(*securePSKCmd); err != nil {
+			return nil, err
+		}
+	}
+	if *secureKeyCmd != "" {
+		content, err := os.ReadFile(*secureKeyCmd)
+		if err != nil {
+			return nil, fmt.Errorf("read secure key: %w", err)
+		}
+		if cfg.PrivateKey, err = secure.ParseKey(string(content)); err != nil {
+			return nil, err
+		}
+	}
+	if isClient && *securePeerCmd != "" {
+		if cfg.PeerPublicKey, err = secure.ParseKey(*securePeerCmd); err != nil {
+			return nil, err
+		}
+	}
+	if !isClient && *secureAuthorizedKeysCmd != "" {
+		keys, err := readListFile(*secureAuthorizedKeysCmd)
+		if err != nil {
+			return nil, fmt.Errorf("read secure authorized keys: %w", err)
+		}
+		for _, key := range keys {
+			publicKey, err := secure.ParseKey(key)
+			if err != nil {
+				return nil, err
+			}
+			cfg.AuthorizedKeys = append(cfg.AuthorizedKeys, publicKey)
+		}
+	}
+	if err := cfg.Validate(isClient); err != nil {
+		return nil, fmt.Errorf("%w, see -secure-psk, -secure-key and -secure-peer", err)
+	}
+	return cfg, nil
+}
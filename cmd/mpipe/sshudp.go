@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/doraemonkeys/monster-pipe-core/internal/forwarder"
+	"github.com/doraemonkeys/monster-pipe-core/pkg/protocol/tcp"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	sshUDPCmd      *string = flag.String("ssh-udp-cmd", "mpipe", "command run on the ssh server for the ssh:...@udp outputs, it is given -stdio host:port@udp")
+	sshUDPRelayCmd *int    = flag.Int("ssh-udp-relay", 0, "send the datagrams of the ssh:...@udp output to the companion 'mpipe 127.0.0.1:PORT@framed target@udp' on the ssh server instead of running -ssh-udp-cmd. The companion decides the target, so all the ssh:...@udp outputs must have the same one")
+	stdioCmd       *bool   = flag.Bool("stdio", false, "forward stdin and stdout to the address given as the only argument, the datagrams of a @udp address are framed. Used by the ssh:...@udp outputs")
+)
+
+const stdioBufferSize = 64 * 1024
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// pipeConn is a net.Conn over a reader and a writer, the stdio of mpipe or of a remote command.
+// It has no deadlines, the tunnel closes it to unblock the reads.
+type pipeConn struct {
+	io.Reader
+	io.WriteCloser
+	close  func() error
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *pipeConn) Close() error {
+	err := c.WriteCloser.Close()
+	if c.close != nil {
+		err = errors.Join(err, c.close())
+	}
+	return err
+}
+
+// CloseWrite closes the writer, the other side reads EOF.
+func (c *pipeConn) CloseWrite() error                { return c.WriteCloser.Close() }
+func (c *pipeConn) LocalAddr() net.Addr              { return c.local }
+func (c *pipeConn) RemoteAddr() net.Addr             { return c.remote }
+func (c *pipeConn) SetDeadline(time.Time) error      { return nil }
+func (c *pipeConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *pipeConn) SetWriteDeadline(time.Time) error { return nil }
+
+// stderrBuffer keeps the beginning of the stderr of a remote command, for the error message when it fails.
+type stderrBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *stderrBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if room := 1024 - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+func (b *stderrBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.TrimSpace(b.buf.String())
+}
+
+// execReader reports why the remote command ended when its stdout reaches EOF.
+type execReader struct {
+	io.Reader
+	session *ssh.Session
+	command string
+	stderr  *stderrBuffer
+}
+
+func (r *execReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if errors.Is(err, io.EOF) {
+		if waitErr := r.session.Wait(); waitErr != nil {
+			return n, fmt.Errorf("remote command %q: %w: %s", r.command, waitErr, r.stderr)
+		}
+	}
+	return n, err
+}
+
+// checkSSHUDPRelay rejects the ssh:...@udp outputs with different targets when they all go to the one relay of relayPort.
+func checkSSHUDPRelay(relayPort int, outputs []forwarder.ForwardOutputConfig, outputParts []string) error {
+	if relayPort <= 0 {
+		return nil
+	}
+	var targets []string
+	for i, output := range outputs {
+		if !isSSHAddr(outputParts[i]) || !strings.HasPrefix(string(output.Protocol), "udp") {
+			continue
+		}
+		if !slices.Contains(targets, output.Target()) {
+			targets = append(targets, output.Target())
+		}
+	}
+	if len(targets) > 1 {
+		return fmt.Errorf("-ssh-udp-relay forwards to the one target of its companion, the ssh udp outputs have %d: %s", len(targets), strings.Join(targets, ", "))
+	}
+	return nil
+}
+
+// sshUDPDial returns the dialer of the ssh:...@udp outputs, ssh.Client.Dial only opens TCP channels.
+// Every tunnel runs -ssh-udp-cmd in its own session, or connects to the -ssh-udp-relay companion, and the datagrams are framed by pkg/protocol/tcp.
+func sshUDPDial(client *ssh.Client) dialFunc {
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if host == "" {
+			// ssh:53@udp is the port on the ssh server.
+			host = "localhost"
+		}
+		if *sshUDPRelayCmd > 0 {
+			conn, err := client.DialContext(ctx, "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(*sshUDPRelayCmd)))
+			if err != nil {
+				return nil, fmt.Errorf("ssh udp relay: %w", err)
+			}
+			return tcp.NewConn(conn), nil
+		}
+		session, err := client.NewSession()
+		if err != nil {
+			return nil, fmt.Errorf("ssh session: %w", err)
+		}
+		stdin, err := session.StdinPipe()
+		if err != nil {
+			_ = session.Close()
+			return nil, err
+		}
+		stdout, err := session.StdoutPipe()
+		if err != nil {
+			_ = session.Close()
+			return nil, err
+		}
+		stderr := &stderrBuffer{}
+		session.Stderr = stderr
+		target := net.JoinHostPort(host, port) + "@" + network
+		command := *sshUDPCmd + " -stdio '" + target + "'"
+		if err := session.Start(command); err != nil {
+			_ = session.Close()
+			return nil, fmt.Errorf("ssh exec %q: %w", command, err)
+		}
+		conn := &pipeConn{
+			Reader:      &execReader{Reader: stdout, session: session, command: command, stderr: stderr},
+			WriteCloser: stdin,
+			close:       session.Close,
+			local:       client.LocalAddr(),
+			remote:      pipeAddr("ssh:" + target),
+		}
+		return tcp.NewConn(conn), nil
+	}
+}
+
+// runStdio is the -stdio mode, it forwards stdin and stdout to the address, see pipeStdio.
+func runStdio(address string) error {
+	cfg, err := parseNetAddrConfig(address, false)
+	if err != nil {
+		return err
+	}
+	conn, err := net.Dial(cfg.Protocol.Network(), net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stdio := &pipeConn{Reader: os.Stdin, WriteCloser: os.Stdout, local: pipeAddr("stdio"), remote: pipeAddr("stdio")}
+	return pipeStdio(stdio, conn, strings.HasPrefix(string(cfg.Protocol), "udp"))
+}
+
+// pipeStdio forwards stdio to conn until both directions are done, the EOF of one side half-closes the other.
+// The datagrams of a UDP conn are framed on stdio, and the end of stdin ends the forwarding since UDP has no EOF.
+func pipeStdio(stdio net.Conn, conn net.Conn, isUDP bool) error {
+	if isUDP {
+		stdio = tcp.NewConn(stdio)
+	}
+	pump := func(dst io.Writer, src io.Reader, done chan<- error) {
+		buf := make([]byte, stdioBufferSize)
+		for {
+			// An empty datagram is read as 0 bytes, it is forwarded like the others.
+			n, err := src.Read(buf)
+			if err == nil {
+				_, err = dst.Write(buf[:n])
+			}
+			// The ICMP errors of a connected UDP socket only mean that a datagram was lost.
+			if isUDP && errors.Is(err, syscall.ECONNREFUSED) {
+				continue
+			}
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					err = nil
+				}
+				done <- err
+				return
+			}
+		}
+	}
+	upstream, downstream := make(chan error, 1), make(chan error, 1)
+	go pump(conn, stdio, upstream)
+	go pump(stdio, conn, downstream)
+	for range 2 {
+		select {
+		case err := <-upstream:
+			if err != nil || isUDP {
+				return err
+			}
+			if err := closeWrite(conn); err != nil {
+				return err
+			}
+		case err := <-downstream:
+			if err != nil {
+				return err
+			}
+			if err := closeWrite(stdio); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/doraemonkeys/monster-pipe-core/internal/forwarder"
+	"github.com/doraemonkeys/monster-pipe-core/pkg/protocol"
+	"github.com/doraemonkeys/monster-pipe-core/pkg/protocol/tcp"
+)
+
+// stdioPipes returns the stdio of pipeStdio, and the ends the test writes stdin to and reads stdout from.
+func stdioPipes() (stdio net.Conn, stdin io.WriteCloser, stdout io.ReadCloser) {
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	return &pipeConn{Reader: stdinR, WriteCloser: stdoutW, local: pipeAddr("stdio"), remote: pipeAddr("stdio")}, stdinW, stdoutR
+}
+
+func runPipeStdio(stdio net.Conn, conn net.Conn, isUDP bool) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- pipeStdio(stdio, conn, isUDP)
+	}()
+	return done
+}
+
+func waitStdio(t *testing.T, done <-chan error) {
+	t.Helper()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("pipeStdio() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pipeStdio() did not return")
+	}
+}
+
+func Test_pipeStdioTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// The target replies after it read everything, so it needs the half-close of stdin.
+		data, _ := io.ReadAll(conn)
+		_, _ = conn.Write(append([]byte("reply:"), data...))
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stdio, stdin, stdout := stdioPipes()
+	done := runPipeStdio(stdio, conn, false)
+	go func() {
+		_, _ = stdin.Write([]byte("hello"))
+		_ = stdin.Close()
+	}()
+	got, err := io.ReadAll(stdout)
+	if err != nil || string(got) != "reply:hello" {
+		t.Errorf("stdout = %q, %v, want %q", got, err, "reply:hello")
+	}
+	waitStdio(t, done)
+}
+
+func Test_pipeStdioUDP(t *testing.T) {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := udpConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = udpConn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	conn, err := net.Dial("udp", udpConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stdio, stdin, stdout := stdioPipes()
+	done := runPipeStdio(stdio, conn, true)
+	framedIn, framedOut := tcp.NewConn(&pipeConn{Reader: strings.NewReader(""), WriteCloser: stdin}), tcp.NewConn(&pipeConn{Reader: stdout, WriteCloser: nopWriteCloser{}})
+	buf := make([]byte, 1500)
+	// The datagrams keep their boundaries, the empty one too.
+	for _, datagram := range []string{"one", "", "three"} {
+		if _, err := framedIn.Write([]byte(datagram)); err != nil {
+			t.Fatal(err)
+		}
+		n, err := framedOut.Read(buf)
+		if err != nil || string(buf[:n]) != datagram {
+			t.Errorf("stdout datagram %q, %v, want %q", buf[:n], err, datagram)
+		}
+	}
+	_ = stdin.Close()
+	waitStdio(t, done)
+}
+
+type nopWriteCloser struct{}
+
+func (nopWriteCloser) Write(b []byte) (int, error) { return len(b), nil }
+func (nopWriteCloser) Close() error                { return nil }
+
+func Test_checkSSHUDPRelay(t *testing.T) {
+	output := func(host string, port int, proto protocol.NetProtocol) forwarder.ForwardOutputConfig {
+		return forwarder.ForwardOutputConfig{NetAddrConfig: forwarder.NetAddrConfig{Host: host, Port: port, Protocol: proto}}
+	}
+	tests := []struct {
+		name    string
+		port    int
+		outputs []forwarder.ForwardOutputConfig
+		parts   []string
+		wantErr bool
+	}{
+		{"one target", 9000,
+			[]forwarder.ForwardOutputConfig{output("10.0.0.2", 53, protocol.NetProtocolUDP), output("10.0.0.2", 53, protocol.NetProtocolUDP)},
+			[]string{"ssh:10.0.0.2:53@udp", "ssh:10.0.0.2:53@udp"}, false},
+		{"two targets", 9000,
+			[]forwarder.ForwardOutputConfig{output("10.0.0.2", 53, protocol.NetProtocolUDP), output("10.0.0.3", 53, protocol.NetProtocolUDP)},
+			[]string{"ssh:10.0.0.2:53@udp", "ssh:10.0.0.3:53@udp"}, true},
+		{"two targets without the relay", 0,
+			[]forwarder.ForwardOutputConfig{output("10.0.0.2", 53, protocol.NetProtocolUDP), output("10.0.0.3", 53, protocol.NetProtocolUDP)},
+			[]string{"ssh:10.0.0.2:53@udp", "ssh:10.0.0.3:53@udp"}, false},
+		{"local and tcp outputs", 9000,
+			[]forwarder.ForwardOutputConfig{output("10.0.0.2", 53, protocol.NetProtocolUDP), output("10.0.0.3", 53, protocol.NetProtocolUDP), output("10.0.0.4", 53, protocol.NetProtocolTCP)},
+			[]string{"ssh:10.0.0.2:53@udp", "10.0.0.3:53@udp", "ssh:10.0.0.4:53"}, false},
+	}
+	for _, tt := range tests {
+		if err := checkSSHUDPRelay(tt.port, tt.outputs, tt.parts); (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkSSHUDPRelay() = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/doraemonkeys/monster-pipe-core/internal/config"
+	"github.com/doraemonkeys/monster-pipe-core/internal/forwarder"
+)
+
+var (
+	inTLSCertCmd       *string   = flag.String("in-tls-cert", "", "PEM certificate file, terminates TLS on the input")
+	inTLSKeyCmd        *string   = flag.String("in-tls-key", "", "PEM private key file of -in-tls-cert")
+	inTLSMinVersionCmd *string   = flag.String("in-tls-min-version", "1.2", "lowest TLS version accepted on the input, 1.0, 1.1, 1.2 or 1.3")
+	inTLSClientCACmd   *string   = flag.String("in-tls-client-ca", "", "PEM file of the CAs that sign the client certificates, enables mutual TLS")
+	inTLSSubjectsCmd   *listFlag = newListFlag("in-tls-allow-subject", "only accept the client certificates with this common name, DNS name, email or subject, can be repeated")
+
+	inTLSSelfSignedCmd *bool          = flag.Bool("in-tls-self-signed", false, "terminate TLS on the input with a certificate signed by a CA generated on the first run, the certificate is rotated before it expires")
+	inTLSHostsCmd      *listFlag      = newListFlag("in-tls-host", "DNS name or IP address of the self-signed certificate, can be repeated, default localhost, the input host and the host name")
+	inTLSValidityCmd   *time.Duration = flag.Duration("in-tls-validity", 30*24*time.Hour, "validity of the self-signed certificate")
+	certDirCmd         *string        = flag.String("cert-dir", "", "directory of the generated CA and certificate, default mpipe in the user config directory")
+
+	outTLSCACmd         *string = flag.String("out-tls-ca", "", "PEM file of the CAs trusted for the @tls outputs, default the system roots")
+	outTLSCertCmd       *string = flag.String("out-tls-cert", "", "PEM client certificate file presented to the @tls outputs")
+	outTLSKeyCmd        *string = flag.String("out-tls-key", "", "PEM private key file of -out-tls-cert")
+	outTLSMinVersionCmd *string = flag.String("out-tls-min-version", "1.2", "lowest TLS version accepted from the @tls outputs, 1.0, 1.1, 1.2 or 1.3")
+	outTLSInsecureCmd   *bool   = flag.Bool("out-tls-insecure", false, "do not verify the certificates of the @tls outputs, for testing only")
+)
+
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("invalid tls version: %s", version)
+}
+
+// selfSignedCert is the certificate of -in-tls-self-signed, its fingerprints are printed with the configuration.
+var selfSignedCert *config.SelfSignedCert
+
+// parseInputTLS returns nil if neither -in-tls-cert nor -in-tls-self-signed is set.
+func parseInputTLS(addr forwarder.NetAddrConfig) (*forwarder.InputTLSConfig, error) {
+	if *inTLSCertCmd == "" && !*inTLSSelfSignedCmd {
+		if *inTLSKeyCmd != "" || *inTLSClientCACmd != "" || len(*inTLSSubjectsCmd) > 0 {
+			return nil, fmt.Errorf("the -in-tls flags need -in-tls-cert or -in-tls-self-signed")
+		}
+		return nil, nil
+	}
+	if strings.HasPrefix(string(addr.Protocol), "udp") {
+		return nil, fmt.Errorf("tls needs a tcp input")
+	}
+	minVersion, err := parseTLSVersion(*inTLSMinVersionCmd)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &forwarder.InputTLSConfig{
+		CertFile:        *inTLSCertCmd,
+		KeyFile:         *inTLSKeyCmd,
+		MinVersion:      minVersion,
+		ClientCAFile:    *inTLSClientCACmd,
+		AllowedSubjects: *inTLSSubjectsCmd,
+	}
+	if !*inTLSSelfSignedCmd {
+		if *inTLSKeyCmd == "" {
+			return nil, fmt.Errorf("-in-tls-cert needs -in-tls-key")
+		}
+		return tlsConfig, nil
+	}
+	if *inTLSCertCmd != "" || *inTLSKeyCmd != "" {
+		return nil, fmt.Errorf("-in-tls-self-signed can't be combined with -in-tls-cert")
+	}
+	dir := *certDirCmd
+	if dir == "" {
+		userDir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, fmt.Errorf("find the certificate directory, set -cert-dir: %w", err)
+		}
+		dir = filepath.Join(userDir, "mpipe")
+	}
+	selfSignedCert, err = config.NewSelfSignedCert(config.SelfSignedConfig{
+		Dir:      dir,
+		Hosts:    selfSignedHosts(addr.Host),
+		Validity: *inTLSValidityCmd,
+		OnRotate: func(cert *x509.Certificate, err error) {
+			if err != nil {
+				fmt.Println(red("TLS certificate rotation failed, the current certificate is kept:"), err)
+				return
+			}
+			fmt.Printf("%s valid until %s, SHA-256 %s\n", green("TLS certificate rotated:"), cert.NotAfter.Format(time.DateTime), config.Fingerprint(cert))
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("self-signed certificate: %w", err)
+	}
+	tlsConfig.GetCertificate = selfSignedCert.GetCertificate
+	return tlsConfig, nil
+}
+
+// selfSignedHosts returns the -in-tls-host names, or the names the clients are likely to use.
+func selfSignedHosts(listenHost string) []string {
+	if len(*inTLSHostsCmd) > 0 {
+		return *inTLSHostsCmd
+	}
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if ip := net.ParseIP(listenHost); listenHost != "" && (ip == nil || !ip.IsUnspecified()) && !slices.Contains(hosts, listenHost) {
+		hosts = append(hosts, listenHost)
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		hosts = append(hosts, hostname)
+	}
+	return hosts
+}
+
+// newOutputTLS returns the TLS config of a @tls output, the per output options like #sni= are set on it later.
+func newOutputTLS() (*forwarder.OutputTLSConfig, error) {
+	if (*outTLSCertCmd == "") != (*outTLSKeyCmd == "") {
+		return nil, fmt.Errorf("-out-tls-cert and -out-tls-key go together")
+	}
+	minVersion, err := parseTLSVersion(*outTLSMinVersionCmd)
+	if err != nil {
+		return nil, err
+	}
+	return &forwarder.OutputTLSConfig{
+		CAFile:             *outTLSCACmd,
+		CertFile:           *outTLSCertCmd,
+		KeyFile:            *outTLSKeyCmd,
+		InsecureSkipVerify: *outTLSInsecureCmd,
+		MinVersion:         minVersion,
+	}, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/doraemonkeys/monster-pipe-core/pkg/protocol/ws"
+)
+
+// headerFlag is a repeatable "Name: value" flag, unlike listFlag the value may hold commas.
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	parts := make([]string, 0, len(h))
+	for name, values := range h {
+		for _, value := range values {
+			parts = append(parts, name+": "+value)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (h headerFlag) Set(value string) error {
+	name, value, ok := strings.Cut(value, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("invalid header %q, expected Name: value", name+":"+value)
+	}
+	http.Header(h).Add(name, strings.TrimSpace(value))
+	return nil
+}
+
+var (
+	wsPathCmd   *string    = flag.String("ws-path", "/", "path of the WebSocket endpoint of the @ws and @wss inputs and outputs")
+	wsHostCmd   *string    = flag.String("ws-host", "", "Host header sent by the @ws and @wss outputs, default the output address")
+	wsHeaderCmd headerFlag = newHeaderFlag("ws-header", "'Name: value' header sent by the @ws and @wss outputs and required by the inputs, can be repeated")
+)
+
+func newHeaderFlag(name string, usage string) headerFlag {
+	h := headerFlag{}
+	flag.Var(h, name, usage)
+	return h
+}
+
+// parseWebSocketConfig returns the config of the @ws and @wss inputs and outputs.
+func parseWebSocketConfig() (*ws.Config, error) {
+	if !strings.HasPrefix(*wsPathCmd, "/") {
+		return nil, fmt.Errorf("invalid -ws-path %q, it must start with /", *wsPathCmd)
+	}
+	return &ws.Config{
+		Path:   *wsPathCmd,
+		Host:   *wsHostCmd,
+		Header: http.Header(wsHeaderCmd).Clone(),
+	}, nil
+}
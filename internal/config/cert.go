@@ -0,0 +1,284 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	caFileName      = "mpipe-ca.pem"
+	caKeyFileName   = "mpipe-ca.key"
+	leafFileName    = "mpipe-cert.pem"
+	leafKeyFileName = "mpipe-cert.key"
+
+	caValidity          = 10 * 365 * 24 * time.Hour
+	defaultCertValidity = 30 * 24 * time.Hour
+	rotateRetryInterval = time.Minute
+)
+
+type SelfSignedConfig struct {
+	// Dir keeps the CA and the certificate.
+	Dir string
+	// Hosts are the DNS names and IP addresses of the certificate, default localhost, 127.0.0.1 and ::1.
+	Hosts []string
+	// Validity of the certificate, default 30 days. The CA is valid for 10 years.
+	Validity time.Duration
+	// RenewBefore is how long before its expiry the certificate is replaced, default a third of Validity.
+	RenewBefore time.Duration
+	// OnRotate is called after each rotation attempt, cert is the new certificate if err is nil.
+	OnRotate func(cert *x509.Certificate, err error)
+}
+
+// SelfSignedCert is a certificate signed by a CA generated on the first run, both are kept in Dir.
+// The certificate is rotated before it expires, the clients that pin the CA keep trusting it.
+type SelfSignedCert struct {
+	config SelfSignedConfig
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+
+	// leaf is swapped as a whole, the handshakes never wait for a rotation.
+	leaf     atomic.Pointer[selfSignedLeaf]
+	rotating atomic.Bool
+}
+
+type selfSignedLeaf struct {
+	cert    *tls.Certificate
+	renewAt time.Time
+}
+
+// NewSelfSignedCert loads the CA and the certificate of the directory, the missing ones are generated.
+func NewSelfSignedCert(config SelfSignedConfig) (*SelfSignedCert, error) {
+	if config.Validity <= 0 {
+		config.Validity = defaultCertValidity
+	}
+	if config.RenewBefore <= 0 || config.RenewBefore >= config.Validity {
+		config.RenewBefore = config.Validity / 3
+	}
+	if len(config.Hosts) == 0 {
+		config.Hosts = []string{"localhost", "127.0.0.1", "::1"}
+	}
+	if err := os.MkdirAll(config.Dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &SelfSignedCert{config: config}
+	if err := s.loadCA(); err != nil {
+		return nil, err
+	}
+	leaf, err := loadKeyPair(s.path(leafFileName), s.path(leafKeyFileName))
+	if err == nil && s.usable(leaf.Leaf) {
+		s.setLeaf(leaf)
+		return s, nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("load certificate: %w", err)
+	}
+	if err := s.rotate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SelfSignedCert) path(name string) string {
+	return filepath.Join(s.config.Dir, name)
+}
+
+func (s *SelfSignedCert) loadCA() error {
+	ca, err := loadKeyPair(s.path(caFileName), s.path(caKeyFileName))
+	if err == nil {
+		key, ok := ca.PrivateKey.(*ecdsa.PrivateKey)
+		if !ok {
+			return fmt.Errorf("the key of %s is not an ECDSA key", s.path(caFileName))
+		}
+		s.ca, s.caKey = ca.Leaf, key
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("load CA: %w", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "mpipe CA", Organization: []string{"mpipe"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	cert, err := createCertificate(template, template, key, key)
+	if err != nil {
+		return err
+	}
+	if err := writeKeyPair(s.path(caFileName), s.path(caKeyFileName), cert, key); err != nil {
+		return err
+	}
+	s.ca, s.caKey = cert, key
+	return nil
+}
+
+// usable reports whether the certificate was signed by the CA, covers the hosts and is not due for renewal.
+func (s *SelfSignedCert) usable(cert *x509.Certificate) bool {
+	if cert == nil || cert.CheckSignatureFrom(s.ca) != nil {
+		return false
+	}
+	for _, host := range s.config.Hosts {
+		if cert.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+	return time.Now().Before(cert.NotAfter.Add(-s.config.RenewBefore))
+}
+
+func (s *SelfSignedCert) setLeaf(leaf *tls.Certificate) {
+	// The CA goes with the certificate, so that the clients can pin either of them.
+	leaf.Certificate = append(leaf.Certificate[:1:1], s.ca.Raw)
+	s.leaf.Store(&selfSignedLeaf{cert: leaf, renewAt: leaf.Leaf.NotAfter.Add(-s.config.RenewBefore)})
+}
+
+// rotate replaces the certificate, the caller set rotating or is the constructor.
+func (s *SelfSignedCert) rotate() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: s.config.Hosts[0], Organization: []string{"mpipe"}},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(s.config.Validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range s.config.Hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	cert, err := createCertificate(template, s.ca, key, s.caKey)
+	if err != nil {
+		return err
+	}
+	if err := writeKeyPair(s.path(leafFileName), s.path(leafKeyFileName), cert, key); err != nil {
+		return err
+	}
+	s.setLeaf(&tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert})
+	return nil
+}
+
+// GetCertificate is the tls.Config.GetCertificate of the inputs, the first handshake after renewAt starts a rotation in the background.
+// The handshakes get the current certificate until the new one is ready, it is still valid for RenewBefore.
+func (s *SelfSignedCert) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	leaf := s.leaf.Load()
+	if time.Now().After(leaf.renewAt) && s.rotating.CompareAndSwap(false, true) {
+		go s.rotateInBackground()
+	}
+	return leaf.cert, nil
+}
+
+// rotateInBackground keeps the current certificate if the rotation fails, it is retried a minute later.
+func (s *SelfSignedCert) rotateInBackground() {
+	defer s.rotating.Store(false)
+	err := s.rotate()
+	if err != nil {
+		err = fmt.Errorf("rotate certificate: %w", err)
+		leaf := s.leaf.Load()
+		s.leaf.Store(&selfSignedLeaf{cert: leaf.cert, renewAt: time.Now().Add(rotateRetryInterval)})
+	}
+	if s.config.OnRotate != nil {
+		s.config.OnRotate(s.leaf.Load().cert.Leaf, err)
+	}
+}
+
+// CA returns the generated CA.
+func (s *SelfSignedCert) CA() *x509.Certificate {
+	return s.ca
+}
+
+// Leaf returns the current certificate.
+func (s *SelfSignedCert) Leaf() *x509.Certificate {
+	return s.leaf.Load().cert.Leaf
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the certificate in the AB:CD:... form printed by openssl.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+func createCertificate(template, parent *x509.Certificate, key, parentKey *ecdsa.PrivateKey) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, fmt.Errorf("create certificate: %w", err)
+	}
+	return x509.ParseCertificate(der)
+}
+
+// loadKeyPair returns the certificate and the key of the files, with Leaf set.
+func loadKeyPair(certPath, keyPath string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	return &cert, nil
+}
+
+// writeKeyPair writes the files like StateFile.Save, the key is only readable by the owner.
+func writeKeyPair(certPath, keyPath string, cert *x509.Certificate, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	files := []struct {
+		path  string
+		block *pem.Block
+		perm  os.FileMode
+	}{
+		{keyPath, &pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}, 0600},
+		{certPath, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}, 0644},
+	}
+	for _, file := range files {
+		tmpPath := file.path + ".tmp"
+		if err := os.WriteFile(tmpPath, pem.EncodeToMemory(file.block), file.perm); err != nil {
+			return err
+		}
+		if err := os.Rename(tmpPath, file.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func Test_selfSignedCertRotate(t *testing.T) {
+	dir := t.TempDir()
+	rotated := make(chan *x509.Certificate, 1)
+	s, err := NewSelfSignedCert(SelfSignedConfig{
+		Dir: dir,
+		OnRotate: func(cert *x509.Certificate, err error) {
+			if err != nil {
+				t.Errorf("rotation failed: %v", err)
+			}
+			rotated <- cert
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := s.Leaf()
+
+	// A second run loads the same CA and certificate.
+	again, err := NewSelfSignedCert(SelfSignedConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.CA().Equal(s.CA()) || !again.Leaf().Equal(first) {
+		t.Error("the CA or the certificate was not reused")
+	}
+
+	// Past renewAt, the handshake gets the current certificate and the new one follows.
+	s.leaf.Store(&selfSignedLeaf{cert: s.leaf.Load().cert, renewAt: time.Now().Add(-time.Second)})
+	cert, err := s.GetCertificate(nil)
+	if err != nil || !cert.Leaf.Equal(first) {
+		t.Fatalf("GetCertificate() during the rotation = %v, want the current certificate", err)
+	}
+	var next *x509.Certificate
+	select {
+	case next = <-rotated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the certificate was not rotated")
+	}
+	if next.Equal(first) || !s.Leaf().Equal(next) {
+		t.Error("the rotated certificate is not in use")
+	}
+	if err := next.CheckSignatureFrom(s.CA()); err != nil {
+		t.Errorf("the rotated certificate is not signed by the CA: %v", err)
+	}
+	if cert, _ := s.GetCertificate(nil); !cert.Leaf.Equal(next) {
+		t.Error("GetCertificate() after the rotation returned the old certificate")
+	}
+	select {
+	case <-rotated:
+		t.Error("rotated again before renewAt")
+	default:
+	}
+}
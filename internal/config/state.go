@@ -0,0 +1,47 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+)
+
+// StateFile keeps the runtime state that must survive a restart.
+type StateFile struct {
+	mu       sync.Mutex
+	filePath string
+}
+
+func NewStateFile(filePath string) *StateFile {
+	return &StateFile{filePath: filePath}
+}
+
+// Load decodes the state into v, a missing file leaves v untouched.
+func (s *StateFile) Load(v any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	content, err := os.ReadFile(s.filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+// Save replaces the state with v, the file is written to a temporary file first so that a crash never leaves it truncated.
+func (s *StateFile) Save(v any) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tmpPath := s.filePath + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.filePath)
+}
@@ -0,0 +1,247 @@
+package forwarder
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/doraemonkeys/monster-pipe-core/pkg/protocol"
+)
+
+// hostMatcher is a MatchHostConfig parsed once, when the input is created.
+type hostMatcher struct {
+	matchIP  func(ip netip.Addr) bool
+	portMin  int
+	portMax  int
+	anyProto bool
+	protocol protocol.NetProtocol
+	identity string
+}
+
+func (h hostMatcher) matchIdentity(identity string) bool {
+	if h.identity == "" {
+		return true
+	}
+	ok, _ := path.Match(h.identity, identity)
+	return ok && identity != ""
+}
+
+func (h hostMatcher) match(ip netip.Addr, port int, proto protocol.NetProtocol) bool {
+	if !h.anyProto && h.protocol != proto {
+		return false
+	}
+	return port >= h.portMin && port <= h.portMax && h.matchIP(ip)
+}
+
+func compileHostMatchers(configs []MatchHostConfig) ([]hostMatcher, error) {
+	matchers := make([]hostMatcher, 0, len(configs))
+	for _, config := range configs {
+		matcher, err := compileHostMatch(config)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, matcher)
+	}
+	return matchers, nil
+}
+
+// compileHostMatch parses the host and the optional port of the pattern, the host is one of:
+//
+//	any address                   *
+//	a single address              192.0.2.1, 2001:db8::1
+//	a CIDR block                  10.0.0.0/8, 2001:db8::/32
+//	an inclusive range            192.0.2.10-192.0.2.20
+//	a wildcard                    192.168.*, 192.168.*.1, * matches any octet (or group), a trailing * the rest of the address
+//	the addresses of a host name  example.com, resolved once
+//
+// The port is a number, a range like 8000-9000 or *. IPv6 addresses with a port are written in brackets.
+func compileHostMatch(config MatchHostConfig) (hostMatcher, error) {
+	matcher := hostMatcher{
+		portMin:  0,
+		portMax:  65535,
+		anyProto: config.AnyProto,
+		protocol: config.Protocol,
+		identity: config.Identity,
+	}
+	if _, err := path.Match(config.Identity, ""); err != nil {
+		return matcher, fmt.Errorf("invalid identity %q: %w", config.Identity, err)
+	}
+	host, port, err := splitHostPattern(strings.TrimSpace(config.Match))
+	if err != nil {
+		return matcher, err
+	}
+	if port != "" && port != "*" {
+		if matcher.portMin, matcher.portMax, err = parsePortRange(port); err != nil {
+			return matcher, fmt.Errorf("invalid port in %q: %w", config.Match, err)
+		}
+	}
+	if matcher.matchIP, err = compileIPMatch(host); err != nil {
+		return matcher, fmt.Errorf("invalid host in %q: %w", config.Match, err)
+	}
+	return matcher, nil
+}
+
+func splitHostPattern(pattern string) (string, string, error) {
+	if strings.HasPrefix(pattern, "[") {
+		end := strings.Index(pattern, "]")
+		if end < 0 {
+			return "", "", fmt.Errorf("missing ] in %q", pattern)
+		}
+		host, rest := pattern[1:end], pattern[end+1:]
+		if rest == "" {
+			return host, "", nil
+		}
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", fmt.Errorf("unexpected %q after ] in %q", rest, pattern)
+		}
+		return host, rest[1:], nil
+	}
+	// A bare IPv6 address has no port.
+	if strings.Count(pattern, ":") > 1 {
+		return pattern, "", nil
+	}
+	if host, port, ok := strings.Cut(pattern, ":"); ok {
+		return host, port, nil
+	}
+	return pattern, "", nil
+}
+
+func parsePortRange(port string) (int, int, error) {
+	from, to, isRange := strings.Cut(port, "-")
+	portMin, err := strconv.Atoi(from)
+	if err != nil || portMin < 0 || portMin > 65535 {
+		return 0, 0, fmt.Errorf("invalid port %q", from)
+	}
+	if !isRange {
+		return portMin, portMin, nil
+	}
+	portMax, err := strconv.Atoi(to)
+	if err != nil || portMax < portMin || portMax > 65535 {
+		return 0, 0, fmt.Errorf("invalid port range %q", port)
+	}
+	return portMin, portMax, nil
+}
+
+func compileIPMatch(host string) (func(ip netip.Addr) bool, error) {
+	if host == "" || host == "*" {
+		return func(netip.Addr) bool { return true }, nil
+	}
+	if strings.Contains(host, "/") {
+		prefix, err := netip.ParsePrefix(host)
+		if err != nil {
+			return nil, err
+		}
+		prefix = prefix.Masked()
+		return prefix.Contains, nil
+	}
+	if from, to, ok := strings.Cut(host, "-"); ok {
+		fromIP, err1 := netip.ParseAddr(from)
+		toIP, err2 := netip.ParseAddr(to)
+		if err1 == nil && err2 == nil {
+			fromIP, toIP = fromIP.Unmap(), toIP.Unmap()
+			if fromIP.Is4() != toIP.Is4() || toIP.Less(fromIP) {
+				return nil, fmt.Errorf("invalid address range %q", host)
+			}
+			return func(ip netip.Addr) bool {
+				return ip.Is4() == fromIP.Is4() && fromIP.Compare(ip) <= 0 && ip.Compare(toIP) <= 0
+			}, nil
+		}
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap().WithZone("")
+		return func(ip netip.Addr) bool { return ip == addr }, nil
+	}
+	if strings.Contains(host, "*") {
+		return compileWildcardMatch(host)
+	}
+	// A host name, the addresses are resolved once.
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make(map[netip.Addr]struct{}, len(ips))
+	for _, ip := range ips {
+		if addr, ok := netip.AddrFromSlice(ip); ok {
+			addrs[addr.Unmap()] = struct{}{}
+		}
+	}
+	return func(ip netip.Addr) bool {
+		_, ok := addrs[ip]
+		return ok
+	}, nil
+}
+
+// compileWildcardMatch compiles 192.168.*.1 style patterns, and their IPv6 equivalent 2001:db8:*:1:*.
+func compileWildcardMatch(host string) (func(ip netip.Addr) bool, error) {
+	ipv6 := strings.Contains(host, ":")
+	sep, groups, base, bits := ".", 4, 10, 8
+	if ipv6 {
+		if strings.Contains(host, "::") {
+			return nil, fmt.Errorf("wildcard can't be combined with :: in %q, use a CIDR block", host)
+		}
+		sep, groups, base, bits = ":", 8, 16, 16
+	}
+	parts := strings.Split(host, sep)
+	// A trailing * matches the rest of the address.
+	for len(parts) < groups && parts[len(parts)-1] == "*" {
+		parts = append(parts, "*")
+	}
+	if len(parts) != groups {
+		return nil, fmt.Errorf("invalid wildcard address %q", host)
+	}
+	// -1 is a wildcard group.
+	values := make([]int, groups)
+	for i, part := range parts {
+		if part == "*" {
+			values[i] = -1
+			continue
+		}
+		value, err := strconv.ParseUint(part, base, bits)
+		if err != nil {
+			return nil, fmt.Errorf("invalid wildcard address %q", host)
+		}
+		values[i] = int(value)
+	}
+	return func(ip netip.Addr) bool {
+		if ip.Is4() == ipv6 {
+			return false
+		}
+		raw := ip.AsSlice()
+		for i, value := range values {
+			if value < 0 {
+				continue
+			}
+			group := int(raw[i])
+			if ipv6 {
+				group = int(raw[2*i])<<8 | int(raw[2*i+1])
+			}
+			if group != value {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// remoteAddrPort returns the IP and port of the connection, IPv4-mapped IPv6 addresses are unmapped.
+func remoteAddrPort(addr net.Addr) (netip.Addr, int, bool) {
+	var addrPort netip.AddrPort
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		addrPort = addr.AddrPort()
+	case *net.UDPAddr:
+		addrPort = addr.AddrPort()
+	default:
+		if addr == nil {
+			return netip.Addr{}, 0, false
+		}
+		var err error
+		if addrPort, err = netip.ParseAddrPort(addr.String()); err != nil {
+			return netip.Addr{}, 0, false
+		}
+	}
+	return addrPort.Addr().Unmap().WithZone(""), int(addrPort.Port()), addrPort.Addr().IsValid()
+}
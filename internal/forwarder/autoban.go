@@ -0,0 +1,244 @@
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBanWindow      = time.Minute
+	defaultBanShortTunnel = time.Second
+	defaultBanDuration    = 10 * time.Minute
+)
+
+type AutoBanConfig struct {
+	// Window is the sliding window the events of a client are counted in, default 1m.
+	Window time.Duration
+	// MaxAccepts bans a client that opens more connections in the window, 0 disables the check.
+	MaxAccepts int
+	// MaxShortTunnels bans a client that has more tunnels shorter than ShortTunnel in the window, 0 disables the check.
+	MaxShortTunnels int
+	// ShortTunnel is the lifetime under which a tunnel counts as short, default 1s.
+	ShortTunnel time.Duration
+	// MaxOutputErrors bans a client whose tunnels hit more output errors in the window, 0 disables the check.
+	// Only the read and write errors of a connected output that replies to the client count, see clientOutputError.
+	// An output that fails for every client still gets them banned, keep it off unless the outputs are reliable.
+	MaxOutputErrors int
+	// BanDuration is how long a ban lasts, default 10m.
+	BanDuration time.Duration
+}
+
+type Ban struct {
+	IP     netip.Addr
+	Until  time.Time
+	Reason string
+}
+
+type banEventType int
+
+const (
+	banEventAccept banEventType = iota
+	banEventShortTunnel
+	banEventOutputError
+	banEventTypeCount
+)
+
+func (b banEventType) String() string {
+	switch b {
+	case banEventAccept:
+		return "connections"
+	case banEventShortTunnel:
+		return "short tunnels"
+	case banEventOutputError:
+		return "output errors"
+	}
+	return "unknown"
+}
+
+// autoBanner keeps the recent events of each client, the timestamps older than the window are dropped.
+type autoBanner struct {
+	config    AutoBanConfig
+	mu        sync.Mutex
+	events    map[netip.Addr]*[banEventTypeCount][]time.Time
+	bans      map[netip.Addr]Ban
+	lastSweep time.Time
+}
+
+func newAutoBanner(config *AutoBanConfig) *autoBanner {
+	if config == nil {
+		return nil
+	}
+	cfg := *config
+	if cfg.Window <= 0 {
+		cfg.Window = defaultBanWindow
+	}
+	if cfg.ShortTunnel <= 0 {
+		cfg.ShortTunnel = defaultBanShortTunnel
+	}
+	if cfg.BanDuration <= 0 {
+		cfg.BanDuration = defaultBanDuration
+	}
+	return &autoBanner{
+		config:    cfg,
+		events:    make(map[netip.Addr]*[banEventTypeCount][]time.Time),
+		bans:      make(map[netip.Addr]Ban),
+		lastSweep: time.Now(),
+	}
+}
+
+func (a *autoBanner) threshold(event banEventType) int {
+	switch event {
+	case banEventAccept:
+		return a.config.MaxAccepts
+	case banEventShortTunnel:
+		return a.config.MaxShortTunnels
+	case banEventOutputError:
+		return a.config.MaxOutputErrors
+	}
+	return 0
+}
+
+func (a *autoBanner) banned(ip netip.Addr) bool {
+	if a == nil {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ban, ok := a.bans[ip]
+	if ok && time.Now().After(ban.Until) {
+		delete(a.bans, ip)
+		return false
+	}
+	return ok
+}
+
+// record adds the event to the window of the client, the returned ban is non-nil if the event got the client banned.
+func (a *autoBanner) record(ip netip.Addr, event banEventType) *Ban {
+	if a == nil || !ip.IsValid() {
+		return nil
+	}
+	threshold := a.threshold(event)
+	if threshold <= 0 {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	a.sweep(now)
+	if _, ok := a.bans[ip]; ok {
+		return nil
+	}
+	events, ok := a.events[ip]
+	if !ok {
+		events = &[banEventTypeCount][]time.Time{}
+		a.events[ip] = events
+	}
+	window := append(trimWindow(events[event], now.Add(-a.config.Window)), now)
+	events[event] = window
+	if len(window) <= threshold {
+		return nil
+	}
+	delete(a.events, ip)
+	ban := Ban{
+		IP:     ip,
+		Until:  now.Add(a.config.BanDuration),
+		Reason: fmt.Sprintf("%d %s in %s", len(window), event, a.config.Window),
+	}
+	a.bans[ip] = ban
+	return &ban
+}
+
+// sweep drops the clients without recent events and the expired bans, at most once per window.
+func (a *autoBanner) sweep(now time.Time) {
+	if now.Sub(a.lastSweep) < a.config.Window {
+		return
+	}
+	a.lastSweep = now
+	since := now.Add(-a.config.Window)
+	for ip, events := range a.events {
+		empty := true
+		for i := range events {
+			events[i] = trimWindow(events[i], since)
+			empty = empty && len(events[i]) == 0
+		}
+		if empty {
+			delete(a.events, ip)
+		}
+	}
+	for ip, ban := range a.bans {
+		if now.After(ban.Until) {
+			delete(a.bans, ip)
+		}
+	}
+}
+
+func trimWindow(window []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(window) && window[i].Before(since) {
+		i++
+	}
+	return window[i:]
+}
+
+// clientOutputError reports whether the output error of a tunnel is counted against its client.
+// The failed dials and the shadow outputs are not, the client has no part in them.
+func clientOutputError(message ForwardConnMessage) bool {
+	switch message.MessageType {
+	case ForwardConnMsgTypeOutputReadError, ForwardConnMsgTypeWriteToOutputError:
+	default:
+		return false
+	}
+	if message.Output.Role == ForwardOutputRoleShadow {
+		return false
+	}
+	return !errors.Is(message.Err, errOutputDial)
+}
+
+// Bans returns the active automatic bans, the ones that expire first come first.
+func (f *ForwardInput) Bans() []Ban {
+	if f.banner == nil {
+		return nil
+	}
+	f.banner.mu.Lock()
+	defer f.banner.mu.Unlock()
+	now := time.Now()
+	bans := make([]Ban, 0, len(f.banner.bans))
+	for _, ban := range f.banner.bans {
+		if now.Before(ban.Until) {
+			bans = append(bans, ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Until.Before(bans[j].Until)
+	})
+	return bans
+}
+
+// Unban lifts the ban of the IP and forgets its recorded events, it returns false if the IP was not banned.
+func (f *ForwardInput) Unban(ip netip.Addr) bool {
+	if f.banner == nil {
+		return false
+	}
+	f.banner.mu.Lock()
+	defer f.banner.mu.Unlock()
+	ip = ip.Unmap()
+	_, ok := f.banner.bans[ip]
+	delete(f.banner.bans, ip)
+	delete(f.banner.events, ip)
+	return ok
+}
+
+// ClearBans lifts all the bans and forgets the recorded events.
+func (f *ForwardInput) ClearBans() {
+	if f.banner == nil {
+		return
+	}
+	f.banner.mu.Lock()
+	defer f.banner.mu.Unlock()
+	clear(f.banner.bans)
+	clear(f.banner.events)
+}
@@ -0,0 +1,183 @@
+package forwarder
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type ForwardMode int
+
+const (
+	// ForwardModeFanOut copies every connection to all the outputs.
+	ForwardModeFanOut ForwardMode = 0
+	// ForwardModeRoundRobin sends each connection to the next output in turn.
+	ForwardModeRoundRobin ForwardMode = 1
+	// ForwardModeWeighted is round-robin in proportion to the weights of the outputs.
+	ForwardModeWeighted ForwardMode = 2
+	// ForwardModeLeastConn sends each connection to the output with the fewest active connections.
+	ForwardModeLeastConn ForwardMode = 3
+	// ForwardModeHash sends the connections of a client address to the same output.
+	ForwardModeHash ForwardMode = 4
+)
+
+func (m ForwardMode) String() string {
+	switch m {
+	case ForwardModeFanOut:
+		return "fanout"
+	case ForwardModeRoundRobin:
+		return "round-robin"
+	case ForwardModeWeighted:
+		return "weighted"
+	case ForwardModeLeastConn:
+		return "least-conn"
+	case ForwardModeHash:
+		return "hash"
+	}
+	return "unknown"
+}
+
+func ParseForwardMode(mode string) (ForwardMode, error) {
+	switch strings.ToLower(mode) {
+	case "", "fanout":
+		return ForwardModeFanOut, nil
+	case "round-robin", "rr":
+		return ForwardModeRoundRobin, nil
+	case "weighted", "wrr":
+		return ForwardModeWeighted, nil
+	case "least-conn", "leastconn":
+		return ForwardModeLeastConn, nil
+	case "hash":
+		return ForwardModeHash, nil
+	}
+	return ForwardModeFanOut, fmt.Errorf("invalid forward mode: %s", mode)
+}
+
+// Number of points of each output on the hash ring.
+const hashRingReplicas = 160
+
+type hashRingNode struct {
+	hash   uint32
+	output *ForwardOutput
+}
+
+// outputBalancer picks exactly one output per connection, the shadows are not part of the rotation.
+type outputBalancer struct {
+	mode    ForwardMode
+	outputs []*ForwardOutput
+
+	mu             sync.Mutex
+	next           int
+	currentWeights []int
+	ring           []hashRingNode
+}
+
+func newOutputBalancer(mode ForwardMode, outputs []*ForwardOutput) *outputBalancer {
+	b := &outputBalancer{mode: mode}
+	for _, output := range outputs {
+		if output.config.Role != ForwardOutputRoleShadow {
+			b.outputs = append(b.outputs, output)
+		}
+	}
+	b.currentWeights = make([]int, len(b.outputs))
+	if mode == ForwardModeHash {
+		for _, output := range b.outputs {
+			for i := 0; i < hashRingReplicas*output.weight(); i++ {
+				b.ring = append(b.ring, hashRingNode{
+					hash:   hashString(output.config.Target() + "#" + strconv.Itoa(i)),
+					output: output,
+				})
+			}
+		}
+		sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+	}
+	return b
+}
+
+// pick returns nil if none of the outputs is available.
+// The picked output counts one more active connection, the caller releases it with releaseOutputs.
+func (b *outputBalancer) pick(clientAddr net.Addr, available func(*ForwardOutput) bool) *ForwardOutput {
+	// The count is taken under the lock, so that the connections accepted together see each other in least-conn.
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	output := b.choose(clientAddr, available)
+	if output != nil {
+		output.shared.activeConns.Add(1)
+	}
+	return output
+}
+
+// choose is called with the lock held.
+func (b *outputBalancer) choose(clientAddr net.Addr, available func(*ForwardOutput) bool) *ForwardOutput {
+	switch b.mode {
+	case ForwardModeRoundRobin:
+		for i := 0; i < len(b.outputs); i++ {
+			output := b.outputs[(b.next+i)%len(b.outputs)]
+			if available(output) {
+				b.next = (b.next + i + 1) % len(b.outputs)
+				return output
+			}
+		}
+	case ForwardModeWeighted:
+		// smooth weighted round-robin
+		best, total := -1, 0
+		for i, output := range b.outputs {
+			if !available(output) {
+				continue
+			}
+			b.currentWeights[i] += output.weight()
+			total += output.weight()
+			if best == -1 || b.currentWeights[i] > b.currentWeights[best] {
+				best = i
+			}
+		}
+		if best != -1 {
+			b.currentWeights[best] -= total
+			return b.outputs[best]
+		}
+	case ForwardModeLeastConn:
+		var best *ForwardOutput
+		var bestLoad float64
+		for _, output := range b.outputs {
+			if !available(output) {
+				continue
+			}
+			load := float64(output.shared.activeConns.Load()) / float64(output.weight())
+			if best == nil || load < bestLoad {
+				best, bestLoad = output, load
+			}
+		}
+		return best
+	case ForwardModeHash:
+		if len(b.ring) == 0 {
+			return nil
+		}
+		hash := hashString(addrIP(clientAddr))
+		start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= hash })
+		// Walk clockwise, the clients of an unavailable output move to the next one on the ring.
+		for i := 0; i < len(b.ring); i++ {
+			node := b.ring[(start+i)%len(b.ring)]
+			if available(node.output) {
+				return node.output
+			}
+		}
+	}
+	return nil
+}
+
+// releaseOutputs ends the active connections counted by selectOutputs.
+func releaseOutputs(outputs []*ForwardOutput) {
+	for _, output := range outputs {
+		output.shared.activeConns.Add(-1)
+	}
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum32()
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type MonsterPipeCoreForwardTunnel struct {
@@ -15,22 +16,73 @@ type MonsterPipeCoreForwardTunnel struct {
 	input         net.Conn
 	outputs       []*ForwardOutput
 	closed        atomic.Bool
+	closeCh       chan struct{}
+	config        ForwardTunnelConfig
 	tunnelWatcher func(message ForwardConnMessage)
+	// chunkWatcher receives the messages about a single chunk of data.
+	chunkWatcher func(message ForwardConnMessage)
+	inputBytes   atomic.Int64
+	outputBytes  atomic.Int64
+	// lastActive is the unix nano time of the last read from the input or an output.
+	lastActive atomic.Int64
+	// The buckets of all the scopes the tunnel belongs to.
+	upBuckets   []*tokenBucket
+	downBuckets []*tokenBucket
+}
+
+type ForwardTunnelConfig struct {
+	// ConnEventsOnly drops the messages about single chunks of data, only the connection level messages are sent.
+	// A TCP tunnel with a single output then copies the data with splice, without passing it through user space.
+	ConnEventsOnly bool
+	// IdleTimeout closes the tunnel when no data is read in either direction for this long, 0 disables it.
+	// The splice path is not used when it is set, because the activity of a spliced tunnel can't be observed.
+	IdleTimeout time.Duration
+	// MaxLifetime closes the tunnel when it has been open for this long, 0 disables it.
+	MaxLifetime time.Duration
+	// Rate limits the bandwidth of the tunnel, the splice path is not used when it is set.
+	Rate RateLimitConfig
+	// sharedRates are the rate limits shared with other tunnels, of the client IP or of the whole forwarder.
+	sharedRates []*rateBuckets
+	// chunkObserver receives the chunk messages even if ConnEventsOnly is set, the splice path is not used with it.
+	chunkObserver func(message ForwardConnMessage)
+	// pool provides the read buffers of the tunnel, it is shared by all the tunnels of a forwarder.
+	pool *bufferPool
 }
 
 func NewForwardTunnel(input net.Conn, outputs []*ForwardOutput, tunnelWatcher func(message ForwardConnMessage)) *MonsterPipeCoreForwardTunnel {
-	return &MonsterPipeCoreForwardTunnel{
+	return NewForwardTunnelWithConfig(ForwardTunnelConfig{}, input, outputs, tunnelWatcher)
+}
+
+func NewForwardTunnelWithConfig(config ForwardTunnelConfig, input net.Conn, outputs []*ForwardOutput, tunnelWatcher func(message ForwardConnMessage)) *MonsterPipeCoreForwardTunnel {
+	if config.pool == nil {
+		config.pool = defaultBufferPool
+	}
+	m := &MonsterPipeCoreForwardTunnel{
 		input:         input,
 		outputs:       outputs,
+		closeCh:       make(chan struct{}),
+		config:        config,
 		tunnelWatcher: tunnelWatcher,
 	}
+	for _, rate := range append([]*rateBuckets{newRateBuckets(config.Rate)}, config.sharedRates...) {
+		if rate == nil {
+			continue
+		}
+		if rate.up != nil {
+			m.upBuckets = append(m.upBuckets, rate.up)
+		}
+		if rate.down != nil {
+			m.downBuckets = append(m.downBuckets, rate.down)
+		}
+	}
+	return m
 }
 
 func (m *MonsterPipeCoreForwardTunnel) Close() error {
-	if m.closed.Load() {
+	if m.closed.Swap(true) {
 		return nil
 	}
-	m.closed.Store(true)
+	close(m.closeCh)
 	var err error
 	for _, output := range m.outputs {
 		if e := output.Close(); e != nil {
@@ -55,6 +107,20 @@ const (
 	ForwardConnMsgTypeOutputReadError    ForwardConnMessageType = 7
 	ForwardConnMsgTypeTunnelClosed       ForwardConnMessageType = 8
 	ForwardConnMsgTypeWriteToInputOK     ForwardConnMessageType = 9
+	// The write queue of the output is full and a chunk is discarded.
+	ForwardConnMsgTypeOutputQueueDropped ForwardConnMessageType = 10
+	// The write queue of the output is full and the output is disconnected.
+	ForwardConnMsgTypeOutputQueueDisconnect ForwardConnMessageType = 11
+	// A dial attempt to the output failed and will be retried.
+	ForwardConnMsgTypeDialRetry ForwardConnMessageType = 12
+	// The circuit breaker of the output opened, or refused a dial while open.
+	ForwardConnMsgTypeCircuitOpen ForwardConnMessageType = 13
+	// No data in either direction for the idle timeout, the tunnel is closed.
+	ForwardConnMsgTypeIdleTimeout ForwardConnMessageType = 14
+	// The tunnel reached its maximum lifetime and is closed.
+	ForwardConnMsgTypeLifetimeExceeded ForwardConnMessageType = 15
+	// The context of the tunnel is done, for example the drain timeout of the forwarder expired.
+	ForwardConnMsgTypeForceClosed ForwardConnMessageType = 16
 )
 
 type ForwardConnMessage struct {
@@ -63,7 +129,15 @@ type ForwardConnMessage struct {
 	OutputAddr     net.Addr
 	ClosedByOutput bool
 	Data           []byte
-	Err            error
+	// InputBytes and OutputBytes are only set in ForwardConnMsgTypeTunnelClosed,
+	// they are the bytes read from the input and the bytes written back to the input.
+	InputBytes  int64
+	OutputBytes int64
+	// Dropped is the number of chunks the output discarded so far, DroppedBytes the size of the one just discarded.
+	// They are only set in ForwardConnMsgTypeOutputQueueDropped, which carries no Data.
+	Dropped      int64
+	DroppedBytes int
+	Err          error
 }
 
 func (f ForwardConnMessage) Address() string {
@@ -96,37 +170,99 @@ func (f ForwardConnMessage) Address() string {
 //
 // Input will be closed when the tunnel exits.
 func (m *MonsterPipeCoreForwardTunnel) Run(ctx context.Context) {
-	closedByOutput := false
+	var closedByOutput atomic.Bool
 	defer func() {
 		_ = m.Close()
 		m.tunnelWatcher(ForwardConnMessage{
 			MessageType:    ForwardConnMsgTypeTunnelClosed,
-			ClosedByOutput: closedByOutput,
+			ClosedByOutput: closedByOutput.Load(),
+			InputBytes:     m.inputBytes.Load(),
+			OutputBytes:    m.outputBytes.Load(),
 		})
 	}()
 	if m.tunnelWatcher == nil {
 		m.tunnelWatcher = func(ForwardConnMessage) {}
 	}
+	m.chunkWatcher = m.tunnelWatcher
+	if m.config.ConnEventsOnly {
+		m.chunkWatcher = func(ForwardConnMessage) {}
+	}
+	if observer := m.config.chunkObserver; observer != nil {
+		watcher := m.chunkWatcher
+		m.chunkWatcher = func(message ForwardConnMessage) {
+			observer(message)
+			watcher(message)
+		}
+	}
+	for _, output := range m.outputs {
+		output.dialWatcher = m.tunnelWatcher
+	}
+	m.touch()
+	go m.watchLifetime(ctx)
+	if m.canSplice() {
+		if output, outputConn := m.spliceOutput(ctx); output != nil {
+			closedByOutput.Store(m.runSplice(output, outputConn))
+			return
+		}
+	}
+	hasPrimary := false
+	for _, output := range m.outputs {
+		if output.config.Role == ForwardOutputRolePrimary {
+			hasPrimary = true
+			break
+		}
+	}
+	// The tunnel is closed by the outputs when all the outputs that reply to the input are closed,
+	// the shadows are only taken into account if there is no such output.
+	var watchedOutputCount int32
+	for _, output := range m.outputs {
+		if output.replyToInput(hasPrimary) {
+			watchedOutputCount++
+		}
+	}
+	watchAll := watchedOutputCount == 0
+	if watchAll {
+		watchedOutputCount = int32(len(m.outputs))
+	}
 	var closedOutputCount atomic.Int32
+	// outputsDone is closed when all the watched outputs are finished, outputsFailed is set if one of them did not end with EOF.
+	outputsDone := make(chan struct{})
+	var outputsFailed atomic.Bool
 	for _, output := range m.outputs {
+		reply := output.replyToInput(hasPrimary)
 		go func() {
+			failed := true
 			defer func() {
-				closedOutputCount.Add(1)
-				if closedOutputCount.Load() == int32(len(m.outputs)) && !m.closed.Load() {
-					closedByOutput = true
-					_ = m.Close() // Close input to make input.Read() not blocked
+				if !reply && !watchAll {
+					return
+				}
+				if failed {
+					outputsFailed.Store(true)
+				}
+				if closedOutputCount.Add(1) == watchedOutputCount {
+					close(outputsDone)
 				}
 			}()
-			const maxBufferSize = 1024 * 1024 * 2
-			var readBuffer [maxBufferSize]byte
+			readBuffer, err := m.config.pool.get(ctx, m.closeCh)
+			if err != nil {
+				return
+			}
+			defer m.config.pool.put(readBuffer)
 			for {
-				n, err := output.Read(ctx, readBuffer[:])
-				if !output.config.Readable {
+				n, err := output.Read(ctx, readBuffer)
+				if err == nil {
+					m.touch()
+				}
+				if err == nil && !reply {
 					// Read the received data, even if you may not process them immediately.
 					continue
 				}
 				if err != nil {
-					if m.closed.Load() || errors.Is(err, io.EOF) {
+					if m.closed.Load() {
+						return
+					}
+					if errors.Is(err, io.EOF) {
+						failed = false
 						return
 					}
 					m.tunnelWatcher(ForwardConnMessage{
@@ -137,13 +273,17 @@ func (m *MonsterPipeCoreForwardTunnel) Run(ctx context.Context) {
 					})
 					return
 				}
-				m.tunnelWatcher(ForwardConnMessage{
+				m.chunkWatcher(ForwardConnMessage{
 					MessageType: ForwardConnMsgTypeOutputRead,
 					Data:        readBuffer[:n],
 					Output:      output.config,
 					OutputAddr:  output.ConnAddr(),
 				})
-				_, err = m.input.Write(readBuffer[:n])
+				if waitBuckets(ctx, m.closeCh, m.downBuckets, n) != nil {
+					return
+				}
+				wn, err := m.input.Write(readBuffer[:n])
+				m.outputBytes.Add(int64(wn))
 				if err != nil {
 					m.tunnelWatcher(ForwardConnMessage{
 						MessageType: ForwardConnMsgTypeWriteToInputError,
@@ -152,7 +292,7 @@ func (m *MonsterPipeCoreForwardTunnel) Run(ctx context.Context) {
 						OutputAddr:  output.ConnAddr(),
 					})
 				} else {
-					m.tunnelWatcher(ForwardConnMessage{
+					m.chunkWatcher(ForwardConnMessage{
 						MessageType: ForwardConnMsgTypeWriteToInputOK,
 						Data:        readBuffer[:n],
 						Output:      output.config,
@@ -162,18 +302,86 @@ func (m *MonsterPipeCoreForwardTunnel) Run(ctx context.Context) {
 			}
 		}()
 	}
-	const maxBufferSize = 1024 * 1024 * 2
-	var readBuffer [maxBufferSize]byte
-	var wg sync.WaitGroup
+	inputDone := make(chan struct{})
+	var inputEOF atomic.Bool
+	go func() {
+		select {
+		case <-outputsDone:
+		case <-inputDone:
+			return
+		case <-m.closeCh:
+			return
+		}
+		// The input loop is waiting for the outputs after the EOF of the input.
+		if m.closed.Load() || inputEOF.Load() {
+			return
+		}
+		closedByOutput.Store(true)
+		// The outputs have nothing more to say, but the input may still be sending.
+		if !outputsFailed.Load() && closeWrite(m.input) == nil {
+			return
+		}
+		_ = m.Close() // Close input to make input.Read() not blocked
+	}()
+	// Each output of a multi-output tunnel gets its own write queue, the slowest output no longer sets the pace.
+	var writers []*outputWriter
+	var writersDone sync.WaitGroup
+	if len(m.outputs) > 1 {
+		for _, output := range m.outputs {
+			if !output.config.Writable {
+				continue
+			}
+			writer := newOutputWriter(m, output)
+			writers = append(writers, writer)
+			writersDone.Add(1)
+			go func() {
+				defer writersDone.Done()
+				writer.run(ctx)
+			}()
+		}
+		defer func() {
+			_ = m.Close()
+			writersDone.Wait()
+			// Nothing is queued after the input loop exits, give back the chunks that were never written.
+			for _, writer := range writers {
+				writer.drain()
+			}
+		}()
+	}
+	var readBuffer []byte
+	defer func() {
+		if readBuffer != nil {
+			m.config.pool.put(readBuffer)
+		}
+	}()
+	defer close(inputDone)
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		default:
 		}
-		n, err := m.input.Read(readBuffer[:])
+		if readBuffer == nil {
+			var err error
+			if readBuffer, err = m.config.pool.get(ctx, m.closeCh); err != nil {
+				return
+			}
+		}
+		n, err := m.input.Read(readBuffer)
 		if err != nil {
-			if m.closed.Load() || errors.Is(err, io.EOF) {
+			if m.closed.Load() {
+				return
+			}
+			if errors.Is(err, io.EOF) {
+				// Half-close the outputs and keep the tunnel until they are done replying.
+				inputEOF.Store(true)
+				if m.closeWriteOutputs(ctx, writers) {
+					select {
+					case <-outputsDone:
+					case <-m.closeCh:
+					case <-ctx.Done():
+					}
+				}
 				return
 			}
 			m.tunnelWatcher(ForwardConnMessage{
@@ -182,68 +390,155 @@ func (m *MonsterPipeCoreForwardTunnel) Run(ctx context.Context) {
 			})
 			return
 		}
-		m.tunnelWatcher(ForwardConnMessage{
+		m.inputBytes.Add(int64(n))
+		m.touch()
+		m.chunkWatcher(ForwardConnMessage{
 			MessageType: ForwardConnMsgTypeInputRead,
 			Data:        readBuffer[:n],
 		})
+		if waitBuckets(ctx, m.closeCh, m.upBuckets, n) != nil {
+			return
+		}
 		// quick path for single output
 		if len(m.outputs) == 1 {
-			wn, err := m.outputs[0].Write(ctx, readBuffer[:n])
-			if err == nil && wn != n {
-				m.tunnelWatcher(ForwardConnMessage{
-					MessageType: ForwardConnMsgTypeWriteToOutputError,
-					Err:         fmt.Errorf("write not match, want %d, got %d", n, wn),
-					Output:      m.outputs[0].config,
-					OutputAddr:  m.outputs[0].ConnAddr(),
-				})
-			}
-			if err != nil {
-				m.tunnelWatcher(ForwardConnMessage{
-					MessageType: ForwardConnMsgTypeWriteToOutputError,
-					Err:         err,
-					Output:      m.outputs[0].config,
-					OutputAddr:  m.outputs[0].ConnAddr(),
-				})
-			} else {
-				m.tunnelWatcher(ForwardConnMessage{
-					MessageType: ForwardConnMsgTypeWriteToOutputOK,
-					Output:      m.outputs[0].config,
-					Data:        readBuffer[:n],
-					OutputAddr:  m.outputs[0].ConnAddr(),
-				})
-			}
+			m.writeToOutput(ctx, m.outputs[0], readBuffer[:n])
+			continue
+		}
+		if len(writers) == 0 {
 			continue
 		}
+		// The buffer now belongs to the writers, the next read gets a new one.
+		c := &chunk{buf: readBuffer, data: readBuffer[:n], pool: m.config.pool}
+		c.refs.Store(int32(len(writers)))
+		readBuffer = nil
+		for _, writer := range writers {
+			writer.enqueue(ctx, c)
+		}
+	}
+}
+
+// canSplice reports whether nothing needs to look at the data of the tunnel.
+func (m *MonsterPipeCoreForwardTunnel) canSplice() bool {
+	rateLimited := len(m.upBuckets) > 0 || len(m.downBuckets) > 0
+	return m.config.ConnEventsOnly && m.config.IdleTimeout <= 0 && !rateLimited && m.config.chunkObserver == nil
+}
+
+func (m *MonsterPipeCoreForwardTunnel) touch() {
+	m.lastActive.Store(time.Now().UnixNano())
+}
+
+// watchLifetime closes the tunnel when the context is done, the tunnel is idle for too long or reaches its maximum lifetime.
+// Closing the connections is the only way to interrupt the blocked reads.
+func (m *MonsterPipeCoreForwardTunnel) watchLifetime(ctx context.Context) {
+	var lifetime <-chan time.Time
+	if m.config.MaxLifetime > 0 {
+		timer := time.NewTimer(m.config.MaxLifetime)
+		defer timer.Stop()
+		lifetime = timer.C
+	}
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if m.config.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(m.config.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+	for {
+		select {
+		case <-m.closeCh:
+			return
+		case <-ctx.Done():
+			m.closeWithMessage(ForwardConnMsgTypeForceClosed, context.Cause(ctx))
+			return
+		case <-lifetime:
+			m.closeWithMessage(ForwardConnMsgTypeLifetimeExceeded, fmt.Errorf("tunnel reached its max lifetime %s", m.config.MaxLifetime))
+			return
+		case <-idle:
+			idleFor := time.Since(time.Unix(0, m.lastActive.Load()))
+			if idleFor >= m.config.IdleTimeout {
+				m.closeWithMessage(ForwardConnMsgTypeIdleTimeout, fmt.Errorf("tunnel idle for %s", idleFor.Truncate(time.Millisecond)))
+				return
+			}
+			idleTimer.Reset(m.config.IdleTimeout - idleFor)
+		}
+	}
+}
+
+func (m *MonsterPipeCoreForwardTunnel) closeWithMessage(messageType ForwardConnMessageType, err error) {
+	if m.closed.Load() {
+		return
+	}
+	m.tunnelWatcher(ForwardConnMessage{
+		MessageType: messageType,
+		Err:         err,
+	})
+	_ = m.Close()
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite shuts down the writing side of the connection if it supports half-close.
+func closeWrite(conn net.Conn) error {
+	if conn, ok := conn.(closeWriter); ok {
+		return conn.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// closeWriteOutputs propagates the EOF of the input to the outputs once their queued chunks are written.
+// It returns false if an output does not support half-close, the tunnel must then be closed.
+func (m *MonsterPipeCoreForwardTunnel) closeWriteOutputs(ctx context.Context, writers []*outputWriter) bool {
+	if len(writers) == 0 {
 		for _, output := range m.outputs {
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				wn, err := output.Write(ctx, readBuffer[:n])
-				if err == nil && wn != n {
-					m.tunnelWatcher(ForwardConnMessage{
-						MessageType: ForwardConnMsgTypeWriteToOutputError,
-						Err:         fmt.Errorf("write not match, want %d, got %d", n, wn),
-						Output:      output.config,
-						OutputAddr:  output.ConnAddr(),
-					})
-				}
-				if err != nil {
-					m.tunnelWatcher(ForwardConnMessage{
-						MessageType: ForwardConnMsgTypeWriteToOutputError,
-						Err:         err,
-						Output:      output.config,
-						OutputAddr:  output.ConnAddr(),
-					})
-				} else {
-					m.tunnelWatcher(ForwardConnMessage{
-						MessageType: ForwardConnMsgTypeWriteToOutputOK,
-						Output:      output.config,
-						Data:        readBuffer[:n],
-						OutputAddr:  output.ConnAddr(),
-					})
-				}
-			}()
+			_ = output.CloseWrite()
 		}
-		wg.Wait()
 	}
+	for _, writer := range writers {
+		writer.enqueueCloseWrite()
+	}
+	// The tunnel may be closed right after, which would discard the chunks still queued.
+	for _, writer := range writers {
+		writer.waitCloseWrite(ctx)
+	}
+	for _, output := range m.outputs {
+		if conn := output.getConn(); conn != nil && output.config.Writable {
+			if _, ok := conn.(closeWriter); !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (m *MonsterPipeCoreForwardTunnel) writeToOutput(ctx context.Context, output *ForwardOutput, data []byte) {
+	if !output.config.Writable {
+		return
+	}
+	wn, err := output.Write(ctx, data)
+	if err == nil && wn != len(data) {
+		m.tunnelWatcher(ForwardConnMessage{
+			MessageType: ForwardConnMsgTypeWriteToOutputError,
+			Err:         fmt.Errorf("write not match, want %d, got %d", len(data), wn),
+			Output:      output.config,
+			OutputAddr:  output.ConnAddr(),
+		})
+		return
+	}
+	if err != nil {
+		m.tunnelWatcher(ForwardConnMessage{
+			MessageType: ForwardConnMsgTypeWriteToOutputError,
+			Err:         err,
+			Output:      output.config,
+			OutputAddr:  output.ConnAddr(),
+		})
+		return
+	}
+	m.chunkWatcher(ForwardConnMessage{
+		MessageType: ForwardConnMsgTypeWriteToOutputOK,
+		Output:      output.config,
+		Data:        data,
+		OutputAddr:  output.ConnAddr(),
+	})
 }
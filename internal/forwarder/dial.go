@@ -0,0 +1,169 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker of the output is open")
+
+const (
+	defaultDialBackoff     = 100 * time.Millisecond
+	defaultDialBackoffMax  = 5 * time.Second
+	defaultBreakerCooldown = 30 * time.Second
+)
+
+type ForwardOutputDialConfig struct {
+	// Timeout limits each dial attempt, 0 means no timeout.
+	Timeout time.Duration
+	// Retries is the number of extra attempts after a failed dial.
+	Retries int
+	// Backoff is the delay before the first retry, it is doubled after each retry up to BackoffMax.
+	Backoff    time.Duration
+	BackoffMax time.Duration
+	// BreakerThreshold consecutive failed dials open the circuit breaker of the output, 0 disables it.
+	BreakerThreshold int
+	// BreakerCooldown is how long the open breaker fails the dials fast, default 30s.
+	// Then the breaker is half-open: a single dial is let through and the others fail fast
+	// until it is done, or for at most Timeout, BreakerCooldown if there is no Timeout.
+	BreakerCooldown time.Duration
+}
+
+// circuitBreaker is shared by an output and all its copies.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// allow returns false while the breaker is open. Once the cooldown is over a single attempt is let through for probeTimeout,
+// another failure opens the breaker again.
+func (c *circuitBreaker) allow(threshold int, probeTimeout time.Duration) bool {
+	if threshold <= 0 {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures < threshold {
+		return true
+	}
+	now := time.Now()
+	if now.Before(c.openUntil) {
+		return false
+	}
+	// Half-open, keep the others out until the result of this attempt is recorded.
+	c.openUntil = now.Add(probeTimeout)
+	return true
+}
+
+// abort forgets an attempt that was given up by the caller, a half-open breaker lets the next one through.
+func (c *circuitBreaker) abort(threshold int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if threshold > 0 && c.failures >= threshold {
+		c.openUntil = time.Time{}
+	}
+}
+
+func (c *circuitBreaker) isOpen(threshold int) bool {
+	if threshold <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.failures >= threshold && time.Now().Before(c.openUntil)
+}
+
+// record returns true if the failure opened the breaker.
+func (c *circuitBreaker) record(err error, threshold int, cooldown time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		c.failures = 0
+		return false
+	}
+	c.failures++
+	if threshold <= 0 || c.failures < threshold {
+		return false
+	}
+	c.openUntil = time.Now().Add(cooldown)
+	return true
+}
+
+// dialWithPolicy dials the output with the timeout, retries and circuit breaker of its config.
+func (f *ForwardOutput) dialWithPolicy(ctx context.Context) (net.Conn, error) {
+	cfg := f.config.Dial
+	if cfg.BreakerCooldown <= 0 {
+		cfg.BreakerCooldown = defaultBreakerCooldown
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = defaultDialBackoff
+	}
+	if cfg.BackoffMax <= 0 {
+		cfg.BackoffMax = defaultDialBackoffMax
+	}
+	probeTimeout := cfg.Timeout
+	if probeTimeout <= 0 {
+		probeTimeout = cfg.BreakerCooldown
+	}
+	backoff := cfg.Backoff
+	for attempt := 0; ; attempt++ {
+		if !f.shared.breaker.allow(cfg.BreakerThreshold, probeTimeout) {
+			f.dialWatcher(ForwardConnMessage{
+				MessageType: ForwardConnMsgTypeCircuitOpen,
+				Err:         ErrCircuitOpen,
+				Output:      f.config,
+			})
+			return nil, ErrCircuitOpen
+		}
+		conn, err := f.dialOnce(ctx, cfg.Timeout)
+		if err != nil && ctx.Err() != nil {
+			// The tunnel gave up, for example the client hung up during the dial, it says nothing about the output.
+			f.shared.breaker.abort(cfg.BreakerThreshold)
+			return nil, err
+		}
+		if f.shared.breaker.record(err, cfg.BreakerThreshold, cfg.BreakerCooldown) {
+			f.dialWatcher(ForwardConnMessage{
+				MessageType: ForwardConnMsgTypeCircuitOpen,
+				Err:         fmt.Errorf("%w after %d consecutive failures: %w", ErrCircuitOpen, cfg.BreakerThreshold, err),
+				Output:      f.config,
+			})
+			return nil, err
+		}
+		if err == nil || attempt >= cfg.Retries || ctx.Err() != nil {
+			return conn, err
+		}
+		f.dialWatcher(ForwardConnMessage{
+			MessageType: ForwardConnMsgTypeDialRetry,
+			Err:         fmt.Errorf("dial attempt %d failed, retry in %s: %w", attempt+1, backoff, err),
+			Output:      f.config,
+		})
+		// Jitter keeps the tunnels of a flapping output from retrying in lockstep.
+		delay := backoff/2 + rand.N(backoff/2+1)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		backoff = min(backoff*2, cfg.BackoffMax)
+	}
+}
+
+// CircuitOpen reports whether the dials to the output currently fail fast.
+func (f *ForwardOutput) CircuitOpen() bool {
+	return f.shared.breaker.isOpen(f.config.Dial.BreakerThreshold)
+}
+
+func (f *ForwardOutput) dialOnce(ctx context.Context, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return f.dialer(ctx, f.config.Protocol.Network(), f.dialAddress())
+}
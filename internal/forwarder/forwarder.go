@@ -2,20 +2,72 @@ package forwarder
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"regexp"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/doraemonkeys/monster-pipe-core/pkg/protocol"
 	syncgmap "github.com/doraemonkeys/sync-gmap"
 )
 
 type MonsterPipeCoreForwarder struct {
+	config           ForwarderConfig
 	input            *ForwardInput
 	outputs          []*ForwardOutput
+	balancer         *outputBalancer
+	pool             *bufferPool
 	msgWatcher       func(message ForwardMessage)
-	connectedClients *syncgmap.SyncMap[string, net.Addr]
+	connectedClients *syncgmap.SyncMap[string, int]
+	clientsMu        sync.Mutex
+	totalConns       int
+	connReleased     chan struct{}
+	clientRates      map[string]*clientRate
+	totalRate        *rateBuckets
+	quota            *quotaTracker
+
+	tunnels       sync.WaitGroup
+	activeTunnels atomic.Int64
+	drainOnce     sync.Once
+	drainCh       chan struct{}
+}
+
+type ForwarderConfig struct {
+	// Mode decides whether a connection is copied to all the outputs or sent to exactly one of them.
+	Mode ForwardMode
+	// ConnEventsOnly is passed to the tunnels, see ForwardTunnelConfig.
+	ConnEventsOnly bool
+	// BufferSize is the size of the read buffers of the tunnels, default 32 KiB.
+	// The forwarders with a UDP input or output use at least 64 KiB so that a datagram fits in a buffer.
+	BufferSize int
+	// MemoryBudget limits the bytes of all the read buffers of the forwarder, 0 means no limit.
+	MemoryBudget int64
+	// MemoryBudgetAction decides what happens to the new connections when the budget is exhausted.
+	MemoryBudgetAction MemoryBudgetAction
+	// IdleTimeout and MaxLifetime are passed to the tunnels, see ForwardTunnelConfig.
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+	// DrainTimeout is how long the running tunnels may take to finish once the forwarder is draining,
+	// the tunnels left after it are closed. 0 closes them right away.
+	DrainTimeout time.Duration
+	// MaxConns limits the concurrent tunnels of the forwarder, MaxConnsPerIP the concurrent tunnels of a client IP.
+	// 0 means no limit.
+	MaxConns      int
+	MaxConnsPerIP int
+	// ConnLimitAction decides what happens to the connections over the limits.
+	ConnLimitAction ConnLimitAction
+	// ConnQueueTimeout is how long a queued connection waits for a free slot, 0 means no timeout.
+	ConnQueueTimeout time.Duration
+	// TunnelRate limits the bandwidth of each tunnel, ClientRate the bandwidth of all the tunnels of a client IP
+	// and TotalRate the bandwidth of the whole forwarder.
+	TunnelRate RateLimitConfig
+	ClientRate RateLimitConfig
+	TotalRate  RateLimitConfig
+	// Quota limits the traffic of each client, the clients over quota are refused once they authenticated.
+	Quota QuotaConfig
 }
 
 type ForwardMessageType int
@@ -25,6 +77,24 @@ const (
 	ForwardMsgTypeTunnel      ForwardMessageType = 2
 	ForwardMsgTypeCommonError ForwardMessageType = 3
 	ForwardMsgTypeAcceptError ForwardMessageType = 4
+	// The health state of an output changed.
+	ForwardMsgTypeOutputHealth ForwardMessageType = 5
+	// The connection is refused because the memory budget of the forwarder is exhausted.
+	ForwardMsgTypeMemoryExhausted ForwardMessageType = 6
+	// The forwarder stopped accepting connections and waits for the running tunnels.
+	ForwardMsgTypeDraining ForwardMessageType = 7
+	// The connection is refused because the forwarder or the client reached its connection limit.
+	ForwardMsgTypeConnLimited ForwardMessageType = 8
+	// The connection is refused because the client used up its traffic quota.
+	ForwardMsgTypeQuotaExceeded ForwardMessageType = 9
+	// The client is banned for a while, see AutoBanConfig.
+	ForwardMsgTypeClientBanned ForwardMessageType = 10
+	// The handshake of the connection failed, for example the client does not know the pre-shared key.
+	ForwardMsgTypeHandshakeError ForwardMessageType = 11
+	// The client authenticated during the handshake, ClientIdentity says as whom.
+	ForwardMsgTypeAuthenticated ForwardMessageType = 12
+	// A UDP session was created, expired or rejected, see UDPSessionMessage.
+	ForwardMsgTypeUDPSession ForwardMessageType = 13
 )
 
 func (f ForwardMessageType) String() string {
@@ -35,6 +105,26 @@ func (f ForwardMessageType) String() string {
 		return "Tunnel message"
 	case ForwardMsgTypeCommonError:
 		return "Common error"
+	case ForwardMsgTypeAcceptError:
+		return "Accept error"
+	case ForwardMsgTypeOutputHealth:
+		return "Output health"
+	case ForwardMsgTypeMemoryExhausted:
+		return "Memory exhausted"
+	case ForwardMsgTypeDraining:
+		return "Draining"
+	case ForwardMsgTypeConnLimited:
+		return "Connection limited"
+	case ForwardMsgTypeQuotaExceeded:
+		return "Quota exceeded"
+	case ForwardMsgTypeClientBanned:
+		return "Client banned"
+	case ForwardMsgTypeHandshakeError:
+		return "Handshake error"
+	case ForwardMsgTypeAuthenticated:
+		return "Authenticated"
+	case ForwardMsgTypeUDPSession:
+		return "UDP session"
 	}
 	return "Unknown"
 }
@@ -44,7 +134,13 @@ type ForwardMessage struct {
 	ConnAddr    net.Addr
 	ConnBlocked bool
 	TunnelMsg   *ForwardConnMessage
-	Err         error
+	HealthMsg   *ForwardHealthMessage
+	Ban         *Ban
+	UDPSession  *UDPSessionMessage
+	// ClientIdentity is who the client authenticated as, for example the common name of its TLS certificate.
+	// It is empty before the handshake and for the anonymous clients.
+	ClientIdentity string
+	Err            error
 }
 
 // func (f ForwardMessage) PrettyPrint() string {
@@ -66,41 +162,221 @@ type ForwardMessage struct {
 // }
 
 func NewForwarder(input *ForwardInput, outputs []*ForwardOutput, msgWatcher func(message ForwardMessage)) *MonsterPipeCoreForwarder {
+	return NewForwarderWithConfig(ForwarderConfig{}, input, outputs, msgWatcher)
+}
+
+func NewForwarderWithConfig(config ForwarderConfig, input *ForwardInput, outputs []*ForwardOutput, msgWatcher func(message ForwardMessage)) *MonsterPipeCoreForwarder {
+	bufferSize := config.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultBufferSize
+	}
+	if isDatagram(input.Config.Protocol) {
+		bufferSize = max(bufferSize, udpBufferSize)
+	}
+	for _, output := range outputs {
+		if isDatagram(output.config.Protocol) {
+			bufferSize = max(bufferSize, udpBufferSize)
+		}
+	}
 	return &MonsterPipeCoreForwarder{
+		config:           config,
 		input:            input,
 		outputs:          outputs,
+		balancer:         newOutputBalancer(config.Mode, outputs),
+		pool:             newBufferPool(bufferSize, config.MemoryBudget),
 		msgWatcher:       msgWatcher,
-		connectedClients: syncgmap.NewSyncMap[string, net.Addr](),
+		connectedClients: syncgmap.NewSyncMap[string, int](),
+		connReleased:     make(chan struct{}),
+		clientRates:      make(map[string]*clientRate),
+		totalRate:        newRateBuckets(config.TotalRate),
+		quota:            newQuotaTracker(config.Quota),
+		drainCh:          make(chan struct{}),
+	}
+}
+
+// Drain stops accepting new connections, Run returns once the running tunnels are finished
+// or the DrainTimeout expires. Cancelling the context of Run drains the forwarder too.
+func (f *MonsterPipeCoreForwarder) Drain() {
+	f.drainOnce.Do(func() {
+		close(f.drainCh)
+	})
+}
+
+func (f *MonsterPipeCoreForwarder) draining(ctx context.Context) bool {
+	select {
+	case <-f.drainCh:
+		return true
+	default:
 	}
+	return ctx.Err() != nil
+}
+
+// drain waits for the running tunnels, the tunnels left after the DrainTimeout are closed with cancelTunnels.
+func (f *MonsterPipeCoreForwarder) drain(cancelTunnels context.CancelCauseFunc) {
+	defer cancelTunnels(nil)
+	active := f.activeTunnels.Load()
+	if active == 0 {
+		return
+	}
+	f.msgWatcher(ForwardMessage{
+		MessageType: ForwardMsgTypeDraining,
+		Err:         fmt.Errorf("waiting up to %s for %d tunnels to finish", f.config.DrainTimeout, active),
+	})
+	done := make(chan struct{})
+	go func() {
+		f.tunnels.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(f.config.DrainTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	}
+	cancelTunnels(fmt.Errorf("drain timeout %s expired", f.config.DrainTimeout))
+	<-done
 }
 
 // Concurrent not safe
 func (f *MonsterPipeCoreForwarder) AddOutput(output *ForwardOutput) {
 	f.outputs = append(f.outputs, output)
+	f.balancer = newOutputBalancer(f.config.Mode, f.outputs)
+	if isDatagram(output.config.Protocol) && f.pool.size < udpBufferSize {
+		f.pool = newBufferPool(udpBufferSize, f.config.MemoryBudget)
+	}
+}
+
+// selectOutputs returns the outputs a new connection is forwarded to,
+// the backup outputs are only used when none of the other outputs is available.
+// The selected outputs count one more active connection, the caller releases them with releaseOutputs.
+func (f *MonsterPipeCoreForwarder) selectOutputs(connAddr net.Addr) []*ForwardOutput {
+	var shadows []*ForwardOutput
+	for _, output := range f.outputs {
+		if output.config.Role == ForwardOutputRoleShadow && output.available() {
+			output.shared.activeConns.Add(1)
+			shadows = append(shadows, output)
+		}
+	}
+	if len(f.balancer.outputs) == 0 {
+		return shadows
+	}
+	for _, backup := range []bool{false, true} {
+		available := func(output *ForwardOutput) bool {
+			return output.config.Backup == backup && output.available()
+		}
+		if f.config.Mode == ForwardModeFanOut {
+			var selected []*ForwardOutput
+			for _, output := range f.balancer.outputs {
+				if available(output) {
+					output.shared.activeConns.Add(1)
+					selected = append(selected, output)
+				}
+			}
+			if len(selected) > 0 {
+				// The shadows still receive a copy of every connection.
+				return append(selected, shadows...)
+			}
+			continue
+		}
+		if picked := f.balancer.pick(connAddr, available); picked != nil {
+			return append([]*ForwardOutput{picked}, shadows...)
+		}
+	}
+	releaseOutputs(shadows)
+	return nil
+}
+
+func (f *MonsterPipeCoreForwarder) runHealthChecks(ctx context.Context) {
+	for _, output := range f.outputs {
+		if output.config.HealthCheck == nil {
+			continue
+		}
+		go output.runHealthCheck(ctx, func(message ForwardHealthMessage) {
+			f.msgWatcher(ForwardMessage{
+				MessageType: ForwardMsgTypeOutputHealth,
+				HealthMsg:   &message,
+			})
+		})
+	}
 }
 
 func (f *MonsterPipeCoreForwarder) Run(ctx context.Context) error {
+	for _, output := range f.outputs {
+		if err := output.config.HealthCheck.validate(output.config.Protocol); err != nil {
+			return fmt.Errorf("output %s: %w", output.config.Target(), err)
+		}
+	}
 	listener, err := f.input.Listen(ctx)
 	if err != nil {
 		return err
 	}
 	fmt.Println("mpipe listening on input", listener.Addr().String())
 	defer listener.Close()
+	if udpListener, ok := listener.(*UdpListener); ok {
+		udpListener.setEventWatcher(func(addr net.Addr, message UDPSessionMessage) {
+			var err error
+			if message.Event == UDPSessionRejected {
+				err = ErrUDPSessionLimit
+			}
+			f.msgWatcher(ForwardMessage{
+				MessageType: ForwardMsgTypeUDPSession,
+				ConnAddr:    addr,
+				UDPSession:  &message,
+				Err:         err,
+			})
+		})
+	}
+	healthCtx, cancelHealth := context.WithCancel(ctx)
+	defer cancelHealth()
+	f.runHealthChecks(healthCtx)
 
-	for {
+	if f.quota != nil {
+		if err := f.quota.load(); err != nil {
+			return err
+		}
+		quotaCtx, cancelQuota := context.WithCancel(context.Background())
+		defer func() {
+			cancelQuota()
+			// The tunnels are done, save what they counted.
+			if err := f.quota.save(); err != nil {
+				f.msgWatcher(ForwardMessage{MessageType: ForwardMsgTypeCommonError, Err: err})
+			}
+		}()
+		go f.quota.run(quotaCtx, func(err error) {
+			f.msgWatcher(ForwardMessage{MessageType: ForwardMsgTypeCommonError, Err: err})
+		})
+	}
+
+	// The tunnels outlive ctx until the drain is over.
+	tunnelCtx, cancelTunnels := context.WithCancelCause(context.WithoutCancel(ctx))
+	defer cancelTunnels(nil)
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
 		select {
 		case <-ctx.Done():
-			return nil
-		default:
+		case <-f.drainCh:
+		case <-stopped:
+			return
 		}
+		// Unblock the Accept.
+		_ = listener.Close()
+	}()
+
+	for {
 		// fmt.Println("debug: 111")
 		conn, err := listener.Accept()
 		if err != nil {
+			if f.draining(ctx) {
+				f.drain(cancelTunnels)
+				return nil
+			}
 			f.msgWatcher(ForwardMessage{
 				MessageType: ForwardMsgTypeAcceptError,
 				Err:         err,
 			})
-			if err == net.ErrClosed || err == io.EOF {
+			if errors.Is(err, net.ErrClosed) || err == io.EOF {
 				return fmt.Errorf("listener closed")
 			}
 			continue
@@ -118,107 +394,175 @@ func (f *MonsterPipeCoreForwarder) Run(ctx context.Context) error {
 		if connBlocked {
 			continue
 		}
-		go f.handleConn(ctx, conn)
+		if f.checkBan(f.input.recordBanEvent(conn.RemoteAddr(), banEventAccept), conn.RemoteAddr()) {
+			_ = conn.Close()
+			continue
+		}
+		f.tunnels.Add(1)
+		f.activeTunnels.Add(1)
+		go func() {
+			defer f.tunnels.Done()
+			defer f.activeTunnels.Add(-1)
+			ip := addrIP(conn.RemoteAddr())
+			if err := f.acquireConn(tunnelCtx, ip); err != nil {
+				_ = conn.Close()
+				f.msgWatcher(ForwardMessage{
+					MessageType: ForwardMsgTypeConnLimited,
+					ConnAddr:    conn.RemoteAddr(),
+					Err:         err,
+				})
+				return
+			}
+			defer f.releaseConn(ip)
+			f.handleConn(tunnelCtx, conn)
+		}()
 	}
 }
 
 func (f *MonsterPipeCoreForwarder) handleConn(ctx context.Context, conn net.Conn) {
 	connAddr := conn.RemoteAddr()
-	f.connectedClients.Store(connAddr.String(), connAddr)
-	defer f.connectedClients.Delete(connAddr.String())
+	var identity string
 
 	MsgWatcher := func(message ForwardConnMessage) {
+		if clientOutputError(message) {
+			f.checkBan(f.input.recordBanEvent(connAddr, banEventOutputError), connAddr)
+		}
 		f.msgWatcher(ForwardMessage{
-			MessageType: ForwardMsgTypeTunnel,
-			ConnAddr:    connAddr,
-			TunnelMsg:   &message,
+			MessageType:    ForwardMsgTypeTunnel,
+			ConnAddr:       connAddr,
+			TunnelMsg:      &message,
+			ClientIdentity: identity,
 		})
 	}
-	var outputs []*ForwardOutput = make([]*ForwardOutput, 0, len(f.outputs))
-	for _, output := range f.outputs {
-		outputs = append(outputs, output.Copy())
+	// The connections of an authenticating listener prove who they are before any output is dialed.
+	if handshaker, ok := conn.(interface{ HandshakeContext(context.Context) error }); ok {
+		handshakeCtx, cancel := context.WithTimeout(ctx, defaultHandshakeTimeout)
+		err := handshaker.HandshakeContext(handshakeCtx)
+		cancel()
+		if err != nil {
+			_ = conn.Close()
+			f.msgWatcher(ForwardMessage{
+				MessageType: ForwardMsgTypeHandshakeError,
+				ConnAddr:    connAddr,
+				Err:         err,
+			})
+			return
+		}
+		identity = connIdentity(conn)
 	}
-	tunnel := NewForwardTunnel(conn, outputs, MsgWatcher)
-	tunnel.Run(ctx)
-}
-
-func matchAddress(pattern, address string) bool {
-	// 分割 IP 和端口
-	patternParts := strings.Split(pattern, ":")
-	addressParts := strings.Split(address, ":")
-
-	// 检查 IP 部分
-	if !matchIP(patternParts[0], addressParts[0]) {
-		return false
+	if !f.input.CheckIdentity(conn, identity) {
+		_ = conn.Close()
+		f.msgWatcher(ForwardMessage{
+			MessageType:    ForwardMsgTypeHandshakeError,
+			ConnAddr:       connAddr,
+			ClientIdentity: identity,
+			Err:            fmt.Errorf("%w: %q", ErrIdentityDenied, identity),
+		})
+		return
 	}
-
-	if len(patternParts) == 1 {
-		// If pattern has no port, then it is considered a match
-		return true
+	if identity != "" {
+		f.msgWatcher(ForwardMessage{
+			MessageType:    ForwardMsgTypeAuthenticated,
+			ConnAddr:       connAddr,
+			ClientIdentity: identity,
+		})
 	}
-
-	// 检查端口部分
-	if len(patternParts) > 1 && len(addressParts) > 1 {
-		pattern := strings.Replace(patternParts[1], "*", "[0-9]+", -1)
-		pattern = fmt.Sprintf("^%s$", pattern)
-		regex, err := regexp.Compile(pattern)
-		if err != nil {
-			return false
-		}
-		return regex.MatchString(addressParts[len(addressParts)-1])
+	ip := addrIP(connAddr)
+	quotaClient := quotaKey(ip, identity)
+	if err := f.quota.check(quotaClient); err != nil {
+		_ = conn.Close()
+		f.msgWatcher(ForwardMessage{
+			MessageType:    ForwardMsgTypeQuotaExceeded,
+			ConnAddr:       connAddr,
+			ClientIdentity: identity,
+			Err:            err,
+		})
+		return
 	}
-
-	return true
-}
-
-func matchIP(pattern, ip string) bool {
-	if pattern == "*" {
-		return true
+	selected := f.selectOutputs(connAddr)
+	defer releaseOutputs(selected)
+	if len(selected) == 0 {
+		_ = conn.Close()
+		f.msgWatcher(ForwardMessage{
+			MessageType:    ForwardMsgTypeCommonError,
+			ConnAddr:       connAddr,
+			ClientIdentity: identity,
+			Err:            fmt.Errorf("no output available"),
+		})
+		return
 	}
-
-	// 处理 IPv4
-	if strings.ContainsRune(pattern, '.') {
-		return matchIPv4(pattern, ip)
+	// A tunnel needs a buffer for the input and one for each of its outputs.
+	if f.config.MemoryBudgetAction == MemoryBudgetReject && !f.pool.available(1+len(selected)) {
+		_ = conn.Close()
+		f.msgWatcher(ForwardMessage{
+			MessageType:    ForwardMsgTypeMemoryExhausted,
+			ConnAddr:       connAddr,
+			ClientIdentity: identity,
+			Err:            ErrMemoryBudgetExceeded,
+		})
+		return
 	}
-
-	// 处理 IPv6
-	return matchIPv6(pattern, ip)
+	var outputs []*ForwardOutput = make([]*ForwardOutput, 0, len(selected))
+	for _, output := range selected {
+		outputs = append(outputs, output.Copy())
+	}
+	clientRate := f.acquireClientRate(ip)
+	defer f.releaseClientRate(ip)
+	var chunkObserver func(message ForwardConnMessage)
+	if f.quota != nil {
+		chunkObserver = f.quota.observe(quotaClient)
+	}
+	tunnel := NewForwardTunnelWithConfig(ForwardTunnelConfig{
+		ConnEventsOnly: f.config.ConnEventsOnly,
+		IdleTimeout:    f.config.IdleTimeout,
+		MaxLifetime:    f.config.MaxLifetime,
+		Rate:           f.config.TunnelRate,
+		sharedRates:    []*rateBuckets{clientRate, f.totalRate},
+		chunkObserver:  chunkObserver,
+		pool:           f.pool,
+	}, conn, outputs, MsgWatcher)
+	start := time.Now()
+	tunnel.Run(ctx)
+	f.checkBan(f.input.recordTunnelClosed(connAddr, time.Since(start)), connAddr)
 }
 
-func matchIPv4(pattern, ip string) bool {
-	pattern = strings.Replace(pattern, ".", "\\.", -1)
-	pattern = fmt.Sprintf("^%s$", strings.Replace(pattern, "*", "[0-9.]+", -1))
-	regex, err := regexp.Compile(pattern)
-	if err != nil {
+// checkBan reports the ban, if any, and returns whether there is one.
+func (f *MonsterPipeCoreForwarder) checkBan(ban *Ban, connAddr net.Addr) bool {
+	if ban == nil {
 		return false
 	}
-	return regex.MatchString(ip)
+	f.msgWatcher(ForwardMessage{
+		MessageType: ForwardMsgTypeClientBanned,
+		ConnAddr:    connAddr,
+		Ban:         ban,
+		Err:         fmt.Errorf("banned until %s: %s", ban.Until.Format(time.DateTime), ban.Reason),
+	})
+	return true
 }
 
-func matchIPv6(pattern, ip string) bool {
-	// 移除方括号（如果有）
-	pattern = strings.Trim(pattern, "[]")
-	ip = strings.Trim(ip, "[]")
+func isUDP(p protocol.NetProtocol) bool {
+	return p == protocol.NetProtocolUDP || p == protocol.NetProtocolUDP4 || p == protocol.NetProtocolUDP6
+}
 
-	// 展开 IPv6 地址
-	patternIP := net.ParseIP(strings.Replace(pattern, "*", "0", -1))
-	actualIP := net.ParseIP(ip)
+// isDatagram reports whether the reads of the protocol are messages, which must fit in a single buffer.
+func isDatagram(p protocol.NetProtocol) bool {
+	return isUDP(p) || p == protocol.NetProtocolFramed
+}
 
-	if patternIP == nil || actualIP == nil {
-		return false
+// addrIP returns the IP of the address without the port.
+func addrIP(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	case *net.UDPAddr:
+		return addr.IP.String()
 	}
-
-	patternParts := strings.Split(pattern, ":")
-	actualParts := strings.Split(ip, ":")
-
-	for i := 0; i < len(patternParts); i++ {
-		if patternParts[i] == "*" {
-			continue
-		}
-		if patternParts[i] != actualParts[i] {
-			return false
-		}
+	if addr == nil {
+		return ""
 	}
-
-	return true
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
 }
@@ -1,8 +1,26 @@
 package forwarder
 
-import "testing"
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
 
-func Test_matchIPv4(t *testing.T) {
+	"github.com/doraemonkeys/monster-pipe-core/internal/config"
+	"github.com/doraemonkeys/monster-pipe-core/pkg/protocol"
+)
+
+func Test_compileHostMatch(t *testing.T) {
 	tests := []struct {
 		name    string
 		pattern string
@@ -45,12 +63,1489 @@ func Test_matchIPv4(t *testing.T) {
 			ip:      "192.168.61.1",
 			want:    true,
 		},
+		{
+			name:    "wildcard octets are numbers",
+			pattern: "192.168.*",
+			ip:      "10.192.168.1",
+			want:    false,
+		},
+		{
+			name:    "cidr",
+			pattern: "10.0.0.0/8",
+			ip:      "10.20.30.40",
+			want:    true,
+		},
+		{
+			name:    "cidr miss",
+			pattern: "10.0.0.0/8",
+			ip:      "11.0.0.1",
+			want:    false,
+		},
+		{
+			name:    "ipv6 cidr",
+			pattern: "2001:db8::/32",
+			ip:      "2001:db8:1::5",
+			want:    true,
+		},
+		{
+			name:    "ipv6 compressed",
+			pattern: "[2001:db8::1]:80",
+			ip:      "[2001:db8:0:0::1]:80",
+			want:    true,
+		},
+		{
+			name:    "ipv6 wildcard",
+			pattern: "2001:db8:*",
+			ip:      "[2001:db8::1]:80",
+			want:    true,
+		},
+		{
+			name:    "range",
+			pattern: "192.0.2.10-192.0.2.20",
+			ip:      "192.0.2.15",
+			want:    true,
+		},
+		{
+			name:    "range miss",
+			pattern: "192.0.2.10-192.0.2.20",
+			ip:      "192.0.2.21",
+			want:    false,
+		},
+		{
+			name:    "port range",
+			pattern: "192.0.2.1:8000-9000",
+			ip:      "192.0.2.1:8080",
+			want:    true,
+		},
+		{
+			name:    "port range miss",
+			pattern: "*:8000-9000",
+			ip:      "192.0.2.1:80",
+			want:    false,
+		},
+		{
+			name:    "ipv4 mapped",
+			pattern: "192.0.2.1",
+			ip:      "[::ffff:192.0.2.1]:80",
+			want:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matcher, err := compileHostMatch(MatchHostConfig{Match: tt.pattern, AnyProto: true})
+			if err != nil {
+				t.Fatalf("compileHostMatch() error = %v", err)
+			}
+			address := tt.ip
+			if _, _, err := net.SplitHostPort(address); err != nil {
+				address = net.JoinHostPort(address, "1234")
+			}
+			ip, port, _ := remoteAddrPort(net.TCPAddrFromAddrPort(netip.MustParseAddrPort(address)))
+			if got := matcher.match(ip, port, protocol.NetProtocolTCP); got != tt.want {
+				t.Errorf("match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	for _, pattern := range []string{"192.168.*.300", "192.0.2.20-192.0.2.10", "10.0.0.0/33", "2001:db8::*", "192.0.2.1:70000"} {
+		if _, err := compileHostMatch(MatchHostConfig{Match: pattern}); err == nil {
+			t.Errorf("compileHostMatch(%q) error = nil", pattern)
+		}
+	}
+
+	// A rule with a Protocol only applies to the inputs of that protocol, in both lists.
+	// The blacklist is checked before the whitelist when both are set.
+	tcpOnly := func(match string) MatchHostConfig {
+		return MatchHostConfig{Match: match, Protocol: protocol.NetProtocolTCP}
+	}
+	aclTests := []struct {
+		name      string
+		blacklist []MatchHostConfig
+		whitelist []MatchHostConfig
+		proto     protocol.NetProtocol
+		ip        string
+		want      bool
+	}{
+		{"blacklist of the input protocol", []MatchHostConfig{tcpOnly("192.0.2.1")}, nil, protocol.NetProtocolTCP, "192.0.2.1", false},
+		{"blacklist of another protocol", []MatchHostConfig{tcpOnly("192.0.2.1")}, nil, protocol.NetProtocolUDP, "192.0.2.1", true},
+		{"whitelist of the input protocol", nil, []MatchHostConfig{tcpOnly("192.0.2.1")}, protocol.NetProtocolTCP, "192.0.2.1", true},
+		{"whitelist of another protocol", nil, []MatchHostConfig{tcpOnly("192.0.2.1")}, protocol.NetProtocolUDP, "192.0.2.1", false},
+		{"both lists, blacklisted", []MatchHostConfig{{Match: "192.0.2.5", AnyProto: true}}, []MatchHostConfig{{Match: "192.0.2.0/24", AnyProto: true}}, protocol.NetProtocolTCP, "192.0.2.5", false},
+		{"both lists, whitelisted", []MatchHostConfig{{Match: "192.0.2.5", AnyProto: true}}, []MatchHostConfig{{Match: "192.0.2.0/24", AnyProto: true}}, protocol.NetProtocolTCP, "192.0.2.6", true},
+		{"both lists, in neither", []MatchHostConfig{{Match: "192.0.2.5", AnyProto: true}}, []MatchHostConfig{{Match: "192.0.2.0/24", AnyProto: true}}, protocol.NetProtocolTCP, "198.51.100.1", false},
+	}
+	for _, tt := range aclTests {
+		acl, err := compileAccessList(tt.blacklist, tt.whitelist)
+		if err != nil {
+			t.Fatalf("%s: compileAccessList() error = %v", tt.name, err)
+		}
+		if got := acl.allowed(netip.MustParseAddr(tt.ip), 1234, tt.proto, "", false); got != tt.want {
+			t.Errorf("%s: allowed() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func Test_outputBalancer(t *testing.T) {
+	newOutput := func(port int, weight int, role ForwardOutputRole) *ForwardOutput {
+		return NewForwardOutput(ForwardOutputConfig{
+			Role:          role,
+			Weight:        weight,
+			NetAddrConfig: NetAddrConfig{Host: "127.0.0.1", Port: port, Protocol: protocol.NetProtocolTCP},
+		}, nil)
+	}
+	outputs := []*ForwardOutput{
+		newOutput(1, 3, ForwardOutputRoleNormal),
+		newOutput(2, 1, ForwardOutputRoleNormal),
+		newOutput(3, 1, ForwardOutputRoleShadow),
+	}
+	all := func(*ForwardOutput) bool { return true }
+	clientAddr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+
+	weighted := newOutputBalancer(ForwardModeWeighted, outputs)
+	counts := map[int]int{}
+	for i := 0; i < 8; i++ {
+		counts[weighted.pick(clientAddr, all).config.Port]++
+	}
+	if counts[1] != 6 || counts[2] != 2 || counts[3] != 0 {
+		t.Errorf("weighted pick counts = %v", counts)
+	}
+
+	hash := newOutputBalancer(ForwardModeHash, outputs)
+	first := hash.pick(clientAddr, all)
+	for i := 0; i < 5; i++ {
+		otherPort := &net.TCPAddr{IP: clientAddr.IP, Port: 2000 + i}
+		if got := hash.pick(otherPort, all); got != first {
+			t.Errorf("hash pick is not sticky, got %v, want %v", got.config.Port, first.config.Port)
+		}
+	}
+	failover := hash.pick(clientAddr, func(o *ForwardOutput) bool { return o != first })
+	if failover == nil || failover == first {
+		t.Errorf("hash pick did not fail over")
+	}
+
+	// The picks above count as active connections.
+	outputs[0].shared.activeConns.Store(4)
+	outputs[1].shared.activeConns.Store(0)
+	leastConn := newOutputBalancer(ForwardModeLeastConn, outputs)
+	if got := leastConn.pick(clientAddr, all); got != outputs[1] {
+		t.Errorf("least-conn pick = %v, want %v", got.config.Port, outputs[1].config.Port)
+	}
+	if got := outputs[1].ActiveConns(); got != 1 {
+		t.Errorf("ActiveConns() of the picked output = %d, want 1", got)
+	}
+}
+
+func Test_leastConnConcurrent(t *testing.T) {
+	var outputs []*ForwardOutput
+	for port := range 2 {
+		outputs = append(outputs, NewForwardOutput(ForwardOutputConfig{
+			NetAddrConfig: NetAddrConfig{Host: "127.0.0.1", Port: port + 1, Protocol: protocol.NetProtocolTCP},
+		}, nil))
+	}
+	leastConn := newOutputBalancer(ForwardModeLeastConn, outputs)
+	clientAddr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	// The connections accepted together see each other, none of them is released before the others pick.
+	picked := make(chan *ForwardOutput, 20)
+	var wg sync.WaitGroup
+	for range cap(picked) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			picked <- leastConn.pick(clientAddr, func(*ForwardOutput) bool { return true })
+		}()
+	}
+	wg.Wait()
+	close(picked)
+	var selected []*ForwardOutput
+	for output := range picked {
+		selected = append(selected, output)
+	}
+	if a, b := outputs[0].ActiveConns(), outputs[1].ActiveConns(); a != 10 || b != 10 {
+		t.Errorf("ActiveConns() after %d concurrent picks = %d and %d, want them even", len(selected), a, b)
+	}
+	releaseOutputs(selected)
+	if a, b := outputs[0].ActiveConns(), outputs[1].ActiveConns(); a != 0 || b != 0 {
+		t.Errorf("ActiveConns() after the release = %d and %d, want 0", a, b)
+	}
+}
+
+func Test_acquireConn(t *testing.T) {
+	input := NewForwardInput(ForwardInputConfig{NetAddrConfig: NetAddrConfig{Host: "127.0.0.1", Protocol: protocol.NetProtocolTCP}}, nil)
+	f := NewForwarderWithConfig(ForwarderConfig{
+		MaxConns:         3,
+		MaxConnsPerIP:    2,
+		ConnLimitAction:  ConnLimitQueue,
+		ConnQueueTimeout: 50 * time.Millisecond,
+	}, input, nil, func(ForwardMessage) {})
+	ctx := context.Background()
+	for _, ip := range []string{"192.0.2.1", "192.0.2.1", "192.0.2.2"} {
+		if err := f.acquireConn(ctx, ip); err != nil {
+			t.Fatalf("acquireConn(%s) = %v", ip, err)
+		}
+	}
+	if err := f.acquireConn(ctx, "192.0.2.3"); !errors.Is(err, ErrConnLimit) {
+		t.Errorf("acquireConn over the total limit = %v, want %v", err, ErrConnLimit)
+	}
+	f.releaseConn("192.0.2.2")
+	if err := f.acquireConn(ctx, "192.0.2.1"); !errors.Is(err, ErrConnLimit) {
+		t.Errorf("acquireConn over the client limit = %v, want %v", err, ErrConnLimit)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		f.releaseConn("192.0.2.1")
+	}()
+	if err := f.acquireConn(ctx, "192.0.2.1"); err != nil {
+		t.Errorf("queued acquireConn = %v", err)
+	}
+	if got := f.ConnectedClients(); got["192.0.2.1"] != 2 || len(got) != 1 {
+		t.Errorf("ConnectedClients() = %v", got)
+	}
+}
+
+func Test_quotaTracker(t *testing.T) {
+	store := config.NewStateFile(filepath.Join(t.TempDir(), "quota.json"))
+	quota := newQuotaTracker(QuotaConfig{Bytes: 10, Store: store})
+	quota.add("192.0.2.1", 6)
+	if err := quota.check("192.0.2.1"); err != nil {
+		t.Errorf("check() under quota = %v", err)
+	}
+	quota.add("192.0.2.1", 5)
+	if err := quota.check("192.0.2.1"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("check() over quota = %v, want %v", err, ErrQuotaExceeded)
+	}
+	if err := quota.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newQuotaTracker(QuotaConfig{Bytes: 10, Store: store})
+	if err := restarted.load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.check("192.0.2.1"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("check() after restart = %v, want %v", err, ErrQuotaExceeded)
+	}
+	if err := restarted.check("192.0.2.2"); err != nil {
+		t.Errorf("check() of another client = %v", err)
+	}
+	if err := restarted.check(quotaKey("192.0.2.1", "alice")); err != nil {
+		t.Errorf("check() of an identity from the IP over quota = %v", err)
+	}
+
+	short := newQuotaTracker(QuotaConfig{Bytes: 10, Period: 20 * time.Millisecond})
+	for i := 0; i < 100; i++ {
+		_ = short.check(netip.AddrFrom4([4]byte{192, 0, 2, byte(i)}).String())
+	}
+	short.add("192.0.2.1", 20)
+	if len(short.usage) != 1 {
+		t.Errorf("%d clients tracked, want only the one with traffic", len(short.usage))
+	}
+	time.Sleep(30 * time.Millisecond)
+	if err := short.check("192.0.2.1"); err != nil {
+		t.Errorf("check() after the period = %v", err)
+	}
+	short.prune()
+	if len(short.usage) != 0 {
+		t.Errorf("%d clients left after the period is over", len(short.usage))
+	}
+}
+
+func Test_autoBanner(t *testing.T) {
+	input := NewForwardInput(ForwardInputConfig{
+		NetAddrConfig: NetAddrConfig{Host: "127.0.0.1", Protocol: protocol.NetProtocolTCP},
+		AutoBan:       &AutoBanConfig{MaxAccepts: 2, MaxShortTunnels: 1},
+	}, nil)
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	for i := 0; i < 2; i++ {
+		if ban := input.recordBanEvent(client, banEventAccept); ban != nil {
+			t.Fatalf("banned after %d connections", i+1)
+		}
+	}
+	if ban := input.recordBanEvent(client, banEventAccept); ban == nil {
+		t.Fatal("not banned over MaxAccepts")
+	}
+	if bans := input.Bans(); len(bans) != 1 || bans[0].IP != netip.MustParseAddr("192.0.2.1") {
+		t.Errorf("Bans() = %v", bans)
+	}
+
+	other := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1234}
+	input.recordTunnelClosed(other, time.Minute)
+	input.recordTunnelClosed(other, time.Millisecond)
+	if ban := input.recordTunnelClosed(other, time.Millisecond); ban == nil {
+		t.Error("not banned over MaxShortTunnels")
+	}
+
+	if !input.Unban(netip.MustParseAddr("192.0.2.1")) || len(input.Bans()) != 1 {
+		t.Errorf("Unban() did not lift the ban, bans = %v", input.Bans())
+	}
+	third := &net.TCPAddr{IP: net.ParseIP("192.0.2.3"), Port: 1234}
+	input.recordTunnelClosed(third, time.Millisecond)
+	if input.Unban(netip.MustParseAddr("192.0.2.3")) {
+		t.Error("Unban() of a client that was not banned returned true")
+	}
+	if ban := input.recordTunnelClosed(third, time.Millisecond); ban != nil {
+		t.Errorf("Unban() kept the events of the client, banned: %v", ban)
+	}
+	input.ClearBans()
+	if bans := input.Bans(); len(bans) != 0 {
+		t.Errorf("Bans() after ClearBans() = %v", bans)
+	}
+}
+
+func Test_clientOutputError(t *testing.T) {
+	resetErr := errors.New("read from output error: connection reset by peer")
+	dialErr := fmt.Errorf("%w: connection refused", errOutputDial)
+	tests := []struct {
+		name    string
+		message ForwardConnMessage
+		want    bool
+	}{
+		{"read error", ForwardConnMessage{MessageType: ForwardConnMsgTypeOutputReadError, Err: resetErr}, true},
+		{"write error", ForwardConnMessage{MessageType: ForwardConnMsgTypeWriteToOutputError, Err: resetErr}, true},
+		{"failed dial", ForwardConnMessage{MessageType: ForwardConnMsgTypeWriteToOutputError, Err: dialErr}, false},
+		{"open circuit", ForwardConnMessage{MessageType: ForwardConnMsgTypeOutputReadError, Err: fmt.Errorf("%w: %w", errOutputDial, ErrCircuitOpen)}, false},
+		{"shadow", ForwardConnMessage{MessageType: ForwardConnMsgTypeOutputReadError, Err: resetErr, Output: ForwardOutputConfig{Role: ForwardOutputRoleShadow}}, false},
+		{"input error", ForwardConnMessage{MessageType: ForwardConnMsgTypeInputReadError, Err: resetErr}, false},
+	}
+	for _, tt := range tests {
+		if got := clientOutputError(tt.message); got != tt.want {
+			t.Errorf("%s: clientOutputError() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func Test_accessListIdentity(t *testing.T) {
+	acl, err := compileAccessList(
+		[]MatchHostConfig{{Match: "*", AnyProto: true, Identity: "mallory"}},
+		[]MatchHostConfig{{Match: "10.0.0.0/8", AnyProto: true, Identity: "backup-*"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := netip.MustParseAddr("10.0.0.1")
+	tests := []struct {
+		identity   string
+		identified bool
+		want       bool
+	}{
+		{"", false, true},
+		{"backup-1", true, true},
+		{"alice", true, false},
+		{"", true, false},
+	}
+	for _, tt := range tests {
+		if got := acl.allowed(ip, 443, protocol.NetProtocolTCP, tt.identity, tt.identified); got != tt.want {
+			t.Errorf("allowed(%q, %v) = %v, want %v", tt.identity, tt.identified, got, tt.want)
+		}
+	}
+	if acl.allowed(netip.MustParseAddr("192.0.2.1"), 443, protocol.NetProtocolTCP, "", false) {
+		t.Errorf("allowed() outside the whitelist = true, want false")
+	}
+	if _, err := compileAccessList(nil, []MatchHostConfig{{Match: "*", Identity: "["}}); err == nil {
+		t.Errorf("compileAccessList() with an invalid identity, want error")
+	}
+}
+
+// idConn stands for a stream authenticated under TLS, like a psk.Conn.
+type idConn struct {
+	net.Conn
+	id string
+}
+
+func (c idConn) ID() string {
+	return c.id
+}
+
+func Test_connIdentity(t *testing.T) {
+	cert, err := config.NewSelfSignedCert(config.SelfSignedConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"alice", ""} {
+		serverPipe, clientPipe := net.Pipe()
+		server := tls.Server(idConn{Conn: serverPipe, id: id}, &tls.Config{GetCertificate: cert.GetCertificate})
+		client := tls.Client(clientPipe, &tls.Config{InsecureSkipVerify: true})
+		go func() {
+			_ = client.Handshake()
+		}()
+		if err := server.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		// The TLS client has no certificate, the identity is found under it.
+		if got := connIdentity(server); got != id {
+			t.Errorf("connIdentity() = %q, want %q", got, id)
+		}
+		_ = server.Close()
+		_ = client.Close()
+	}
+}
+
+func Test_udpSessions(t *testing.T) {
+	l, err := DefaultListen(context.Background(), "udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	listener := l.(*UdpListener)
+	if err := listener.configure(UDPConfig{IdleTimeout: 200 * time.Millisecond, MaxSessions: 1, MaxDatagramSize: 16}); err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan UDPSessionMessage, 10)
+	listener.setEventWatcher(func(_ net.Addr, message UDPSessionMessage) { events <- message })
+
+	client, err := net.Dial("udp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	session, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _, _ = listener.Accept() }()
+	if message := <-events; message.Event != UDPSessionCreated || message.Sessions != 1 {
+		t.Errorf("first event = %+v", message)
+	}
+	buf := make([]byte, 64)
+	if n, err := session.Read(buf); err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("Read() = %q, %v", buf[:n], err)
+	}
+
+	_ = session.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := session.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read() past the deadline error = %v", err)
+	}
+	_ = session.SetReadDeadline(time.Time{})
+	if _, err := client.Write(make([]byte, 17)); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := net.Dial("udp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	_, _ = other.Write([]byte("over the limit"))
+	if message := <-events; message.Event != UDPSessionRejected || message.Dropped != 1 {
+		t.Errorf("event over MaxSessions = %+v", message)
+	}
+	// The next datagrams of the rejected client are not reported again within the period, the next event is the expiry.
+	_, _ = other.Write([]byte("over the limit"))
+	_, _ = other.Write([]byte("over the limit"))
+
+	if _, err := session.Read(buf); !errors.Is(err, io.EOF) {
+		t.Errorf("Read() of an idle session error = %v", err)
+	}
+	if message := <-events; message.Event != UDPSessionExpired || message.Sessions != 0 || message.Oversized != 1 {
+		t.Errorf("idle event = %+v", message)
+	}
+	_ = session.Close()
+}
+
+// udpSession returns a session of a configured listener and its client, which sent "ping".
+func udpSession(t *testing.T, config UDPConfig) (*UdpConn, net.Conn) {
+	t.Helper()
+	l, err := DefaultListen(context.Background(), "udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	listener := l.(*UdpListener)
+	if err := listener.configure(config); err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.Dial("udp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	session, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = session.Close() })
+	// Accept reads the datagrams of the sessions too.
+	go func() { _, _ = listener.Accept() }()
+	buf := make([]byte, 64)
+	if n, err := session.Read(buf); err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("Read() = %q, %v", buf[:n], err)
+	}
+	return session.(*UdpConn), client
+}
+
+func Test_udpSessionIdleTimeout(t *testing.T) {
+	// The sessions expire by default.
+	session, _ := udpSession(t, UDPConfig{})
+	if timeout := session.listener.config.IdleTimeout; timeout != defaultUDPIdleTimeout {
+		t.Errorf("default IdleTimeout = %v, want %v", timeout, defaultUDPIdleTimeout)
+	}
+	if session.idleTimer == nil {
+		t.Fatal("no idle timer with the default IdleTimeout")
+	}
+	session.lastActive.Store(time.Now().Add(-defaultUDPIdleTimeout).UnixNano())
+	session.idleTimer.Reset(0)
+	buf := make([]byte, 64)
+	_ = session.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := session.Read(buf); !errors.Is(err, io.EOF) {
+		t.Errorf("Read() of a session idle for the default IdleTimeout = %v, want EOF", err)
+	}
+
+	// With a negative IdleTimeout the session waits for the next datagram as long as it takes.
+	session, client := udpSession(t, UDPConfig{IdleTimeout: -1})
+	if session.idleTimer != nil {
+		t.Error("idle timer with a negative IdleTimeout")
+	}
+	_ = session.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, err := session.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read() of a quiet session = %v, want the deadline", err)
+	}
+	_ = session.SetReadDeadline(time.Time{})
+	if _, err := client.Write([]byte("later")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := session.Read(buf); err != nil || string(buf[:n]) != "later" {
+		t.Errorf("Read() = %q, %v", buf[:n], err)
+	}
+}
+
+// startForwarder runs a forwarder with a TCP input on a loopback port, it returns the address of the input.
+func startForwarder(t *testing.T, config ForwarderConfig, inputConfig ForwardInputConfig, outputs []*ForwardOutput, msgWatcher func(ForwardMessage)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inputConfig.Protocol == "" {
+		inputConfig.Protocol = protocol.NetProtocolTCP
+	}
+	input := NewForwardInput(inputConfig, func(context.Context, string, string) (net.Listener, error) {
+		return l, nil
+	})
+	if msgWatcher == nil {
+		msgWatcher = func(ForwardMessage) {}
+	}
+	f := NewForwarderWithConfig(config, input, outputs, msgWatcher)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = f.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return l.Addr().String()
+}
+
+// serveTCP serves each connection of a loopback listener with handle, it returns the address of the listener.
+func serveTCP(t *testing.T, handle func(conn net.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// echoTCP writes back what it reads until EOF, then half-closes the connection.
+func echoTCP(conn net.Conn) {
+	_, _ = io.Copy(conn, conn)
+	_ = closeWrite(conn)
+}
+
+func newTCPOutput(t *testing.T, address string, config ForwardOutputConfig) *ForwardOutput {
+	t.Helper()
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Readable = true
+	config.Writable = true
+	config.NetAddrConfig = NetAddrConfig{Host: addrPort.Addr().String(), Port: int(addrPort.Port()), Protocol: protocol.NetProtocolTCP}
+	return NewForwardOutput(config, nil)
+}
+
+// roundTrip sends data to the forwarder, half-closes the connection and returns everything read back.
+func roundTrip(t *testing.T, address string, data []byte) []byte {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read the reply: %v", err)
+	}
+	return got
+}
+
+func Test_primaryShadowTunnel(t *testing.T) {
+	primary := serveTCP(t, func(conn net.Conn) {
+		data, _ := io.ReadAll(conn)
+		_, _ = conn.Write(append([]byte("primary:"), data...))
+	})
+	shadowGot := make(chan []byte, 1)
+	shadow := serveTCP(t, func(conn net.Conn) {
+		_, _ = conn.Write([]byte("shadow:"))
+		data, _ := io.ReadAll(conn)
+		shadowGot <- data
+		_, _ = conn.Write([]byte("shadow reply"))
+	})
+	address := startForwarder(t, ForwarderConfig{}, ForwardInputConfig{}, []*ForwardOutput{
+		newTCPOutput(t, shadow, ForwardOutputConfig{Role: ForwardOutputRoleShadow}),
+		newTCPOutput(t, primary, ForwardOutputConfig{Role: ForwardOutputRolePrimary}),
+	}, nil)
+
+	if got := roundTrip(t, address, []byte("hello")); string(got) != "primary:hello" {
+		t.Errorf("reply = %q, want only the response of the primary", got)
+	}
+	select {
+	case got := <-shadowGot:
+		if string(got) != "hello" {
+			t.Errorf("shadow received %q, want %q", got, "hello")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shadow did not receive the data")
+	}
+}
+
+func Test_outputTLS(t *testing.T) {
+	serverDir, clientDir := t.TempDir(), t.TempDir()
+	serverCert, err := config.NewSelfSignedCert(config.SelfSignedConfig{Dir: serverDir, Hosts: []string{"backend.test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := config.NewSelfSignedCert(config.SelfSignedConfig{Dir: clientDir, Hosts: []string{"client.test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		GetCertificate: serverCert.GetCertificate,
+		ClientAuth:     tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	type handshake struct {
+		serverName string
+		clientCert []byte
+	}
+	handshakes := make(chan handshake, 8)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tlsConn := conn.(*tls.Conn)
+				if tlsConn.Handshake() != nil {
+					return
+				}
+				state := tlsConn.ConnectionState()
+				handshakes <- handshake{serverName: state.ServerName, clientCert: state.PeerCertificates[0].Raw}
+				echoTCP(conn)
+			}()
+		}
+	}()
+
+	tlsConfig := OutputTLSConfig{
+		ServerName: "backend.test",
+		CAFile:     filepath.Join(serverDir, "mpipe-ca.pem"),
+		CertFile:   filepath.Join(clientDir, "mpipe-cert.pem"),
+		KeyFile:    filepath.Join(clientDir, "mpipe-cert.key"),
+	}
+	address := startForwarder(t, ForwarderConfig{}, ForwardInputConfig{}, []*ForwardOutput{
+		newTCPOutput(t, l.Addr().String(), ForwardOutputConfig{TLS: &tlsConfig}),
+	}, nil)
+	if got := roundTrip(t, address, []byte("hello")); string(got) != "hello" {
+		t.Errorf("reply = %q, want %q", got, "hello")
+	}
+	select {
+	case h := <-handshakes:
+		if h.serverName != "backend.test" {
+			t.Errorf("SNI = %q, want backend.test", h.serverName)
+		}
+		if !slices.Equal(h.clientCert, clientCert.Leaf().Raw) {
+			t.Error("the output did not present the client certificate")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the backend saw no handshake")
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c *OutputTLSConfig)
+	}{
+		{"system roots", func(c *OutputTLSConfig) { c.CAFile = "" }},
+		{"wrong server name", func(c *OutputTLSConfig) { c.ServerName = "other.test" }},
+		{"untrusted CA", func(c *OutputTLSConfig) { c.CAFile = filepath.Join(clientDir, "mpipe-ca.pem") }},
+		{"missing client cert", func(c *OutputTLSConfig) { c.CertFile = filepath.Join(clientDir, "missing.pem") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tlsConfig
+			tt.modify(&c)
+			output := newTCPOutput(t, l.Addr().String(), ForwardOutputConfig{TLS: &c})
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := output.Dial(ctx); err == nil {
+				_ = output.Close()
+				t.Error("Dial() succeeded")
+			}
+		})
+	}
+}
+
+func Test_outputWriterOverflow(t *testing.T) {
+	newWriter := func(config ForwardOutputConfig, watcher func(ForwardConnMessage)) *outputWriter {
+		config.WriteQueueSize = 1
+		config.Writable = true
+		tunnel := NewForwardTunnelWithConfig(ForwardTunnelConfig{ConnEventsOnly: true}, nil, nil, watcher)
+		return newOutputWriter(tunnel, NewForwardOutput(config, nil))
+	}
+	pool := newBufferPool(8, 0)
+	newChunk := func(data string) *chunk {
+		buf, _ := pool.get(context.Background(), nil)
+		c := &chunk{buf: buf, data: append(buf[:0], data...), pool: pool}
+		c.refs.Store(1)
+		return c
+	}
+	queued := func(w *outputWriter) string {
+		select {
+		case c := <-w.queue:
+			defer c.release()
+			return string(c.data)
+		default:
+			return ""
+		}
+	}
+
+	if got := newWriter(ForwardOutputConfig{}, nil).policy; got != ForwardOutputOverflowBlock {
+		t.Errorf("default policy = %v, want %v", got, ForwardOutputOverflowBlock)
+	}
+	if got := newWriter(ForwardOutputConfig{Role: ForwardOutputRoleShadow}, nil).policy; got != ForwardOutputOverflowDropNewest {
+		t.Errorf("default policy of a shadow = %v, want %v", got, ForwardOutputOverflowDropNewest)
+	}
+
+	for _, tt := range []struct {
+		policy       ForwardOutputOverflowPolicy
+		queued       string
+		droppedBytes int
+	}{
+		{ForwardOutputOverflowDropNewest, "first", len("second")},
+		{ForwardOutputOverflowDropOldest, "second", len("first")},
+		{ForwardOutputOverflowDisconnect, "first", 0},
+	} {
+		var messages []ForwardConnMessage
+		w := newWriter(ForwardOutputConfig{OverflowPolicy: tt.policy}, func(message ForwardConnMessage) {
+			messages = append(messages, message)
+		})
+		w.enqueue(context.Background(), newChunk("first"))
+		w.enqueue(context.Background(), newChunk("second"))
+		if got := queued(w); got != tt.queued {
+			t.Errorf("%v: queued %q, want %q", tt.policy, got, tt.queued)
+		}
+		if len(messages) != 1 {
+			t.Fatalf("%v: messages = %+v", tt.policy, messages)
+		}
+		message := messages[0]
+		if tt.policy == ForwardOutputOverflowDisconnect {
+			if message.MessageType != ForwardConnMsgTypeOutputQueueDisconnect || !w.disconnected.Load() {
+				t.Errorf("%v: message = %+v, disconnected = %v", tt.policy, message, w.disconnected.Load())
+			}
+			w.enqueue(context.Background(), newChunk("third"))
+			if got := queued(w); got != "" {
+				t.Errorf("%v: queued %q after the disconnect", tt.policy, got)
+			}
+		} else if message.MessageType != ForwardConnMsgTypeOutputQueueDropped || message.Dropped != 1 || message.DroppedBytes != tt.droppedBytes || message.Data != nil {
+			t.Errorf("%v: message = %+v", tt.policy, message)
+		}
+	}
+
+	w := newWriter(ForwardOutputConfig{OverflowPolicy: ForwardOutputOverflowBlock}, nil)
+	w.enqueue(context.Background(), newChunk("first"))
+	enqueued := make(chan struct{})
+	go func() {
+		defer close(enqueued)
+		w.enqueue(context.Background(), newChunk("second"))
+	}()
+	select {
+	case <-enqueued:
+		t.Fatal("block policy did not wait for room in the queue")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if got := queued(w); got != "first" {
+		t.Errorf("block: queued %q, want %q", got, "first")
+	}
+	<-enqueued
+	if got := queued(w); got != "second" {
+		t.Errorf("block: queued %q, want %q", got, "second")
+	}
+	if used := pool.used.Load(); used != 0 {
+		t.Errorf("%d bytes of the pool are not released", used)
+	}
+}
+
+func Test_healthCheckThresholds(t *testing.T) {
+	// The probes get these responses in turn, then "ok".
+	script := []string{"ok", "no", "ok", "no", "no", "ok", "ok"}
+	var probes atomic.Int32
+	address := serveTCP(t, func(conn net.Conn) {
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		response := "ok"
+		if n := int(probes.Add(1)); n <= len(script) {
+			response = script[n-1]
+		}
+		_, _ = conn.Write([]byte(response))
+	})
+	output := newTCPOutput(t, address, ForwardOutputConfig{HealthCheck: &HealthCheckConfig{
+		Type:     HealthCheckExpect,
+		Interval: time.Millisecond,
+		Send:     []byte("PING"),
+		Expect:   []byte("ok"),
+		Rise:     2,
+		Fall:     2,
+	}})
+	type change struct {
+		healthy bool
+		probe   int32
+	}
+	changes := make(chan change, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go output.runHealthCheck(ctx, func(message ForwardHealthMessage) {
+		changes <- change{message.Healthy, probes.Load()}
+	})
+	// A single failure is under Fall, the output goes down after the 4th and 5th probes, and up after the 6th and 7th.
+	for _, want := range []change{{false, 5}, {true, 7}} {
+		select {
+		case got := <-changes:
+			if got != want {
+				t.Errorf("health change = %+v, want %+v", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no health change, want %+v", want)
+		}
+	}
+
+	udpOutput := NewForwardOutput(ForwardOutputConfig{
+		HealthCheck:   &HealthCheckConfig{Type: HealthCheckExpect},
+		NetAddrConfig: NetAddrConfig{Host: "127.0.0.1", Port: 53, Protocol: protocol.NetProtocolUDP},
+	}, nil)
+	input := NewForwardInput(ForwardInputConfig{NetAddrConfig: NetAddrConfig{Host: "127.0.0.1", Protocol: protocol.NetProtocolTCP}}, nil)
+	if err := NewForwarder(input, []*ForwardOutput{udpOutput}, func(ForwardMessage) {}).Run(ctx); err == nil {
+		t.Error("Run() with a health check on a udp output, want error")
+	}
+}
+
+func Test_selectOutputsBackup(t *testing.T) {
+	newOutput := func(port int, backup bool) *ForwardOutput {
+		return NewForwardOutput(ForwardOutputConfig{
+			Backup:        backup,
+			NetAddrConfig: NetAddrConfig{Host: "127.0.0.1", Port: port, Protocol: protocol.NetProtocolTCP},
+		}, nil)
+	}
+	outputs := []*ForwardOutput{newOutput(1, false), newOutput(2, false), newOutput(3, true)}
+	input := NewForwardInput(ForwardInputConfig{NetAddrConfig: NetAddrConfig{Host: "127.0.0.1", Protocol: protocol.NetProtocolTCP}}, nil)
+	clientAddr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	ports := func(selected []*ForwardOutput) []int {
+		var ports []int
+		for _, output := range selected {
+			ports = append(ports, output.config.Port)
+		}
+		return ports
+	}
+	for _, mode := range []ForwardMode{ForwardModeFanOut, ForwardModeRoundRobin} {
+		f := NewForwarderWithConfig(ForwarderConfig{Mode: mode}, input, outputs, func(ForwardMessage) {})
+		for _, output := range outputs {
+			output.shared.unhealthy.Store(false)
+		}
+		for i := 0; i < 4; i++ {
+			if got := ports(f.selectOutputs(clientAddr)); slices.Contains(got, 3) {
+				t.Errorf("%v: selected %v while the primaries are healthy", mode, got)
+			}
+		}
+		outputs[0].shared.unhealthy.Store(true)
+		for i := 0; i < 4; i++ {
+			if got := ports(f.selectOutputs(clientAddr)); !slices.Equal(got, []int{2}) {
+				t.Errorf("%v: selected %v with one primary down, want [2]", mode, got)
+			}
+		}
+		outputs[1].shared.unhealthy.Store(true)
+		if got := ports(f.selectOutputs(clientAddr)); !slices.Equal(got, []int{3}) {
+			t.Errorf("%v: selected %v with all the primaries down, want [3]", mode, got)
+		}
+		outputs[2].shared.unhealthy.Store(true)
+		if got := f.selectOutputs(clientAddr); len(got) != 0 {
+			t.Errorf("%v: selected %v with all the outputs down", mode, ports(got))
+		}
+	}
+}
+
+func Test_dialWithPolicy(t *testing.T) {
+	var attempts atomic.Int32
+	// dial fails the first failures attempts, then waits for release and connects, or returns the error of the context.
+	newOutput := func(dialConfig ForwardOutputDialConfig, failures int32, release <-chan struct{}) (*ForwardOutput, *[]ForwardConnMessage) {
+		attempts.Store(0)
+		output := NewForwardOutput(ForwardOutputConfig{
+			Dial:          dialConfig,
+			NetAddrConfig: NetAddrConfig{Host: "127.0.0.1", Port: 1, Protocol: protocol.NetProtocolTCP},
+		}, func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+			if attempts.Add(1) <= failures {
+				return nil, errors.New("connection refused")
+			}
+			select {
+			case <-release:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			a, b := net.Pipe()
+			_ = b.Close()
+			return a, nil
+		})
+		var mu sync.Mutex
+		messages := &[]ForwardConnMessage{}
+		output.dialWatcher = func(message ForwardConnMessage) {
+			mu.Lock()
+			defer mu.Unlock()
+			*messages = append(*messages, message)
+		}
+		return output, messages
+	}
+	released := make(chan struct{})
+	close(released)
+	ctx := context.Background()
+
+	output, messages := newOutput(ForwardOutputDialConfig{Retries: 2, Backoff: 20 * time.Millisecond, BackoffMax: 30 * time.Millisecond}, 2, released)
+	start := time.Now()
+	if conn, err := output.dialWithPolicy(ctx); err != nil {
+		t.Fatalf("dial with retries = %v", err)
+	} else {
+		_ = conn.Close()
+	}
+	// The jittered delays are at least half of 20ms and of 30ms.
+	if elapsed := time.Since(start); attempts.Load() != 3 || len(*messages) != 2 || elapsed < 25*time.Millisecond {
+		t.Errorf("dial with retries: %d attempts, %d messages in %s", attempts.Load(), len(*messages), elapsed)
+	}
+	for _, message := range *messages {
+		if message.MessageType != ForwardConnMsgTypeDialRetry {
+			t.Errorf("retry message = %+v", message)
+		}
+	}
+
+	release := make(chan struct{})
+	output, messages = newOutput(ForwardOutputDialConfig{BreakerThreshold: 2, BreakerCooldown: 50 * time.Millisecond}, 2, release)
+	for i := 0; i < 2; i++ {
+		if _, err := output.dialWithPolicy(ctx); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("dial %d = %v, want the dial error", i+1, err)
+		}
+	}
+	if !output.CircuitOpen() || len(*messages) != 1 || (*messages)[0].MessageType != ForwardConnMsgTypeCircuitOpen {
+		t.Fatalf("breaker not open after 2 failures, messages = %+v", *messages)
+	}
+	if _, err := output.dialWithPolicy(ctx); !errors.Is(err, ErrCircuitOpen) || attempts.Load() != 2 {
+		t.Errorf("dial while open = %v after %d attempts, want %v without an attempt", err, attempts.Load(), ErrCircuitOpen)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if output.CircuitOpen() {
+		t.Fatal("breaker still open after the cooldown")
+	}
+	// Half-open, a single attempt is let through.
+	probeCtx, cancelProbe := context.WithCancel(ctx)
+	probeDone := make(chan error)
+	go func() {
+		_, err := output.dialWithPolicy(probeCtx)
+		probeDone <- err
+	}()
+	for attempts.Load() != 3 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := output.dialWithPolicy(ctx); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("second dial while half-open = %v, want %v", err, ErrCircuitOpen)
+	}
+	// The tunnel of the probe gives up, it is not a failure of the output.
+	cancelProbe()
+	if err := <-probeDone; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled probe = %v", err)
+	}
+	go func() {
+		_, err := output.dialWithPolicy(ctx)
+		probeDone <- err
+	}()
+	close(release)
+	if err := <-probeDone; err != nil {
+		t.Errorf("probe after the cancelled one = %v", err)
+	}
+	if output.CircuitOpen() || output.shared.breaker.failures != 0 {
+		t.Errorf("breaker not closed by a successful probe, failures = %d", output.shared.breaker.failures)
+	}
+
+	output, _ = newOutput(ForwardOutputDialConfig{BreakerThreshold: 1}, 0, make(chan struct{}))
+	cancelCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := output.dialWithPolicy(cancelCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("dial with an expired context = %v", err)
+	}
+	if output.CircuitOpen() {
+		t.Error("breaker opened by the context of the tunnel")
+	}
+}
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+func Test_tunnelSplice(t *testing.T) {
+	backend := serveTCP(t, echoTCP)
+	tests := []struct {
+		name   string
+		config ForwardTunnelConfig
+		splice bool
+	}{
+		{"events only", ForwardTunnelConfig{ConnEventsOnly: true}, true},
+		{"chunk events", ForwardTunnelConfig{}, false},
+		{"idle timeout", ForwardTunnelConfig{ConnEventsOnly: true, IdleTimeout: time.Minute}, false},
+		{"rate limit", ForwardTunnelConfig{ConnEventsOnly: true, Rate: RateLimitConfig{Up: RateLimit{BytesPerSecond: 1 << 30}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, input := tcpPair(t)
+			// The splice path never takes a buffer from the pool.
+			tt.config.pool = newBufferPool(1024, 0)
+			tunnel := NewForwardTunnelWithConfig(tt.config, input, []*ForwardOutput{newTCPOutput(t, backend, ForwardOutputConfig{})}, nil)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				tunnel.Run(context.Background())
+			}()
+			_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 5)
+			if _, err := client.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "hello" {
+				t.Fatalf("echo = %q, %v", buf, err)
+			}
+			if spliced := tt.config.pool.used.Load() == 0; spliced != tt.splice {
+				t.Errorf("spliced = %v, want %v", spliced, tt.splice)
+			}
+			_ = client.CloseWrite()
+			if rest, err := io.ReadAll(client); err != nil || len(rest) != 0 {
+				t.Errorf("after the half-close read %q, %v", rest, err)
+			}
+			<-done
+		})
+	}
+}
+
+func Test_bufferPool(t *testing.T) {
+	pool := newBufferPool(1024, 2048)
+	ctx := context.Background()
+	// The buffers go back to the pool, sync.Pool only drops some of them under the race detector.
+	arrays := map[*byte]bool{}
+	for i := 0; i < 100; i++ {
+		buf, err := pool.get(ctx, nil)
+		if err != nil || len(buf) != 1024 {
+			t.Fatalf("get() = %d bytes, %v", len(buf), err)
+		}
+		arrays[&buf[0]] = true
+		pool.put(buf)
+	}
+	if len(arrays) > 50 {
+		t.Errorf("%d buffers allocated for 100 gets, the pool does not reuse them", len(arrays))
+	}
+
+	first, _ := pool.get(ctx, nil)
+	second, _ := pool.get(ctx, nil)
+	if pool.available(1) {
+		t.Error("available(1) = true with the budget used up")
+	}
+	closed := make(chan struct{})
+	close(closed)
+	if _, err := pool.get(ctx, closed); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("get() over the budget of a closed tunnel = %v, want %v", err, net.ErrClosed)
+	}
+	waiting := make(chan []byte)
+	go func() {
+		buf, _ := pool.get(ctx, nil)
+		waiting <- buf
+	}()
+	select {
+	case <-waiting:
+		t.Fatal("get() over the budget did not wait")
+	case <-time.After(20 * time.Millisecond):
+	}
+	// A buffer too small to be reused still gives back its budget and wakes the waiter.
+	pool.put(first[:0:512])
+	pool.put(<-waiting)
+	pool.put(second)
+	if used := pool.used.Load(); used != 0 {
+		t.Errorf("used = %d after all the buffers are back", used)
+	}
+}
+
+func Test_memoryBudget(t *testing.T) {
+	echo := func(t *testing.T, conn net.Conn, data string, timeout time.Duration) error {
+		t.Helper()
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+		if _, err := conn.Write([]byte(data)); err != nil {
+			return err
+		}
+		buf := make([]byte, len(data))
+		_, err := io.ReadFull(conn, buf)
+		return err
+	}
+	backend := serveTCP(t, echoTCP)
+	for _, action := range []MemoryBudgetAction{MemoryBudgetReject, MemoryBudgetBackpressure} {
+		t.Run(action.String(), func(t *testing.T) {
+			messages := make(chan ForwardMessage, 10)
+			// A load balanced tunnel takes a buffer for the input and one for its output, the budget holds one tunnel.
+			address := startForwarder(t, ForwarderConfig{
+				Mode:               ForwardModeRoundRobin,
+				BufferSize:         1024,
+				MemoryBudget:       2048,
+				MemoryBudgetAction: action,
+			}, ForwardInputConfig{}, []*ForwardOutput{
+				newTCPOutput(t, backend, ForwardOutputConfig{}),
+				newTCPOutput(t, backend, ForwardOutputConfig{}),
+			}, func(message ForwardMessage) {
+				if message.MessageType == ForwardMsgTypeMemoryExhausted {
+					messages <- message
+				}
+			})
+			first, err := net.Dial("tcp", address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer first.Close()
+			if err := echo(t, first, "first", 5*time.Second); err != nil {
+				t.Fatalf("first tunnel: %v", err)
+			}
+			second, err := net.Dial("tcp", address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer second.Close()
+			err = echo(t, second, "second", 100*time.Millisecond)
+			if action == MemoryBudgetReject {
+				if err == nil {
+					t.Fatal("second tunnel served over the budget")
+				}
+				select {
+				case message := <-messages:
+					if !errors.Is(message.Err, ErrMemoryBudgetExceeded) {
+						t.Errorf("message = %+v", message)
+					}
+				case <-time.After(5 * time.Second):
+					t.Error("no memory exhausted message")
+				}
+				return
+			}
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("second tunnel over the budget = %v, want it to wait", err)
+			}
+			_ = first.Close()
+			buf := make([]byte, len("second"))
+			_ = second.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.ReadFull(second, buf); err != nil || string(buf) != "second" {
+				t.Errorf("second tunnel after the first closed = %q, %v", buf, err)
+			}
+		})
+	}
+}
+
+func Test_halfClose(t *testing.T) {
+	// The input half-closes first, the output replies after its EOF.
+	replyAfterEOF := serveTCP(t, func(conn net.Conn) {
+		data, _ := io.ReadAll(conn)
+		_, _ = conn.Write(append([]byte("got:"), data...))
+	})
+	// The output half-closes first, the input still sends after its EOF.
+	lateInput := make(chan string, 10)
+	sendFirst := serveTCP(t, func(conn net.Conn) {
+		_, _ = conn.Write([]byte("hi"))
+		_ = closeWrite(conn)
+		data, _ := io.ReadAll(conn)
+		lateInput <- string(data)
+	})
+	tests := []struct {
+		name    string
+		config  ForwarderConfig
+		outputs int
+	}{
+		{"splice", ForwarderConfig{ConnEventsOnly: true}, 1},
+		{"single output", ForwarderConfig{}, 1},
+		{"fan out", ForwarderConfig{}, 2},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := matchIPv4(tt.pattern, tt.ip); got != tt.want {
-				t.Errorf("matchIPv4() = %v, want %v", got, tt.want)
+			newOutputs := func(address string) []*ForwardOutput {
+				var outputs []*ForwardOutput
+				for i := 0; i < tt.outputs; i++ {
+					role := ForwardOutputRolePrimary
+					if i > 0 {
+						role = ForwardOutputRoleShadow
+					}
+					outputs = append(outputs, newTCPOutput(t, address, ForwardOutputConfig{Role: role}))
+				}
+				return outputs
+			}
+
+			address := startForwarder(t, tt.config, ForwardInputConfig{}, newOutputs(replyAfterEOF), nil)
+			if got := roundTrip(t, address, []byte("hello")); string(got) != "got:hello" {
+				t.Errorf("reply after the EOF of the input = %q", got)
+			}
+
+			address = startForwarder(t, tt.config, ForwardInputConfig{}, newOutputs(sendFirst), nil)
+			conn, err := net.Dial("tcp", address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if got, err := io.ReadAll(conn); err != nil || string(got) != "hi" {
+				t.Fatalf("read until the EOF of the output = %q, %v", got, err)
+			}
+			if _, err := conn.Write([]byte("late")); err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.(*net.TCPConn).CloseWrite()
+			for i := 0; i < tt.outputs; i++ {
+				select {
+				case got := <-lateInput:
+					if got != "late" {
+						t.Errorf("output received %q after its EOF, want %q", got, "late")
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("the data sent after the EOF of the output did not arrive")
+				}
+			}
+		})
+	}
+}
+
+func Test_tunnelIdleTimeout(t *testing.T) {
+	backend := serveTCP(t, echoTCP)
+	messages := make(chan ForwardConnMessageType, 10)
+	address := startForwarder(t, ForwarderConfig{IdleTimeout: 100 * time.Millisecond}, ForwardInputConfig{},
+		[]*ForwardOutput{newTCPOutput(t, backend, ForwardOutputConfig{})}, func(message ForwardMessage) {
+			if message.TunnelMsg != nil && message.TunnelMsg.MessageType == ForwardConnMsgTypeIdleTimeout {
+				messages <- message.TunnelMsg.MessageType
+			}
+		})
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1)
+	// The traffic keeps the tunnel open past the idle timeout.
+	for i := 0; i < 6; i++ {
+		if _, err := conn.Write([]byte("a")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("active tunnel closed: %v", err)
+		}
+		time.Sleep(30 * time.Millisecond)
+	}
+	start := time.Now()
+	if _, err := conn.Read(buf); err == nil {
+		t.Fatal("idle tunnel not closed")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("idle tunnel closed after %s", elapsed)
+	}
+	select {
+	case <-messages:
+	case <-time.After(5 * time.Second):
+		t.Error("no idle timeout message")
+	}
+}
+
+func Test_drainTimeout(t *testing.T) {
+	backend := serveTCP(t, echoTCP)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := NewForwardInput(ForwardInputConfig{NetAddrConfig: NetAddrConfig{Protocol: protocol.NetProtocolTCP}}, func(context.Context, string, string) (net.Listener, error) {
+		return l, nil
+	})
+	forceClosed := make(chan struct{}, 10)
+	f := NewForwarderWithConfig(ForwarderConfig{DrainTimeout: 200 * time.Millisecond}, input,
+		[]*ForwardOutput{newTCPOutput(t, backend, ForwardOutputConfig{})}, func(message ForwardMessage) {
+			if message.TunnelMsg != nil && message.TunnelMsg.MessageType == ForwardConnMsgTypeForceClosed {
+				forceClosed <- struct{}{}
+			}
+		})
+	runDone := make(chan error, 1)
+	go func() { runDone <- f.Run(context.Background()) }()
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1)
+		if _, err := conn.Write([]byte("a")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	finishing, stuck := dial(), dial()
+	defer stuck.Close()
+	start := time.Now()
+	f.Drain()
+	// The tunnel that finishes within the drain timeout is not interrupted.
+	time.Sleep(50 * time.Millisecond)
+	if _, err := finishing.Write([]byte("b")); err != nil {
+		t.Fatalf("tunnel closed by the drain before the timeout: %v", err)
+	}
+	_ = finishing.(*net.TCPConn).CloseWrite()
+	if got, err := io.ReadAll(finishing); err != nil || string(got) != "b" {
+		t.Errorf("draining tunnel = %q, %v", got, err)
+	}
+	_ = finishing.Close()
+
+	if err := <-runDone; err != nil {
+		t.Errorf("Run() after the drain = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Run() returned %s after Drain(), before the drain timeout", elapsed)
+	}
+	if len(forceClosed) != 1 {
+		t.Errorf("%d tunnels force closed, want 1", len(forceClosed))
+	}
+	if _, err := stuck.Read(make([]byte, 1)); err == nil {
+		t.Error("tunnel left after the drain timeout is still open")
+	}
+	if _, err := net.DialTimeout("tcp", l.Addr().String(), time.Second); err == nil {
+		t.Error("the input still accepts connections after the drain")
+	}
+}
+
+func Test_rateLimits(t *testing.T) {
+	sink := serveTCP(t, func(conn net.Conn) {
+		_, _ = io.Copy(io.Discard, conn)
+		_, _ = conn.Write([]byte("done"))
+	})
+	source := serveTCP(t, func(conn net.Conn) {
+		_, _ = conn.Write(make([]byte, 20<<10))
+	})
+	// send uploads n bytes from the local IP, or downloads them if n is 0, it returns how long it took.
+	send := func(t *testing.T, address string, localIP string, n int) time.Duration {
+		dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(localIP)}}
+		conn, err := dialer.Dial("tcp", address)
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+		start := time.Now()
+		if _, err := conn.Write(make([]byte, n)); err != nil {
+			t.Error(err)
+		}
+		_ = conn.(*net.TCPConn).CloseWrite()
+		if _, err := io.ReadAll(conn); err != nil {
+			t.Error(err)
+		}
+		return time.Since(start)
+	}
+	// 20 KiB at 50 KiB/s after a burst of 5 KiB take 300ms, 10 KiB take 100ms.
+	limit := RateLimitConfig{Up: RateLimit{BytesPerSecond: 50 << 10, Burst: 5 << 10}}
+	tests := []struct {
+		name    string
+		config  ForwarderConfig
+		clients []string
+		slow    bool
+	}{
+		{"tunnel", ForwarderConfig{TunnelRate: limit}, []string{"127.0.0.1"}, true},
+		{"tunnels of a client", ForwarderConfig{ClientRate: limit}, []string{"127.0.0.1", "127.0.0.1"}, true},
+		{"tunnels of two clients", ForwarderConfig{ClientRate: limit}, []string{"127.0.0.1", "127.0.0.2"}, false},
+		{"total", ForwarderConfig{TotalRate: limit}, []string{"127.0.0.1", "127.0.0.2"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address := startForwarder(t, tt.config, ForwardInputConfig{}, []*ForwardOutput{newTCPOutput(t, sink, ForwardOutputConfig{})}, nil)
+			var wg sync.WaitGroup
+			start := time.Now()
+			for _, ip := range tt.clients {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					send(t, address, ip, (20<<10)/len(tt.clients))
+				}()
+			}
+			wg.Wait()
+			if slow := time.Since(start) >= 200*time.Millisecond; slow != tt.slow {
+				t.Errorf("took %s, want slow = %v", time.Since(start), tt.slow)
 			}
 		})
 	}
+	t.Run("download", func(t *testing.T) {
+		address := startForwarder(t, ForwarderConfig{TunnelRate: RateLimitConfig{Down: limit.Up}}, ForwardInputConfig{},
+			[]*ForwardOutput{newTCPOutput(t, source, ForwardOutputConfig{})}, nil)
+		if elapsed := send(t, address, "127.0.0.1", 0); elapsed < 200*time.Millisecond {
+			t.Errorf("download took %s, want at least 200ms", elapsed)
+		}
+	})
 }
@@ -0,0 +1,189 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/doraemonkeys/monster-pipe-core/pkg/protocol"
+)
+
+type HealthCheckType int
+
+const (
+	// HealthCheckTCP only checks that a connection to the output can be established.
+	HealthCheckTCP HealthCheckType = 0
+	// HealthCheckExpect sends HealthCheckConfig.Send and expects the response to start with HealthCheckConfig.Expect.
+	HealthCheckExpect HealthCheckType = 1
+	// HealthCheckHTTP sends a GET request to HealthCheckConfig.HTTPPath and expects a 2xx or 3xx status.
+	HealthCheckHTTP HealthCheckType = 2
+)
+
+func (h HealthCheckType) String() string {
+	switch h {
+	case HealthCheckTCP:
+		return "tcp"
+	case HealthCheckExpect:
+		return "expect"
+	case HealthCheckHTTP:
+		return "http"
+	}
+	return "unknown"
+}
+
+const (
+	defaultHealthCheckInterval = 5 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+	defaultHealthCheckRise     = 2
+	defaultHealthCheckFall     = 3
+)
+
+type HealthCheckConfig struct {
+	Type HealthCheckType
+	// Interval between two probes, default 5s.
+	Interval time.Duration
+	// Timeout of a single probe, default 2s.
+	Timeout  time.Duration
+	Send     []byte
+	Expect   []byte
+	HTTPPath string
+	// Rise is the number of consecutive successful probes for an unhealthy output to become healthy, default 2.
+	Rise int
+	// Fall is the number of consecutive failed probes for a healthy output to become unhealthy, default 3.
+	Fall int
+}
+
+// validate rejects the probes that prove nothing about the output. A UDP socket "connects" without sending anything,
+// and a datagram may go unanswered even when the output is up.
+func (c *HealthCheckConfig) validate(p protocol.NetProtocol) error {
+	if c == nil || !isUDP(p) {
+		return nil
+	}
+	return fmt.Errorf("%s health check can't probe a udp output", c.Type)
+}
+
+type ForwardHealthMessage struct {
+	Output  ForwardOutputConfig
+	Healthy bool
+	Err     error
+}
+
+// Healthy reports whether the output passes its health checks, an output without health checks is always healthy.
+func (f *ForwardOutput) Healthy() bool {
+	return !f.shared.unhealthy.Load()
+}
+
+// runHealthCheck probes the output until the context is done,
+// the watcher is called every time the health state of the output changes.
+func (f *ForwardOutput) runHealthCheck(ctx context.Context, watcher func(message ForwardHealthMessage)) {
+	cfg := *f.config.HealthCheck
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultHealthCheckInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultHealthCheckTimeout
+	}
+	if cfg.Rise <= 0 {
+		cfg.Rise = defaultHealthCheckRise
+	}
+	if cfg.Fall <= 0 {
+		cfg.Fall = defaultHealthCheckFall
+	}
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	var successes, failures int
+	for {
+		probeCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+		err := f.probe(probeCtx, cfg)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			successes, failures = successes+1, 0
+			if successes >= cfg.Rise && f.shared.unhealthy.CompareAndSwap(true, false) {
+				watcher(ForwardHealthMessage{Output: f.config, Healthy: true})
+			}
+		} else {
+			successes, failures = 0, failures+1
+			if failures >= cfg.Fall && f.shared.unhealthy.CompareAndSwap(false, true) {
+				watcher(ForwardHealthMessage{Output: f.config, Healthy: false, Err: err})
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (f *ForwardOutput) probe(ctx context.Context, cfg HealthCheckConfig) error {
+	address := f.dialAddress()
+	if cfg.Type == HealthCheckHTTP {
+		return f.probeHTTP(ctx, address, cfg.HTTPPath)
+	}
+	conn, err := f.dialer(ctx, f.config.Protocol.Network(), address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if cfg.Type == HealthCheckTCP {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if len(cfg.Send) > 0 {
+		if _, err := conn.Write(cfg.Send); err != nil {
+			return err
+		}
+	}
+	if len(cfg.Expect) == 0 {
+		return nil
+	}
+	response := make([]byte, len(cfg.Expect))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return err
+	}
+	if !bytes.Equal(response, cfg.Expect) {
+		return fmt.Errorf("unexpected health check response: %q", response)
+	}
+	return nil
+}
+
+func (f *ForwardOutput) probeHTTP(ctx context.Context, address string, path string) error {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	client := http.Client{
+		Transport: &http.Transport{
+			// Dial through the output, so that the outputs behind ssh are probed from the remote side.
+			DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+				return f.dialer(ctx, f.config.Protocol.Network(), address)
+			},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+address+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected health check status: %s", resp.Status)
+	}
+	return nil
+}
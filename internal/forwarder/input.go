@@ -2,23 +2,42 @@ package forwarder
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"net"
+	"net/netip"
+	"slices"
 	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/doraemonkeys/monster-pipe-core/pkg/protocol"
-	syncgmap "github.com/doraemonkeys/sync-gmap"
+	"github.com/doraemonkeys/monster-pipe-core/pkg/protocol/secure"
+	"github.com/doraemonkeys/monster-pipe-core/pkg/protocol/tcp"
+	"github.com/doraemonkeys/monster-pipe-core/pkg/protocol/ws"
 )
 
 type ForwardInputConfig struct {
 	NetAddrConfig
-	// Blacklist and Whitelist can only exist one, the other is nil
+	// Blacklist is checked first, a connection that matches it is refused.
 	//
-	// for example, "192.0.2.1:25", "[2001:db8::1]:80" , "192.0.2.1:*"
+	// for example, "192.0.2.1:25", "[2001:db8::1]:80" , "192.0.2.1:*", "10.0.0.0/8", "192.0.2.10-192.0.2.20:8000-9000"
 	Blacklist []MatchHostConfig
-	// Blacklist and Whitelist can only exist one, the other is nil.
+	// If Whitelist is not empty, only the connections that match it are allowed.
 	//
-	// for example, "192.0.2.1:25", "[2001:db8::1]:80" , "192.0.2.1:*"
+	// for example, "192.0.2.1:25", "[2001:db8::1]:80" , "192.0.2.1:*", "2001:db8::/32"
 	Whitelist []MatchHostConfig
+	// AutoBan temporarily refuses the clients that misbehave, nil disables it.
+	// The bans are checked before the Blacklist and the Whitelist.
+	AutoBan *AutoBanConfig
+	// TLS terminates TLS on the accepted connections, nil forwards them as they are. It needs a TCP input.
+	TLS *InputTLSConfig
+	// Secure is the key exchange config of a NetProtocolSecure input.
+	Secure *secure.Config
+	// WebSocket is the path and the required headers of a ws or wss input, nil accepts any client on /.
+	WebSocket *ws.Config
+	// UDP configures the client sessions of a UDP input.
+	UDP UDPConfig
 }
 
 type NetAddrConfig struct {
@@ -30,76 +49,231 @@ type NetAddrConfig struct {
 type MatchHostConfig struct {
 	Match    string
 	AnyProto bool
+	// Protocol limits the rule to the inputs of this protocol, unless AnyProto is set.
 	Protocol protocol.NetProtocol
+	// Identity also requires the client to authenticate as a matching identity, * matches any run of characters.
+	// The rules with an Identity are decided after the handshake, see CheckIdentity.
+	Identity string
+}
+
+func (m MatchHostConfig) String() string {
+	s := m.Match
+	if !m.AnyProto {
+		s += "@" + m.Protocol.String()
+	}
+	if m.Identity != "" {
+		s += "#" + m.Identity
+	}
+	return s
 }
 
 type ForwardInput struct {
 	Config   ForwardInputConfig
 	listener func(ctx context.Context, network string, address string) (net.Listener, error)
+	acl      atomic.Pointer[accessList]
+	banner   *autoBanner
+	// compileErr is reported by Listen, NewForwardInput has no error to return.
+	compileErr error
+}
+
+// accessList is replaced as a whole, so that a connection is never checked against half of an update.
+type accessList struct {
+	blacklist       []hostMatcher
+	whitelist       []hostMatcher
+	blacklistConfig []MatchHostConfig
+	whitelistConfig []MatchHostConfig
+	hasIdentity     bool
+}
+
+func compileAccessList(blacklist, whitelist []MatchHostConfig) (*accessList, error) {
+	acl := &accessList{blacklistConfig: blacklist, whitelistConfig: whitelist}
+	var err error
+	if acl.blacklist, err = compileHostMatchers(blacklist); err != nil {
+		return nil, fmt.Errorf("blacklist: %w", err)
+	}
+	if acl.whitelist, err = compileHostMatchers(whitelist); err != nil {
+		return nil, fmt.Errorf("whitelist: %w", err)
+	}
+	hasIdentity := func(matcher hostMatcher) bool { return matcher.identity != "" }
+	acl.hasIdentity = slices.ContainsFunc(acl.blacklist, hasIdentity) || slices.ContainsFunc(acl.whitelist, hasIdentity)
+	return acl, nil
+}
+
+// allowed checks the blacklist first, then the whitelist if it is not empty.
+// Until the client is identified, the rules with an Identity only count in the whitelist, to let the client on to the handshake.
+func (a *accessList) allowed(ip netip.Addr, port int, proto protocol.NetProtocol, identity string, identified bool) bool {
+	for _, matcher := range a.blacklist {
+		if matcher.identity != "" && !identified {
+			continue
+		}
+		if matcher.match(ip, port, proto) && matcher.matchIdentity(identity) {
+			return false
+		}
+	}
+	if len(a.whitelist) == 0 {
+		return true
+	}
+	for _, matcher := range a.whitelist {
+		if matcher.match(ip, port, proto) && (!identified || matcher.matchIdentity(identity)) {
+			return true
+		}
+	}
+	return false
 }
 
 func NewForwardInput(config ForwardInputConfig, listener func(ctx context.Context, network string, address string) (net.Listener, error)) *ForwardInput {
 	if listener == nil {
-		listener = func(ctx context.Context, network string, address string) (net.Listener, error) {
-			// l := net.ListenConfig{}
-			// l.ListenPacket()
-			// return l.Listen(ctx, network, address)
-			switch network {
-			case "udp", "udp4", "udp6":
-				udpAddr, err := net.ResolveUDPAddr(network, address)
-				if err != nil {
-					return nil, err
-				}
-				udpConn, err := net.ListenUDP(network, udpAddr)
-				if err != nil {
-					return nil, err
-				}
-				return &UdpListener{listener: udpConn, dataChMap: syncgmap.NewSyncMap[string, chan []byte]()}, nil
-			default:
-				l, err := net.Listen(network, address)
-				if err != nil {
-					return nil, err
-				}
-				return l, nil
-			}
-		}
+		listener = DefaultListen
 	}
-	return &ForwardInput{
+	input := &ForwardInput{
 		Config:   config,
 		listener: listener,
+		banner:   newAutoBanner(config.AutoBan),
+	}
+	acl, err := compileAccessList(config.Blacklist, config.Whitelist)
+	if err != nil {
+		input.compileErr = err
+		acl = &accessList{}
+	}
+	input.acl.Store(acl)
+	return input
+}
+
+// DefaultListen is the listener of the inputs created without one, it listens on the local host.
+func DefaultListen(ctx context.Context, network string, address string) (net.Listener, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+		udpAddr, err := net.ResolveUDPAddr(network, address)
+		if err != nil {
+			return nil, err
+		}
+		udpConn, err := net.ListenUDP(network, udpAddr)
+		if err != nil {
+			return nil, err
+		}
+		return newUdpListener(udpConn), nil
+	default:
+		l, err := net.Listen(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+}
+
+// UpdateAccessList replaces the blacklist and the whitelist, the running tunnels are not affected.
+// The lists are left unchanged if one of the patterns is invalid.
+func (f *ForwardInput) UpdateAccessList(blacklist, whitelist []MatchHostConfig) error {
+	acl, err := compileAccessList(blacklist, whitelist)
+	if err != nil {
+		return err
 	}
+	f.acl.Store(acl)
+	return nil
+}
+
+// AccessList returns the blacklist and the whitelist in use.
+func (f *ForwardInput) AccessList() (blacklist, whitelist []MatchHostConfig) {
+	acl := f.acl.Load()
+	return acl.blacklistConfig, acl.whitelistConfig
 }
 
 // Check if the connection is allowed
 func (f *ForwardInput) CheckConn(conn net.Conn) bool {
-	if len(f.Config.Blacklist) > 0 {
-		for _, addr := range f.Config.Blacklist {
-			if matchAddress(addr.Match, conn.RemoteAddr().String()) {
-				if addr.AnyProto {
-					return false
-				} else if addr.Protocol != f.Config.Protocol {
-					return false
-				}
-			}
-		}
+	acl := f.acl.Load()
+	if len(acl.blacklist) == 0 && len(acl.whitelist) == 0 && f.banner == nil {
 		return true
 	}
-	if len(f.Config.Whitelist) > 0 {
-		for _, addr := range f.Config.Whitelist {
-			if matchAddress(addr.Match, conn.RemoteAddr().String()) {
-				if addr.AnyProto {
-					return true
-				} else if addr.Protocol == f.Config.Protocol {
-					return true
-				}
-			}
-		}
+	ip, port, ok := remoteAddrPort(conn.RemoteAddr())
+	if ok && f.banner.banned(ip) {
 		return false
 	}
-	return true
+	if !ok {
+		// An address that can't be checked only passes when there are no rules to allow it.
+		return len(acl.whitelist) == 0
+	}
+	return acl.allowed(ip, port, f.Config.Protocol, "", false)
+}
+
+// CheckIdentity checks the rules with an Identity once the client is authenticated, CheckConn only checked their addresses.
+// identity is empty for the anonymous clients.
+func (f *ForwardInput) CheckIdentity(conn net.Conn, identity string) bool {
+	acl := f.acl.Load()
+	if !acl.hasIdentity {
+		return true
+	}
+	ip, port, ok := remoteAddrPort(conn.RemoteAddr())
+	if !ok {
+		return len(acl.whitelist) == 0
+	}
+	return acl.allowed(ip, port, f.Config.Protocol, identity, true)
 }
 
 func (f *ForwardInput) Listen(ctx context.Context) (net.Listener, error) {
+	if f.compileErr != nil {
+		return nil, f.compileErr
+	}
+	if f.Config.Protocol == protocol.NetProtocolWSS && f.Config.TLS == nil {
+		return nil, fmt.Errorf("wss input needs a tls config")
+	}
+	var tlsConfig *tls.Config
+	if f.Config.TLS != nil {
+		if isUDP(f.Config.Protocol) {
+			return nil, fmt.Errorf("tls needs a tcp input")
+		}
+		var err error
+		if tlsConfig, err = f.Config.TLS.serverConfig(); err != nil {
+			return nil, err
+		}
+	}
+	listen := f.listener
+	if f.Config.Protocol == protocol.NetProtocolSecure {
+		if f.Config.Secure == nil {
+			return nil, fmt.Errorf("secure input needs a secure config")
+		}
+		listen = secure.WrapListen(listen, f.Config.Secure)
+	}
 	// fmt.Printf("f.config: %+v\n", f.config)
-	return f.listener(ctx, f.Config.Protocol.String(), f.Config.Host+":"+strconv.Itoa(f.Config.Port))
+	l, err := listen(ctx, f.Config.Protocol.Network(), f.Config.Host+":"+strconv.Itoa(f.Config.Port))
+	if err != nil {
+		return nil, err
+	}
+	if udpListener, ok := l.(*UdpListener); ok {
+		if err := udpListener.configure(f.Config.UDP); err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+	}
+	// The handshakes run in the tunnel goroutine, see MonsterPipeCoreForwarder.handleConn.
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	switch {
+	case f.Config.Protocol.IsWebSocket():
+		// The upgrade request of wss is read from the TLS connection.
+		l = ws.NewListener(l, f.Config.WebSocket)
+	case f.Config.Protocol == protocol.NetProtocolFramed:
+		l = tcp.NewListener(l)
+	}
+	return l, nil
+}
+
+// recordBanEvent counts the event of the client, the returned ban is non-nil if the client just got banned.
+func (f *ForwardInput) recordBanEvent(addr net.Addr, event banEventType) *Ban {
+	if f.banner == nil {
+		return nil
+	}
+	ip, _, ok := remoteAddrPort(addr)
+	if !ok {
+		return nil
+	}
+	return f.banner.record(ip, event)
+}
+
+// recordTunnelClosed counts the tunnel of the client if it was short lived.
+func (f *ForwardInput) recordTunnelClosed(addr net.Addr, lifetime time.Duration) *Ban {
+	if f.banner == nil || lifetime >= f.banner.config.ShortTunnel {
+		return nil
+	}
+	return f.recordBanEvent(addr, banEventShortTunnel)
 }
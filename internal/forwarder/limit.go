@@ -0,0 +1,109 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrConnLimit = errors.New("connection limit reached")
+
+type ConnLimitAction int
+
+const (
+	// ConnLimitReject closes the connections over the limit right away.
+	ConnLimitReject ConnLimitAction = 0
+	// ConnLimitQueue holds the connections over the limit until a tunnel finishes or the ConnQueueTimeout expires.
+	ConnLimitQueue ConnLimitAction = 1
+)
+
+func (a ConnLimitAction) String() string {
+	switch a {
+	case ConnLimitReject:
+		return "reject"
+	case ConnLimitQueue:
+		return "queue"
+	}
+	return "unknown"
+}
+
+func ParseConnLimitAction(action string) (ConnLimitAction, error) {
+	switch strings.ToLower(action) {
+	case "", "reject":
+		return ConnLimitReject, nil
+	case "queue":
+		return ConnLimitQueue, nil
+	}
+	return ConnLimitReject, fmt.Errorf("invalid connection limit action: %s", action)
+}
+
+// tryAcquireConn registers a tunnel of the client if the limits allow it.
+// connectedClients holds the number of tunnels of each client IP.
+func (f *MonsterPipeCoreForwarder) tryAcquireConn(ip string) error {
+	f.clientsMu.Lock()
+	defer f.clientsMu.Unlock()
+	if f.config.MaxConns > 0 && f.totalConns >= f.config.MaxConns {
+		return fmt.Errorf("%w: %d tunnels", ErrConnLimit, f.totalConns)
+	}
+	conns, _ := f.connectedClients.Load(ip)
+	if f.config.MaxConnsPerIP > 0 && conns >= f.config.MaxConnsPerIP {
+		return fmt.Errorf("%w: %d tunnels from %s", ErrConnLimit, conns, ip)
+	}
+	f.totalConns++
+	f.connectedClients.Store(ip, conns+1)
+	return nil
+}
+
+// acquireConn waits for a free slot when the action is ConnLimitQueue.
+func (f *MonsterPipeCoreForwarder) acquireConn(ctx context.Context, ip string) error {
+	var timeout <-chan time.Time
+	if f.config.ConnLimitAction == ConnLimitQueue && f.config.ConnQueueTimeout > 0 {
+		timer := time.NewTimer(f.config.ConnQueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		f.clientsMu.Lock()
+		released := f.connReleased
+		f.clientsMu.Unlock()
+		err := f.tryAcquireConn(ip)
+		if err == nil || f.config.ConnLimitAction != ConnLimitQueue {
+			return err
+		}
+		select {
+		case <-released:
+		case <-timeout:
+			return fmt.Errorf("queued for %s: %w", f.config.ConnQueueTimeout, err)
+		case <-f.drainCh:
+			return err
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func (f *MonsterPipeCoreForwarder) releaseConn(ip string) {
+	f.clientsMu.Lock()
+	defer f.clientsMu.Unlock()
+	f.totalConns--
+	if conns, _ := f.connectedClients.Load(ip); conns > 1 {
+		f.connectedClients.Store(ip, conns-1)
+	} else {
+		f.connectedClients.Delete(ip)
+	}
+	// Wake up the queued connections.
+	close(f.connReleased)
+	f.connReleased = make(chan struct{})
+}
+
+// ConnectedClients returns the number of tunnels of each client IP.
+func (f *MonsterPipeCoreForwarder) ConnectedClients() map[string]int {
+	clients := make(map[string]int)
+	f.connectedClients.Range(func(ip string, conns int) bool {
+		clients[ip] = conns
+		return true
+	})
+	return clients
+}
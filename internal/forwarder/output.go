@@ -2,52 +2,191 @@ package forwarder
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
+	"github.com/doraemonkeys/monster-pipe-core/pkg/protocol"
+	"github.com/doraemonkeys/monster-pipe-core/pkg/protocol/secure"
+	"github.com/doraemonkeys/monster-pipe-core/pkg/protocol/tcp"
+	"github.com/doraemonkeys/monster-pipe-core/pkg/protocol/ws"
 	"golang.org/x/sync/singleflight"
 )
 
 type ForwardOutputConfig struct {
 	Readable bool
 	Writable bool
+	// Role decides whether the responses of the output are sent back to the input.
+	Role ForwardOutputRole
+	// WriteQueueSize is the number of chunks that can be queued for the output in a multi-output tunnel.
+	WriteQueueSize int
+	// OverflowPolicy decides what happens when the write queue of the output is full.
+	OverflowPolicy ForwardOutputOverflowPolicy
+	// Weight of the output in the weighted, least-conn and hash modes, 0 is the same as 1.
+	Weight int
+	// Backup outputs only get connections when none of the other outputs is healthy.
+	Backup bool
+	// HealthCheck enables the periodic probes of the output, nil disables them. A UDP output can't be probed.
+	HealthCheck *HealthCheckConfig
+	// Dial controls the timeout, retries and circuit breaker used to connect to the output.
+	Dial ForwardOutputDialConfig
+	// TLS dials the output with TLS, nil dials it as it is. It needs a TCP output.
+	TLS *OutputTLSConfig
+	// Secure is the key exchange config of a NetProtocolSecure output.
+	Secure *secure.Config
+	// WebSocket is the path and the headers of the upgrade request of a ws or wss output, nil requests /.
+	WebSocket *ws.Config
 	NetAddrConfig
 }
 
+type ForwardOutputRole int
+
+const (
+	// ForwardOutputRoleNormal replies to the input as long as the output is readable.
+	ForwardOutputRoleNormal ForwardOutputRole = 0
+	// ForwardOutputRolePrimary is the only output whose responses go back to the input,
+	// other outputs of the tunnel are treated as shadows.
+	ForwardOutputRolePrimary ForwardOutputRole = 1
+	// ForwardOutputRoleShadow receives the same data as the other outputs,
+	// but its responses are drained and discarded.
+	ForwardOutputRoleShadow ForwardOutputRole = 2
+)
+
+func (r ForwardOutputRole) String() string {
+	switch r {
+	case ForwardOutputRoleNormal:
+		return "normal"
+	case ForwardOutputRolePrimary:
+		return "primary"
+	case ForwardOutputRoleShadow:
+		return "shadow"
+	}
+	return "unknown"
+}
+
+func ParseForwardOutputRole(role string) (ForwardOutputRole, error) {
+	switch strings.ToLower(role) {
+	case "", "normal":
+		return ForwardOutputRoleNormal, nil
+	case "primary":
+		return ForwardOutputRolePrimary, nil
+	case "shadow":
+		return ForwardOutputRoleShadow, nil
+	}
+	return ForwardOutputRoleNormal, fmt.Errorf("invalid output role: %s", role)
+}
+
 func (f ForwardOutputConfig) Target() string {
 	return f.Host + ":" + strconv.Itoa(f.Port)
 }
 
 type ForwardOutput struct {
 	config              ForwardOutputConfig
+	connMu              sync.RWMutex
 	conn                net.Conn
+	closed              bool
+	dialErr             error
 	connectSingleflight singleflight.Group
 	dialer              func(ctx context.Context, network string, address string) (net.Conn, error)
+	dialWatcher         func(message ForwardConnMessage)
+	// shared is the state shared by the output and all its copies.
+	shared *forwardOutputShared
+}
+
+type forwardOutputShared struct {
+	activeConns atomic.Int64
+	unhealthy   atomic.Bool
+	breaker     circuitBreaker
 }
 
+// errOutputDial wraps the dial errors returned by the reads and the writes of an output.
+var errOutputDial = errors.New("dail output error")
+
 func NewForwardOutput(config ForwardOutputConfig, dialer func(ctx context.Context, network string, address string) (net.Conn, error)) *ForwardOutput {
 	if dialer == nil {
-		dialer = func(ctx context.Context, network string, address string) (net.Conn, error) {
-			d := net.Dialer{}
-			return d.DialContext(ctx, network, address)
-		}
+		dialer = DefaultDial
+	}
+	if config.Protocol == protocol.NetProtocolSecure {
+		dialer = wrapSecureDial(dialer, config.Secure)
+	}
+	tlsConfig := config.TLS
+	if config.Protocol == protocol.NetProtocolWSS && tlsConfig == nil {
+		tlsConfig = &OutputTLSConfig{}
+	}
+	if tlsConfig != nil {
+		dialer = tlsConfig.wrapDial(dialer, config.Host)
+	}
+	switch {
+	case config.Protocol.IsWebSocket():
+		dialer = ws.WrapDial(dialer, config.WebSocket)
+	case config.Protocol == protocol.NetProtocolFramed:
+		dialer = tcp.WrapDial(dialer)
 	}
 	return &ForwardOutput{
-		config: config,
-		dialer: dialer,
+		config:      config,
+		dialer:      dialer,
+		dialWatcher: func(ForwardConnMessage) {},
+		shared:      &forwardOutputShared{},
+	}
+}
+
+func wrapSecureDial(dial func(ctx context.Context, network string, address string) (net.Conn, error), config *secure.Config) func(ctx context.Context, network string, address string) (net.Conn, error) {
+	if config == nil {
+		return func(context.Context, string, string) (net.Conn, error) {
+			return nil, fmt.Errorf("secure output needs a secure config")
+		}
 	}
+	return secure.WrapDial(dial, config)
+}
+
+// DefaultDial is the dialer of the outputs created without one.
+func DefaultDial(ctx context.Context, network string, address string) (net.Conn, error) {
+	d := net.Dialer{}
+	return d.DialContext(ctx, network, address)
 }
 
 func (f *ForwardOutput) GetConfig() ForwardOutputConfig {
 	return f.config
 }
 
+func (f *ForwardOutput) weight() int {
+	if f.config.Weight <= 0 {
+		return 1
+	}
+	return f.config.Weight
+}
+
+// ActiveConns returns the number of tunnels currently using the output.
+func (f *ForwardOutput) ActiveConns() int64 {
+	return f.shared.activeConns.Load()
+}
+
+// available reports whether new connections can be forwarded to the output.
+func (f *ForwardOutput) available() bool {
+	return f.Healthy() && !f.CircuitOpen()
+}
+
+// replyToInput reports whether the data read from the output should be written back to the input.
+func (f *ForwardOutput) replyToInput(tunnelHasPrimary bool) bool {
+	if !f.config.Readable {
+		return false
+	}
+	if tunnelHasPrimary {
+		return f.config.Role == ForwardOutputRolePrimary
+	}
+	return f.config.Role != ForwardOutputRoleShadow
+}
+
 func (f *ForwardOutput) Copy() *ForwardOutput {
 	var newOutput ForwardOutput
 	newOutput.config = f.config
 	newOutput.dialer = f.dialer
+	newOutput.dialWatcher = f.dialWatcher
+	newOutput.shared = f.shared
 	return &newOutput
 }
 
@@ -55,12 +194,11 @@ func (f *ForwardOutput) Write(ctx context.Context, buf []byte) (int, error) {
 	if !f.config.Writable {
 		return 0, nil
 	}
-	if f.conn == nil {
-		if err := f.Dial(ctx); err != nil {
-			return 0, fmt.Errorf("dail output error: %w", err)
-		}
+	conn, err := f.getOrDial(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", errOutputDial, err)
 	}
-	n, err := f.conn.Write(buf)
+	n, err := conn.Write(buf)
 	if err != nil {
 		// f.conn = nil
 		return 0, fmt.Errorf("write to output error: %w", err)
@@ -69,12 +207,11 @@ func (f *ForwardOutput) Write(ctx context.Context, buf []byte) (int, error) {
 }
 
 func (f *ForwardOutput) Read(ctx context.Context, buf []byte) (int, error) {
-	if f.conn == nil {
-		if err := f.Dial(ctx); err != nil {
-			return 0, fmt.Errorf("dail output error: %w", err)
-		}
+	conn, err := f.getOrDial(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", errOutputDial, err)
 	}
-	n, err := f.conn.Read(buf)
+	n, err := conn.Read(buf)
 	if err != nil {
 		// f.conn = nil
 		return 0, fmt.Errorf("read from output error: %w", err)
@@ -83,40 +220,88 @@ func (f *ForwardOutput) Read(ctx context.Context, buf []byte) (int, error) {
 }
 
 func (f *ForwardOutput) Close() error {
+	f.connMu.Lock()
+	defer f.connMu.Unlock()
+	f.closed = true
 	if f.conn == nil {
 		return nil
 	}
 	return f.conn.Close()
 }
 
+// CloseWrite shuts down the writing side of the output connection, if it is connected.
+func (f *ForwardOutput) CloseWrite() error {
+	conn := f.getConn()
+	if conn == nil {
+		return nil
+	}
+	return closeWrite(conn)
+}
+
+func (f *ForwardOutput) getConn() net.Conn {
+	f.connMu.RLock()
+	defer f.connMu.RUnlock()
+	return f.conn
+}
+
+func (f *ForwardOutput) getOrDial(ctx context.Context) (net.Conn, error) {
+	if conn := f.getConn(); conn != nil {
+		return conn, nil
+	}
+	if err := f.Dial(ctx); err != nil {
+		return nil, err
+	}
+	return f.getConn(), nil
+}
+
+// Dial connects the output, once a dial has failed the following calls return the same error.
 func (f *ForwardOutput) Dial(ctx context.Context) error {
 	_, err, _ := f.connectSingleflight.Do("", func() (interface{}, error) {
-		host := f.config.Host
-		if len(host) == 0 {
-			host = "127.0.0.1"
+		f.connMu.RLock()
+		conn, dialErr := f.conn, f.dialErr
+		f.connMu.RUnlock()
+		if conn != nil || dialErr != nil {
+			return nil, dialErr
 		}
-		conn, err := f.dialer(ctx, string(f.config.Protocol), host+":"+strconv.Itoa(f.config.Port))
+		conn, err := f.dialWithPolicy(ctx)
+		f.connMu.Lock()
+		defer f.connMu.Unlock()
 		if err != nil {
+			f.dialErr = err
 			return nil, err
 		}
+		if f.closed {
+			_ = conn.Close()
+			return nil, net.ErrClosed
+		}
 		f.conn = conn
 		return nil, nil
 	})
 	return err
 }
 
+func (f *ForwardOutput) dialAddress() string {
+	host := f.config.Host
+	if len(host) == 0 {
+		host = "127.0.0.1"
+	}
+	return host + ":" + strconv.Itoa(f.config.Port)
+}
+
 func (f *ForwardOutput) Target() string {
-	if f.conn == nil {
+	conn := f.getConn()
+	if conn == nil {
 		return f.config.Host + ":" + strconv.Itoa(f.config.Port)
 	}
-	return f.conn.RemoteAddr().String()
+	return conn.RemoteAddr().String()
 }
 
 func (f *ForwardOutput) ConnAddr() net.Addr {
-	if f.conn == nil {
+	conn := f.getConn()
+	if conn == nil {
 		return nil
 	}
-	addr := f.conn.RemoteAddr()
+	addr := conn.RemoteAddr()
 	addrString := addr.String()
 	if strings.HasSuffix(addrString, ":0") {
 		return nil
@@ -0,0 +1,138 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	defaultBufferSize = 32 * 1024
+	// A UDP datagram must fit in a single buffer, otherwise it is split or truncated.
+	udpBufferSize = 64 * 1024
+)
+
+var ErrMemoryBudgetExceeded = errors.New("memory budget exceeded")
+
+type MemoryBudgetAction int
+
+const (
+	// MemoryBudgetBackpressure makes the tunnels wait for a buffer when the budget is exhausted.
+	MemoryBudgetBackpressure MemoryBudgetAction = 0
+	// MemoryBudgetReject refuses the new connections when the budget is exhausted,
+	// the running tunnels still wait for a buffer.
+	MemoryBudgetReject MemoryBudgetAction = 1
+)
+
+func (a MemoryBudgetAction) String() string {
+	switch a {
+	case MemoryBudgetBackpressure:
+		return "backpressure"
+	case MemoryBudgetReject:
+		return "reject"
+	}
+	return "unknown"
+}
+
+func ParseMemoryBudgetAction(action string) (MemoryBudgetAction, error) {
+	switch strings.ToLower(action) {
+	case "", "backpressure":
+		return MemoryBudgetBackpressure, nil
+	case "reject":
+		return MemoryBudgetReject, nil
+	}
+	return MemoryBudgetBackpressure, fmt.Errorf("invalid memory budget action: %s", action)
+}
+
+// bufferPool hands out fixed size buffers, the bytes of the buffers in use never exceed the budget.
+type bufferPool struct {
+	size   int
+	budget int64
+	pool   sync.Pool
+	used   atomic.Int64
+
+	mu       sync.Mutex
+	waiting  bool
+	released chan struct{}
+}
+
+// A budget of 0 means no limit.
+func newBufferPool(size int, budget int64) *bufferPool {
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+	p := &bufferPool{
+		size:     size,
+		budget:   budget,
+		released: make(chan struct{}),
+	}
+	p.pool.New = func() any {
+		buf := make([]byte, p.size)
+		return &buf
+	}
+	return p
+}
+
+var defaultBufferPool = newBufferPool(defaultBufferSize, 0)
+
+// get waits until the budget allows one more buffer, or done is closed.
+func (p *bufferPool) get(ctx context.Context, done <-chan struct{}) ([]byte, error) {
+	for {
+		p.mu.Lock()
+		if p.budget <= 0 || p.used.Load()+int64(p.size) <= p.budget {
+			p.used.Add(int64(p.size))
+			p.mu.Unlock()
+			return *p.pool.Get().(*[]byte), nil
+		}
+		p.waiting = true
+		released := p.released
+		p.mu.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-done:
+			return nil, net.ErrClosed
+		}
+	}
+}
+
+// put releases the budget of a buffer from get, a buffer too small to be reused is left to the GC.
+func (p *bufferPool) put(buf []byte) {
+	if cap(buf) >= p.size {
+		buf = buf[:p.size]
+		p.pool.Put(&buf)
+	}
+	p.mu.Lock()
+	p.used.Add(-int64(p.size))
+	if p.waiting {
+		p.waiting = false
+		close(p.released)
+		p.released = make(chan struct{})
+	}
+	p.mu.Unlock()
+}
+
+// available reports whether n more buffers fit in the budget right now.
+func (p *bufferPool) available(n int) bool {
+	return p.budget <= 0 || p.used.Load()+int64(n*p.size) <= p.budget
+}
+
+// chunk is a buffer shared by the writers of a multi-output tunnel,
+// it goes back to the pool when the last writer releases it.
+type chunk struct {
+	buf  []byte
+	data []byte
+	refs atomic.Int32
+	pool *bufferPool
+}
+
+func (c *chunk) release() {
+	if c.refs.Add(-1) == 0 {
+		c.pool.put(c.buf)
+	}
+}
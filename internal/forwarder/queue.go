@@ -0,0 +1,206 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+const defaultWriteQueueSize = 64
+
+type ForwardOutputOverflowPolicy int
+
+const (
+	// ForwardOutputOverflowDefault blocks for the primary and normal outputs, and drops the newest chunk for the shadows.
+	ForwardOutputOverflowDefault ForwardOutputOverflowPolicy = 0
+	// ForwardOutputOverflowBlock waits until the output has room for the chunk, the whole tunnel is slowed down.
+	ForwardOutputOverflowBlock ForwardOutputOverflowPolicy = 1
+	// ForwardOutputOverflowDropNewest discards the chunk that does not fit in the queue.
+	ForwardOutputOverflowDropNewest ForwardOutputOverflowPolicy = 2
+	// ForwardOutputOverflowDropOldest discards the oldest queued chunk to make room for the new one.
+	ForwardOutputOverflowDropOldest ForwardOutputOverflowPolicy = 3
+	// ForwardOutputOverflowDisconnect closes the output, the rest of the tunnel keeps running.
+	ForwardOutputOverflowDisconnect ForwardOutputOverflowPolicy = 4
+)
+
+func (p ForwardOutputOverflowPolicy) String() string {
+	switch p {
+	case ForwardOutputOverflowDefault:
+		return "default"
+	case ForwardOutputOverflowBlock:
+		return "block"
+	case ForwardOutputOverflowDropNewest:
+		return "drop-newest"
+	case ForwardOutputOverflowDropOldest:
+		return "drop-oldest"
+	case ForwardOutputOverflowDisconnect:
+		return "disconnect"
+	}
+	return "unknown"
+}
+
+func ParseForwardOutputOverflowPolicy(policy string) (ForwardOutputOverflowPolicy, error) {
+	switch strings.ToLower(policy) {
+	case "", "default":
+		return ForwardOutputOverflowDefault, nil
+	case "block":
+		return ForwardOutputOverflowBlock, nil
+	case "drop-newest", "drop":
+		return ForwardOutputOverflowDropNewest, nil
+	case "drop-oldest":
+		return ForwardOutputOverflowDropOldest, nil
+	case "disconnect":
+		return ForwardOutputOverflowDisconnect, nil
+	}
+	return ForwardOutputOverflowDefault, fmt.Errorf("invalid overflow policy: %s", policy)
+}
+
+// outputWriter owns the write side of an output in a multi-output tunnel,
+// so that a slow output only fills its own queue instead of stalling the others.
+type outputWriter struct {
+	tunnel       *MonsterPipeCoreForwardTunnel
+	output       *ForwardOutput
+	policy       ForwardOutputOverflowPolicy
+	queue        chan *chunk
+	disconnected atomic.Bool
+	// dropCount is the number of chunks discarded by the overflow policy.
+	dropCount atomic.Int64
+	// closeWritten is closed once the half-close queued by enqueueCloseWrite is done.
+	closeWritten chan struct{}
+}
+
+func newOutputWriter(tunnel *MonsterPipeCoreForwardTunnel, output *ForwardOutput) *outputWriter {
+	size := output.config.WriteQueueSize
+	if size <= 0 {
+		size = defaultWriteQueueSize
+	}
+	policy := output.config.OverflowPolicy
+	if policy == ForwardOutputOverflowDefault {
+		policy = ForwardOutputOverflowBlock
+		if output.config.Role == ForwardOutputRoleShadow {
+			policy = ForwardOutputOverflowDropNewest
+		}
+	}
+	return &outputWriter{
+		tunnel:       tunnel,
+		output:       output,
+		policy:       policy,
+		queue:        make(chan *chunk, size),
+		closeWritten: make(chan struct{}),
+	}
+}
+
+// enqueue hands the chunk to the writer goroutine, the writer releases it once written or dropped.
+func (w *outputWriter) enqueue(ctx context.Context, c *chunk) {
+	if w.disconnected.Load() {
+		c.release()
+		return
+	}
+	select {
+	case w.queue <- c:
+		return
+	default:
+	}
+	switch w.policy {
+	case ForwardOutputOverflowBlock:
+		select {
+		case w.queue <- c:
+		case <-ctx.Done():
+			c.release()
+		case <-w.tunnel.closeCh:
+			c.release()
+		}
+	case ForwardOutputOverflowDropNewest:
+		w.dropped(c)
+	case ForwardOutputOverflowDropOldest:
+		for {
+			select {
+			case w.queue <- c:
+				return
+			default:
+			}
+			select {
+			case oldest := <-w.queue:
+				w.dropped(oldest)
+			default:
+			}
+		}
+	case ForwardOutputOverflowDisconnect:
+		c.release()
+		if w.disconnected.Swap(true) {
+			return
+		}
+		w.tunnel.tunnelWatcher(ForwardConnMessage{
+			MessageType: ForwardConnMsgTypeOutputQueueDisconnect,
+			Err:         fmt.Errorf("write queue of output is full"),
+			Output:      w.output.config,
+			OutputAddr:  w.output.ConnAddr(),
+		})
+		_ = w.output.Close()
+	}
+}
+
+// dropped reports the size of the discarded chunk, never its data: the message is sent even if ConnEventsOnly is set.
+func (w *outputWriter) dropped(c *chunk) {
+	size := len(c.data)
+	c.release()
+	w.tunnel.tunnelWatcher(ForwardConnMessage{
+		MessageType:  ForwardConnMsgTypeOutputQueueDropped,
+		Output:       w.output.config,
+		OutputAddr:   w.output.ConnAddr(),
+		Dropped:      w.dropCount.Add(1),
+		DroppedBytes: size,
+	})
+}
+
+// enqueueCloseWrite queues the half-close of the output behind the chunks that are already queued.
+func (w *outputWriter) enqueueCloseWrite() {
+	select {
+	case w.queue <- nil:
+	case <-w.tunnel.closeCh:
+	}
+}
+
+// waitCloseWrite waits until the chunks queued before enqueueCloseWrite and the half-close are written.
+func (w *outputWriter) waitCloseWrite(ctx context.Context) {
+	select {
+	case <-w.closeWritten:
+	case <-w.tunnel.closeCh:
+	case <-ctx.Done():
+	}
+}
+
+// run writes the queued chunks to the output until the tunnel is closed.
+func (w *outputWriter) run(ctx context.Context) {
+	for {
+		select {
+		case c := <-w.queue:
+			if c == nil {
+				_ = w.output.CloseWrite()
+				close(w.closeWritten)
+				continue
+			}
+			if !w.disconnected.Load() {
+				w.tunnel.writeToOutput(ctx, w.output, c.data)
+			}
+			c.release()
+		case <-w.tunnel.closeCh:
+			return
+		}
+	}
+}
+
+// drain releases the chunks left in the queue.
+func (w *outputWriter) drain() {
+	for {
+		select {
+		case c := <-w.queue:
+			if c != nil {
+				c.release()
+			}
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrQuotaExceeded = errors.New("traffic quota exceeded")
+
+const (
+	defaultQuotaPeriod       = 24 * time.Hour
+	defaultQuotaSaveInterval = 30 * time.Second
+)
+
+// QuotaStore persists the quota usage across restarts, config.StateFile implements it.
+type QuotaStore interface {
+	Load(v any) error
+	Save(v any) error
+}
+
+type QuotaConfig struct {
+	// Bytes is the traffic allowed to a client in each period, both directions count. 0 disables the quotas.
+	// A client that authenticated is counted by its identity, as "#identity", the others by their IP.
+	Bytes int64
+	// Period is the length of a quota window, default 24h. A window starts with the first byte of the client.
+	Period time.Duration
+	// Store persists the usage, nil keeps it in memory only.
+	Store QuotaStore
+	// SaveInterval is how often the usage is written to the store, default 30s.
+	SaveInterval time.Duration
+}
+
+type QuotaUsage struct {
+	Bytes       int64     `json:"bytes"`
+	PeriodStart time.Time `json:"period_start"`
+}
+
+// quotaTracker counts the traffic of each client from the chunk events of the tunnels.
+type quotaTracker struct {
+	config QuotaConfig
+	mu     sync.Mutex
+	usage  map[string]*QuotaUsage
+	dirty  bool
+}
+
+func newQuotaTracker(config QuotaConfig) *quotaTracker {
+	if config.Bytes <= 0 {
+		return nil
+	}
+	if config.Period <= 0 {
+		config.Period = defaultQuotaPeriod
+	}
+	if config.SaveInterval <= 0 {
+		config.SaveInterval = defaultQuotaSaveInterval
+	}
+	return &quotaTracker{config: config, usage: make(map[string]*QuotaUsage)}
+}
+
+func (q *quotaTracker) load() error {
+	if q.config.Store == nil {
+		return nil
+	}
+	usage := make(map[string]*QuotaUsage)
+	if err := q.config.Store.Load(&usage); err != nil {
+		return fmt.Errorf("load quota state: %w", err)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for client, u := range usage {
+		if u != nil {
+			q.usage[client] = u
+		}
+	}
+	return nil
+}
+
+func (q *quotaTracker) save() error {
+	if q.config.Store == nil {
+		return nil
+	}
+	q.mu.Lock()
+	if !q.dirty {
+		q.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	usage := make(map[string]QuotaUsage, len(q.usage))
+	for client, u := range q.usage {
+		// The expired windows are not worth keeping.
+		if now.Sub(u.PeriodStart) < q.config.Period {
+			usage[client] = *u
+		}
+	}
+	q.dirty = false
+	q.mu.Unlock()
+	if err := q.config.Store.Save(usage); err != nil {
+		q.mu.Lock()
+		q.dirty = true
+		q.mu.Unlock()
+		return fmt.Errorf("save quota state: %w", err)
+	}
+	return nil
+}
+
+// quotaKey returns the client a tunnel is counted for, the # keeps an identity apart from an IP.
+func quotaKey(ip string, identity string) string {
+	if identity != "" {
+		return "#" + identity
+	}
+	return ip
+}
+
+// prune forgets the clients whose window is over, a check or a new byte starts a new one.
+func (q *quotaTracker) prune() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	for client, u := range q.usage {
+		if now.Sub(u.PeriodStart) >= q.config.Period {
+			delete(q.usage, client)
+		}
+	}
+}
+
+// current returns the usage of the client in the current window, the caller holds the lock.
+func (q *quotaTracker) current(client string) *QuotaUsage {
+	now := time.Now()
+	u, ok := q.usage[client]
+	if !ok || now.Sub(u.PeriodStart) >= q.config.Period {
+		u = &QuotaUsage{PeriodStart: now}
+		q.usage[client] = u
+	}
+	return u
+}
+
+func (q *quotaTracker) check(client string) error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// The check creates no entry, only the traffic does, so that the clients that never send anything take no memory.
+	u, ok := q.usage[client]
+	if !ok || time.Since(u.PeriodStart) >= q.config.Period {
+		return nil
+	}
+	if u.Bytes >= q.config.Bytes {
+		return fmt.Errorf("%w: %d of %d bytes used since %s", ErrQuotaExceeded, u.Bytes, q.config.Bytes, u.PeriodStart.Format(time.DateTime))
+	}
+	return nil
+}
+
+func (q *quotaTracker) add(client string, n int) {
+	if q == nil || n <= 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.current(client).Bytes += int64(n)
+	q.dirty = true
+}
+
+// observe counts the bytes read from the client and the bytes written back to it.
+func (q *quotaTracker) observe(client string) func(message ForwardConnMessage) {
+	return func(message ForwardConnMessage) {
+		switch message.MessageType {
+		case ForwardConnMsgTypeInputRead, ForwardConnMsgTypeWriteToInputOK:
+			q.add(client, len(message.Data))
+		}
+	}
+}
+
+// run prunes and saves the usage every SaveInterval until the context is done.
+func (q *quotaTracker) run(ctx context.Context, errWatcher func(error)) {
+	ticker := time.NewTicker(q.config.SaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			q.prune()
+			if err := q.save(); err != nil {
+				errWatcher(err)
+			}
+		}
+	}
+}
+
+// QuotaUsage returns the usage of the clients in their current window, keyed by IP or by "#identity".
+func (f *MonsterPipeCoreForwarder) QuotaUsage() map[string]QuotaUsage {
+	usage := make(map[string]QuotaUsage)
+	if f.quota == nil {
+		return usage
+	}
+	f.quota.mu.Lock()
+	defer f.quota.mu.Unlock()
+	now := time.Now()
+	for client, u := range f.quota.usage {
+		if now.Sub(u.PeriodStart) < f.quota.config.Period {
+			usage[client] = *u
+		}
+	}
+	return usage
+}
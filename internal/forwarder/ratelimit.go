@@ -0,0 +1,138 @@
+package forwarder
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+type RateLimit struct {
+	// BytesPerSecond is the sustained rate, 0 means no limit.
+	BytesPerSecond int64
+	// Burst is the number of bytes that can be sent at once after an idle period, default one second of BytesPerSecond.
+	Burst int64
+}
+
+// RateLimitConfig limits the upstream (input to outputs) and the downstream (outputs to input) separately.
+type RateLimitConfig struct {
+	Up   RateLimit
+	Down RateLimit
+}
+
+func (r RateLimitConfig) enabled() bool {
+	return r.Up.BytesPerSecond > 0 || r.Down.BytesPerSecond > 0
+}
+
+// tokenBucket is a token bucket that lets a read go into debt:
+// the reader is delayed until the bucket is back to zero, so chunks bigger than the burst still pass.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns nil if the limit is disabled, a nil bucket never waits.
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	if limit.BytesPerSecond <= 0 {
+		return nil
+	}
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = limit.BytesPerSecond
+	}
+	return &tokenBucket{
+		rate:   float64(limit.BytesPerSecond),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n bytes from the bucket and returns how long the caller must wait before using them.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// waitBuckets waits until all the buckets allow n more bytes, or the tunnel is closed.
+func waitBuckets(ctx context.Context, done <-chan struct{}, buckets []*tokenBucket, n int) error {
+	var delay time.Duration
+	for _, bucket := range buckets {
+		if bucket != nil {
+			delay = max(delay, bucket.reserve(n))
+		}
+	}
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return net.ErrClosed
+	}
+}
+
+// rateBuckets are the buckets of one scope.
+type rateBuckets struct {
+	up   *tokenBucket
+	down *tokenBucket
+}
+
+func newRateBuckets(config RateLimitConfig) *rateBuckets {
+	if !config.enabled() {
+		return nil
+	}
+	return &rateBuckets{up: newTokenBucket(config.Up), down: newTokenBucket(config.Down)}
+}
+
+// clientRate holds the buckets of a client IP while it has tunnels.
+type clientRate struct {
+	buckets *rateBuckets
+	refs    int
+}
+
+func (f *MonsterPipeCoreForwarder) acquireClientRate(ip string) *rateBuckets {
+	if !f.config.ClientRate.enabled() {
+		return nil
+	}
+	f.clientsMu.Lock()
+	defer f.clientsMu.Unlock()
+	rate, ok := f.clientRates[ip]
+	if !ok {
+		rate = &clientRate{buckets: newRateBuckets(f.config.ClientRate)}
+		f.clientRates[ip] = rate
+	}
+	rate.refs++
+	return rate.buckets
+}
+
+func (f *MonsterPipeCoreForwarder) releaseClientRate(ip string) {
+	if !f.config.ClientRate.enabled() {
+		return
+	}
+	f.clientsMu.Lock()
+	defer f.clientsMu.Unlock()
+	if rate, ok := f.clientRates[ip]; ok {
+		rate.refs--
+		if rate.refs <= 0 {
+			delete(f.clientRates, ip)
+		}
+	}
+}
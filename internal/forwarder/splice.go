@@ -0,0 +1,84 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// spliceOutput returns the output and its connection if the tunnel can be copied with splice:
+// a single TCP output that replies to a TCP input.
+// The output is dialed here, if it fails the normal path reports the error.
+func (m *MonsterPipeCoreForwardTunnel) spliceOutput(ctx context.Context) (*ForwardOutput, *net.TCPConn) {
+	if len(m.outputs) != 1 {
+		return nil, nil
+	}
+	output := m.outputs[0]
+	if !output.config.Writable || !output.replyToInput(false) {
+		return nil, nil
+	}
+	if _, ok := m.input.(*net.TCPConn); !ok {
+		return nil, nil
+	}
+	conn, err := output.getOrDial(ctx)
+	if err != nil {
+		return nil, nil
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, nil
+	}
+	return output, tcpConn
+}
+
+// runSplice copies the data in both directions with io.Copy,
+// which lets (*net.TCPConn).ReadFrom use splice on linux. It returns true if the tunnel was closed by the output.
+//
+// The EOF of one side is propagated with CloseWrite, the tunnel is closed once both directions are finished.
+func (m *MonsterPipeCoreForwardTunnel) runSplice(output *ForwardOutput, outputConn *net.TCPConn) bool {
+	var closedByOutput, upstreamDone atomic.Bool
+	downstreamDone := make(chan struct{})
+	go func() {
+		defer close(downstreamDone)
+		n, err := io.Copy(m.input, outputConn)
+		m.outputBytes.Add(n)
+		if m.closed.Load() {
+			return
+		}
+		if !upstreamDone.Load() {
+			closedByOutput.Store(true)
+		}
+		if err == nil {
+			_ = closeWrite(m.input)
+			return
+		}
+		if !errors.Is(err, net.ErrClosed) {
+			m.tunnelWatcher(ForwardConnMessage{
+				MessageType: ForwardConnMsgTypeOutputReadError,
+				Err:         err,
+				Output:      output.config,
+				OutputAddr:  output.ConnAddr(),
+			})
+		}
+		_ = m.Close()
+	}()
+	n, err := io.Copy(outputConn, m.input)
+	m.inputBytes.Add(n)
+	upstreamDone.Store(true)
+	if err == nil {
+		_ = outputConn.CloseWrite()
+	} else {
+		if !m.closed.Load() && !errors.Is(err, net.ErrClosed) {
+			m.tunnelWatcher(ForwardConnMessage{
+				MessageType: ForwardConnMsgTypeInputReadError,
+				Err:         err,
+			})
+		}
+		_ = m.Close()
+	}
+	<-downstreamDone
+	_ = m.Close()
+	return closedByOutput.Load()
+}
@@ -0,0 +1,197 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/doraemonkeys/monster-pipe-core/pkg/protocol"
+)
+
+var ErrIdentityDenied = errors.New("client identity is not allowed")
+
+const defaultHandshakeTimeout = 10 * time.Second
+
+type InputTLSConfig struct {
+	// CertFile and KeyFile are the PEM files of the server certificate.
+	CertFile string
+	KeyFile  string
+	// GetCertificate is used instead of CertFile and KeyFile when it is set,
+	// for example config.SelfSignedCert.GetCertificate that rotates the certificate without a restart.
+	GetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	// MinVersion is the lowest TLS version accepted, default tls.VersionTLS12.
+	MinVersion uint16
+	// ClientCAFile enables mutual TLS, the clients must present a certificate signed by one of the CAs of the PEM file.
+	ClientCAFile string
+	// AllowedSubjects limits the client certificates to the ones whose common name, DNS name, email address
+	// or full subject is listed. Empty allows any certificate signed by the client CAs.
+	AllowedSubjects []string
+}
+
+func (c *InputTLSConfig) serverConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		GetCertificate: c.GetCertificate,
+		MinVersion:     c.MinVersion,
+	}
+	if config.GetCertificate == nil {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load tls certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	if c.ClientCAFile == "" {
+		if len(c.AllowedSubjects) > 0 {
+			return nil, fmt.Errorf("tls allowed subjects need a client CA")
+		}
+		return config, nil
+	}
+	pem, err := os.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("read tls client CA: %w", err)
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in tls client CA %s", c.ClientCAFile)
+	}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	if len(c.AllowedSubjects) > 0 {
+		allowed := slices.Clone(c.AllowedSubjects)
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			cert := state.PeerCertificates[0]
+			for _, subject := range certSubjects(cert) {
+				if slices.Contains(allowed, subject) {
+					return nil
+				}
+			}
+			return fmt.Errorf("%w: %s", ErrIdentityDenied, cert.Subject)
+		}
+	}
+	return config, nil
+}
+
+func certSubjects(cert *x509.Certificate) []string {
+	subjects := []string{cert.Subject.CommonName, cert.Subject.String()}
+	subjects = append(subjects, cert.DNSNames...)
+	return append(subjects, cert.EmailAddresses...)
+}
+
+// certIdentity names the client of a certificate, the common name if it has one.
+func certIdentity(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return cert.Subject.String()
+}
+
+// connIdentity returns who the client proved to be during the handshake, it is empty for the anonymous clients.
+// The wrapping connections are unwrapped until one of them has an identity,
+// a wss client is identified by its TLS certificate, or by the key of the stream under TLS.
+func connIdentity(conn net.Conn) string {
+	for conn != nil {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			if certs := c.ConnectionState().PeerCertificates; len(certs) > 0 {
+				return certIdentity(certs[0])
+			}
+		case interface{ ID() string }:
+			if id := c.ID(); id != "" {
+				return id
+			}
+		}
+		unwrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = unwrapper.NetConn()
+	}
+	return ""
+}
+
+type OutputTLSConfig struct {
+	// ServerName is sent as SNI and checked against the certificate of the output, default the host of the output.
+	ServerName string
+	// CAFile is the PEM bundle of the CAs trusted for the output, default the system roots.
+	CAFile string
+	// CertFile and KeyFile are the client certificate presented to the outputs that require mutual TLS.
+	CertFile string
+	KeyFile  string
+	// InsecureSkipVerify accepts any certificate of the output, it is meant for testing.
+	InsecureSkipVerify bool
+	// MinVersion is the lowest TLS version accepted, default tls.VersionTLS12.
+	MinVersion uint16
+}
+
+func (c *OutputTLSConfig) clientConfig(host string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		MinVersion:         c.MinVersion,
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	if config.ServerName == "" {
+		// The outputs on the ssh server, ssh:6380.
+		config.ServerName = "localhost"
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read tls CA: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in tls CA %s", c.CAFile)
+		}
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load tls client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// wrapDial runs the TLS handshake over the connections of dial.
+// An invalid config is returned by every dial, NewForwardOutput has no error to return.
+func (c *OutputTLSConfig) wrapDial(dial func(ctx context.Context, network string, address string) (net.Conn, error), host string) func(ctx context.Context, network string, address string) (net.Conn, error) {
+	config, configErr := c.clientConfig(host)
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		if configErr != nil {
+			return nil, configErr
+		}
+		if isUDP(protocol.NetProtocol(network)) {
+			return nil, fmt.Errorf("tls needs a tcp output")
+		}
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("tls handshake: %w", err)
+		}
+		return tlsConn, nil
+	}
+}
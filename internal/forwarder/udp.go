@@ -1,96 +1,469 @@
 package forwarder
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
+)
+
+var ErrUDPSessionLimit = errors.New("udp session limit reached")
 
-	syncgmap "github.com/doraemonkeys/sync-gmap"
+const (
+	defaultUDPIdleTimeout  = 2 * time.Minute
+	defaultUDPQueueSize    = 100
+	defaultUDPRejectPeriod = time.Minute
+	defaultUDPMemoryBudget = 32 << 20
+	// MaxUDPDatagramSize is the largest UDPConfig.MaxDatagramSize, it holds any UDP datagram.
+	MaxUDPDatagramSize = 64 * 1024
 )
 
-type UdpListener struct {
-	listener *net.UDPConn
-	// dataChMap map[string]chan []byte
-	dataChMap *syncgmap.SyncMap[string, chan []byte]
+type UDPConfig struct {
+	// IdleTimeout expires a session that neither received nor sent a datagram for this long, default 2 minutes.
+	// A negative IdleTimeout keeps the sessions until their tunnels close.
+	// The tunnel of an expired session reads EOF.
+	IdleTimeout time.Duration
+	// MaxSessions limits the concurrent sessions, the datagrams of the new clients over it are dropped. 0 means no limit.
+	MaxSessions int
+	// QueueSize is how many datagrams a session holds until its tunnel reads them, default 100.
+	QueueSize int
+	// MemoryBudget limits the bytes of the datagrams held by all the sessions, default 32 MiB.
+	// The datagrams over the queue size or the budget are dropped, see UDPSessionMessage.Dropped.
+	MemoryBudget int64
+	// MaxDatagramSize is the largest datagram accepted from the clients, default and at most 64 KiB.
+	// The larger datagrams are dropped, see UDPSessionMessage.Oversized.
+	MaxDatagramSize int
+	// ReadBuffer and WriteBuffer set SO_RCVBUF and SO_SNDBUF of the socket, 0 keeps the defaults of the system.
+	// A larger receive buffer absorbs the bursts while the sessions are busy.
+	ReadBuffer  int
+	WriteBuffer int
 }
 
-type UdpConn struct {
-	*net.UDPConn
-	addr    *net.UDPAddr
-	data    []byte
-	dataCh  <-chan []byte
-	onClose func()
+func (c UDPConfig) withDefaults() UDPConfig {
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = defaultUDPIdleTimeout
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = defaultUDPQueueSize
+	}
+	if c.MemoryBudget <= 0 {
+		c.MemoryBudget = defaultUDPMemoryBudget
+	}
+	if c.MaxDatagramSize <= 0 {
+		c.MaxDatagramSize = MaxUDPDatagramSize
+	}
+	return c
 }
 
-func (u *UdpConn) Read(b []byte) (int, error) {
-	if len(u.data) != 0 {
-		n := copy(b, u.data)
-		u.data = u.data[n:]
-		return n, nil
+type UDPSessionEvent int
+
+const (
+	UDPSessionCreated UDPSessionEvent = 1
+	// The session was idle for UDPConfig.IdleTimeout.
+	UDPSessionExpired UDPSessionEvent = 2
+	// The datagrams of a new client are dropped because of UDPConfig.MaxSessions.
+	// It is reported once per client and per IdleTimeout, or per minute when the sessions don't expire.
+	UDPSessionRejected UDPSessionEvent = 3
+	// The tunnel of the session is closed.
+	UDPSessionClosed UDPSessionEvent = 4
+)
+
+func (e UDPSessionEvent) String() string {
+	switch e {
+	case UDPSessionCreated:
+		return "created"
+	case UDPSessionExpired:
+		return "expired"
+	case UDPSessionRejected:
+		return "rejected"
+	case UDPSessionClosed:
+		return "closed"
 	}
-	data := <-u.dataCh
-	n := copy(b, data)
-	u.data = data[n:]
-	return n, nil
+	return "unknown"
 }
 
-func (u *UdpConn) Write(b []byte) (int, error) {
-	return u.UDPConn.WriteToUDP(b, u.addr)
+type UDPSessionMessage struct {
+	Event UDPSessionEvent
+	// Sessions is the number of sessions after the event.
+	Sessions int
+	// Dropped is the number of datagrams of the session dropped because its queue was full or the memory budget exhausted,
+	// Oversized the number of the ones larger than UDPConfig.MaxDatagramSize. They are set in UDPSessionExpired and UDPSessionClosed.
+	// In UDPSessionRejected, Dropped is the number of datagrams of the client rejected since its last UDPSessionRejected.
+	Dropped   int64
+	Oversized int64
 }
 
-func (u *UdpConn) Close() error {
-	u.onClose()
+// UdpListener demultiplexes the datagrams of a UDP socket into a session per client address,
+// Accept returns the session of a new client.
+type UdpListener struct {
+	conn    *net.UDPConn
+	config  UDPConfig
+	onEvent func(addr net.Addr, message UDPSessionMessage)
+	readBuf []byte
+	// queued is the bytes of the datagrams held by the sessions.
+	queued atomic.Int64
+
+	mu       sync.Mutex
+	sessions map[netip.AddrPort]*UdpConn
+	// rejected keeps the clients refused over MaxSessions, so that each of them is reported once per period.
+	rejected  map[netip.AddrPort]*udpRejection
+	lastSweep time.Time
+}
+
+type udpRejection struct {
+	reportedAt time.Time
+	lastSeen   time.Time
+	// count is the datagrams rejected since reportedAt.
+	count int64
+}
+
+func newUdpListener(conn *net.UDPConn) *UdpListener {
+	return &UdpListener{
+		conn:     conn,
+		config:   UDPConfig{}.withDefaults(),
+		readBuf:  make([]byte, MaxUDPDatagramSize+1),
+		sessions: make(map[netip.AddrPort]*UdpConn),
+		rejected: make(map[netip.AddrPort]*udpRejection),
+	}
+}
+
+// configure sets the config of the socket and the sessions, it is called before the first Accept.
+func (u *UdpListener) configure(config UDPConfig) error {
+	config = config.withDefaults()
+	if config.MaxDatagramSize > MaxUDPDatagramSize {
+		return fmt.Errorf("udp max datagram size %d is over %d", config.MaxDatagramSize, MaxUDPDatagramSize)
+	}
+	if config.ReadBuffer > 0 {
+		if err := u.conn.SetReadBuffer(config.ReadBuffer); err != nil {
+			return fmt.Errorf("set udp read buffer: %w", err)
+		}
+	}
+	if config.WriteBuffer > 0 {
+		if err := u.conn.SetWriteBuffer(config.WriteBuffer); err != nil {
+			return fmt.Errorf("set udp write buffer: %w", err)
+		}
+	}
+	u.config = config
+	// One more byte tells a datagram over the limit from one that is exactly the limit.
+	u.readBuf = make([]byte, config.MaxDatagramSize+1)
 	return nil
 }
 
-func (u *UdpConn) LocalAddr() net.Addr {
-	return u.UDPConn.LocalAddr()
+// setEventWatcher receives the session events, it is called before the first Accept.
+func (u *UdpListener) setEventWatcher(onEvent func(addr net.Addr, message UDPSessionMessage)) {
+	u.onEvent = onEvent
 }
 
-func (u *UdpConn) RemoteAddr() net.Addr {
-	return u.addr
+func (u *UdpListener) emit(addr net.Addr, message UDPSessionMessage) {
+	if u.onEvent != nil {
+		u.onEvent(addr, message)
+	}
+}
+
+// Sessions returns the number of the current sessions.
+func (u *UdpListener) Sessions() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.sessions)
 }
 
 func (u *UdpListener) Accept() (net.Conn, error) {
-	const channelSize = 100
 	for {
-		buf := make([]byte, 2048)
-		n, addr, err := u.listener.ReadFromUDP(buf)
+		n, addr, err := u.conn.ReadFromUDPAddrPort(u.readBuf)
 		if err != nil {
 			return nil, err
 		}
-		dataCh, ok := u.dataChMap.Load(addr.String())
-		if ok {
-			// dataCh <- buf[:n]
-			if len(dataCh) < channelSize {
-				dataCh <- buf[:n]
-			} else {
-				go func() {
-					select {
-					case dataCh <- buf[:n]:
-					case <-time.After(time.Second):
-					}
-				}()
+		var data []byte
+		if n <= u.config.MaxDatagramSize {
+			data = bytes.Clone(u.readBuf[:n])
+		}
+		u.mu.Lock()
+		// The datagrams are queued under the lock, so that a closed session gets none after it drained its queue.
+		if session, ok := u.sessions[addr]; ok {
+			session.push(data)
+			u.mu.Unlock()
+			continue
+		}
+		if u.config.MaxSessions > 0 && len(u.sessions) >= u.config.MaxSessions {
+			sessions := len(u.sessions)
+			rejected, report := u.reject(addr)
+			u.mu.Unlock()
+			if report {
+				u.emit(udpAddr(addr), UDPSessionMessage{Event: UDPSessionRejected, Sessions: sessions, Dropped: rejected})
 			}
 			continue
 		}
-		dataCh = make(chan []byte, channelSize)
-		u.dataChMap.Store(addr.String(), dataCh)
-		return &UdpConn{
-			UDPConn: u.listener,
-			addr:    addr,
-			data:    buf[:n],
-			dataCh:  dataCh,
-			onClose: func() {
-				u.dataChMap.Delete(addr.String())
-			},
-		}, nil
+		delete(u.rejected, addr)
+		session := newUdpConn(u, addr)
+		u.sessions[addr] = session
+		session.push(data)
+		sessions := len(u.sessions)
+		u.mu.Unlock()
+		u.emit(session.remoteAddr, UDPSessionMessage{Event: UDPSessionCreated, Sessions: sessions})
+		return session, nil
 	}
 }
 
+// reject counts the rejected datagram of the client, report is true for the first one of a period.
+// The caller holds the lock of the listener.
+func (u *UdpListener) reject(addr netip.AddrPort) (rejected int64, report bool) {
+	now := time.Now()
+	period := u.config.IdleTimeout
+	if period <= 0 {
+		period = defaultUDPRejectPeriod
+	}
+	// The clients that went quiet are forgotten, at most once per period.
+	if now.Sub(u.lastSweep) >= period {
+		u.lastSweep = now
+		for addr, r := range u.rejected {
+			if now.Sub(r.lastSeen) >= period {
+				delete(u.rejected, addr)
+			}
+		}
+	}
+	r, ok := u.rejected[addr]
+	if ok && now.Sub(r.reportedAt) < period {
+		r.count++
+		r.lastSeen = now
+		return 0, false
+	}
+	rejected = 1
+	if ok {
+		rejected += r.count
+	}
+	u.rejected[addr] = &udpRejection{reportedAt: now, lastSeen: now}
+	return rejected, true
+}
+
+// remove deletes the session from the table, it returns the number of sessions left.
+func (u *UdpListener) remove(session *UdpConn) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.sessions[session.addr] == session {
+		delete(u.sessions, session.addr)
+	}
+	return len(u.sessions)
+}
+
 func (u *UdpListener) Close() error {
-	return u.listener.Close()
+	return u.conn.Close()
 }
 
 func (u *UdpListener) Addr() net.Addr {
-	return u.listener.LocalAddr()
+	return u.conn.LocalAddr()
+}
+
+// udpAddr returns the address of a client, an IPv4 client of a dual-stack socket is shown as IPv4.
+func udpAddr(addr netip.AddrPort) *net.UDPAddr {
+	return net.UDPAddrFromAddrPort(netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port()))
+}
+
+// UdpConn is the session of a client, its datagrams are queued by the listener until the tunnel reads them.
+type UdpConn struct {
+	listener   *UdpListener
+	addr       netip.AddrPort
+	remoteAddr *net.UDPAddr
+	// data is the rest of a datagram larger than the buffer of the last Read.
+	data       []byte
+	dataCh     chan []byte
+	lastActive atomic.Int64
+	dropped    atomic.Int64
+	oversized  atomic.Int64
+	idleTimer  *time.Timer
+
+	deadlineMu   sync.Mutex
+	readDeadline time.Time
+	// deadlineCh is closed when the read deadline changes, so that a blocked Read picks up the new one.
+	deadlineCh chan struct{}
+
+	// expired makes Read return EOF once the queue is empty, instead of net.ErrClosed.
+	expired   atomic.Bool
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newUdpConn(listener *UdpListener, addr netip.AddrPort) *UdpConn {
+	u := &UdpConn{
+		listener:   listener,
+		addr:       addr,
+		remoteAddr: udpAddr(addr),
+		dataCh:     make(chan []byte, listener.config.QueueSize),
+		deadlineCh: make(chan struct{}),
+		closed:     make(chan struct{}),
+	}
+	u.touch()
+	if listener.config.IdleTimeout > 0 {
+		// The timer is armed once it is assigned, checkIdle resets it.
+		u.idleTimer = time.AfterFunc(time.Hour, u.checkIdle)
+		u.idleTimer.Reset(listener.config.IdleTimeout)
+	}
+	return u
+}
+
+func (u *UdpConn) touch() {
+	u.lastActive.Store(time.Now().UnixNano())
+}
+
+// push queues a datagram, data is nil for a datagram over UDPConfig.MaxDatagramSize.
+// The caller holds the lock of the listener.
+func (u *UdpConn) push(data []byte) {
+	// A client whose datagrams are dropped is still active.
+	u.touch()
+	if data == nil {
+		u.oversized.Add(1)
+		return
+	}
+	size := int64(len(data))
+	if u.listener.queued.Add(size) > u.listener.config.MemoryBudget {
+		u.listener.queued.Add(-size)
+		u.dropped.Add(1)
+		return
+	}
+	select {
+	case u.dataCh <- data:
+	default:
+		u.listener.queued.Add(-size)
+		u.dropped.Add(1)
+	}
+}
+
+func (u *UdpConn) checkIdle() {
+	idleFor := time.Since(time.Unix(0, u.lastActive.Load()))
+	if timeout := u.listener.config.IdleTimeout; idleFor < timeout {
+		u.idleTimer.Reset(timeout - idleFor)
+		return
+	}
+	select {
+	case <-u.closed:
+		return
+	default:
+	}
+	u.expired.Store(true)
+	sessions := u.listener.remove(u)
+	u.closeOnce.Do(func() { close(u.closed) })
+	u.listener.emit(u.remoteAddr, u.message(UDPSessionExpired, sessions))
+}
+
+func (u *UdpConn) message(event UDPSessionEvent, sessions int) UDPSessionMessage {
+	return UDPSessionMessage{Event: event, Sessions: sessions, Dropped: u.dropped.Load(), Oversized: u.oversized.Load()}
+}
+
+// take returns a datagram to the caller of Read.
+func (u *UdpConn) take(b []byte, data []byte) int {
+	u.listener.queued.Add(-int64(len(data)))
+	n := copy(b, data)
+	u.data = data[n:]
+	return n
+}
+
+func (u *UdpConn) Read(b []byte) (int, error) {
+	if len(u.data) != 0 {
+		n := copy(b, u.data)
+		u.data = u.data[n:]
+		return n, nil
+	}
+	for {
+		u.deadlineMu.Lock()
+		deadline, deadlineCh := u.readDeadline, u.deadlineCh
+		u.deadlineMu.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case data := <-u.dataCh:
+			stopTimer(timer)
+			return u.take(b, data), nil
+		case <-u.closed:
+			stopTimer(timer)
+			if !u.expired.Load() {
+				return 0, net.ErrClosed
+			}
+			select {
+			case data := <-u.dataCh:
+				return u.take(b, data), nil
+			default:
+				return 0, io.EOF
+			}
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		case <-deadlineCh:
+			stopTimer(timer)
+		}
+	}
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+func (u *UdpConn) Write(b []byte) (int, error) {
+	u.touch()
+	return u.listener.conn.WriteToUDPAddrPort(b, u.addr)
+}
+
+// Close removes the session, a later datagram of the client creates a new one.
+func (u *UdpConn) Close() error {
+	closing := false
+	u.closeOnce.Do(func() {
+		closing = true
+		close(u.closed)
+	})
+	if u.idleTimer != nil {
+		u.idleTimer.Stop()
+	}
+	sessions := u.listener.remove(u)
+	// An expired session already reported its counters.
+	if closing {
+		u.listener.emit(u.remoteAddr, u.message(UDPSessionClosed, sessions))
+	}
+	for {
+		select {
+		case data := <-u.dataCh:
+			u.listener.queued.Add(-int64(len(data)))
+		default:
+			return nil
+		}
+	}
+}
+
+func (u *UdpConn) LocalAddr() net.Addr {
+	return u.listener.conn.LocalAddr()
+}
+
+func (u *UdpConn) RemoteAddr() net.Addr {
+	return u.remoteAddr
+}
+
+// SetDeadline only sets the read deadline, the socket is shared by all the sessions.
+func (u *UdpConn) SetDeadline(t time.Time) error {
+	return u.SetReadDeadline(t)
+}
+
+func (u *UdpConn) SetReadDeadline(t time.Time) error {
+	u.deadlineMu.Lock()
+	defer u.deadlineMu.Unlock()
+	u.readDeadline = t
+	close(u.deadlineCh)
+	u.deadlineCh = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline does nothing, a write to the shared socket does not block for long.
+func (u *UdpConn) SetWriteDeadline(time.Time) error {
+	return nil
 }
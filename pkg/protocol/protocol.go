@@ -14,12 +14,34 @@ const (
 	NetProtocolUDP  NetProtocol = "udp"
 	NetProtocolUDP4 NetProtocol = "udp4"
 	NetProtocolUDP6 NetProtocol = "udp6"
+	// NetProtocolSecure is a TCP stream encrypted by pkg/protocol/secure, for mpipe to mpipe links.
+	NetProtocolSecure NetProtocol = "secure"
+	// NetProtocolWS and NetProtocolWSS carry the stream or the datagrams in WebSocket messages, see pkg/protocol/ws.
+	NetProtocolWS  NetProtocol = "ws"
+	NetProtocolWSS NetProtocol = "wss"
+	// NetProtocolFramed is a TCP stream of length-prefixed messages, see pkg/protocol/tcp.
+	// It carries the datagrams of a UDP tunnel between two mpipe.
+	NetProtocolFramed NetProtocol = "framed"
 )
 
 func (n NetProtocol) String() string {
 	return string(n)
 }
 
+// Network returns the network the protocol is carried over, the one passed to the listeners and the dialers.
+func (n NetProtocol) Network() string {
+	switch n {
+	case NetProtocolSecure, NetProtocolWS, NetProtocolWSS, NetProtocolFramed:
+		return "tcp"
+	}
+	return string(n)
+}
+
+// IsWebSocket reports whether the protocol is ws or wss.
+func (n NetProtocol) IsWebSocket() bool {
+	return n == NetProtocolWS || n == NetProtocolWSS
+}
+
 func ParseNetProtocol(protocol string) (NetProtocol, error) {
 	switch strings.ToLower(protocol) {
 	case "tcp":
@@ -34,6 +56,14 @@ func ParseNetProtocol(protocol string) (NetProtocol, error) {
 		return NetProtocolUDP4, nil
 	case "udp6":
 		return NetProtocolUDP6, nil
+	case "secure":
+		return NetProtocolSecure, nil
+	case "ws":
+		return NetProtocolWS, nil
+	case "wss":
+		return NetProtocolWSS, nil
+	case "framed":
+		return NetProtocolFramed, nil
 	}
 	return "", fmt.Errorf("invalid protocol: %s", protocol)
 }
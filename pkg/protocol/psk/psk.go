@@ -0,0 +1,266 @@
+// Package psk authenticates both ends of a stream with a pre-shared key before any data is forwarded.
+//
+// The handshake is a mutual HMAC-SHA256 challenge/response:
+//
+//	server -> client: "MPSK" version server-nonce(32)
+//	client -> server: client-nonce(32) id-length(1) id client-mac(32)
+//	server -> client: server-mac(32)
+//
+// client-mac is HMAC(key, "client" server-nonce client-nonce id) and server-mac is HMAC(key, "server" client-nonce server-nonce id).
+// The key never crosses the wire and the nonces make a recorded handshake useless. The stream itself is not encrypted.
+package psk
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	version   = 1
+	nonceSize = 32
+	macSize   = sha256.Size
+
+	defaultTimeout = 10 * time.Second
+)
+
+var (
+	magic = []byte("MPSK")
+
+	ErrAuthFailed = errors.New("psk authentication failed")
+)
+
+type Config struct {
+	// Key is the pre-shared key of the client, and of the server when Keys is nil.
+	Key []byte
+	// ID names the client, the server passes it to Keys.
+	ID string
+	// Keys returns the key of a client ID on the server, so that the clients can have their own keys.
+	Keys func(id string) ([]byte, bool)
+	// Timeout limits the handshake, default 10s.
+	Timeout time.Duration
+}
+
+func (c *Config) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return defaultTimeout
+	}
+	return c.Timeout
+}
+
+func (c *Config) key(id string) ([]byte, bool) {
+	if c.Keys != nil {
+		return c.Keys(id)
+	}
+	return c.Key, len(c.Key) > 0
+}
+
+// Conn is a stream that runs the handshake before the first Read or Write.
+type Conn struct {
+	net.Conn
+	config   *Config
+	isClient bool
+
+	handshakeOnce sync.Once
+	handshakeErr  error
+	id            string
+}
+
+// Server returns the server side of the handshake, see Conn.HandshakeContext.
+func Server(conn net.Conn, config *Config) *Conn {
+	return &Conn{Conn: conn, config: config}
+}
+
+// Client returns the client side of the handshake, see Conn.HandshakeContext.
+func Client(conn net.Conn, config *Config) *Conn {
+	return &Conn{Conn: conn, config: config, isClient: true}
+}
+
+// ID returns the ID the client authenticated with, it is empty before the handshake.
+func (c *Conn) ID() string {
+	return c.id
+}
+
+// HandshakeContext runs the handshake if it has not run yet, the error of the first run is returned to all the callers.
+func (c *Conn) HandshakeContext(ctx context.Context) error {
+	c.handshakeOnce.Do(func() {
+		c.handshakeErr = c.handshake(ctx)
+	})
+	return c.handshakeErr
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if err := c.HandshakeContext(context.Background()); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.HandshakeContext(context.Background()); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// CloseWrite half-closes the underlying connection if it supports it.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+func (c *Conn) handshake(ctx context.Context) error {
+	deadline := time.Now().Add(c.config.timeout())
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = c.Conn.SetDeadline(deadline)
+	// A deadline in the past interrupts the blocked reads when the context is done.
+	stop := context.AfterFunc(ctx, func() {
+		_ = c.Conn.SetDeadline(time.Now())
+	})
+	defer stop()
+	var err error
+	if c.isClient {
+		err = c.clientHandshake()
+	} else {
+		err = c.serverHandshake()
+	}
+	if err != nil {
+		return err
+	}
+	return c.Conn.SetDeadline(time.Time{})
+}
+
+func (c *Conn) serverHandshake() error {
+	hello := make([]byte, 0, len(magic)+1+nonceSize)
+	hello = append(hello, magic...)
+	hello = append(hello, version)
+	serverNonce := make([]byte, nonceSize)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return err
+	}
+	hello = append(hello, serverNonce...)
+	if _, err := c.Conn.Write(hello); err != nil {
+		return fmt.Errorf("psk handshake: %w", err)
+	}
+
+	clientNonce := make([]byte, nonceSize+1)
+	if _, err := io.ReadFull(c.Conn, clientNonce); err != nil {
+		return fmt.Errorf("psk handshake: %w", err)
+	}
+	id := make([]byte, clientNonce[nonceSize])
+	clientNonce = clientNonce[:nonceSize]
+	clientMAC := make([]byte, macSize)
+	if _, err := io.ReadFull(c.Conn, id); err != nil {
+		return fmt.Errorf("psk handshake: %w", err)
+	}
+	if _, err := io.ReadFull(c.Conn, clientMAC); err != nil {
+		return fmt.Errorf("psk handshake: %w", err)
+	}
+	key, ok := c.config.key(string(id))
+	if !ok || !hmac.Equal(clientMAC, sign(key, "client", serverNonce, clientNonce, id)) {
+		return ErrAuthFailed
+	}
+	if _, err := c.Conn.Write(sign(key, "server", clientNonce, serverNonce, id)); err != nil {
+		return fmt.Errorf("psk handshake: %w", err)
+	}
+	c.id = string(id)
+	return nil
+}
+
+func (c *Conn) clientHandshake() error {
+	if len(c.config.ID) > 255 {
+		return fmt.Errorf("psk id is longer than 255 bytes")
+	}
+	hello := make([]byte, len(magic)+1+nonceSize)
+	if _, err := io.ReadFull(c.Conn, hello); err != nil {
+		return fmt.Errorf("psk handshake: %w", err)
+	}
+	if string(hello[:len(magic)]) != string(magic) || hello[len(magic)] != version {
+		return fmt.Errorf("psk handshake: the server does not speak psk version %d", version)
+	}
+	serverNonce := hello[len(magic)+1:]
+	clientNonce := make([]byte, nonceSize)
+	if _, err := rand.Read(clientNonce); err != nil {
+		return err
+	}
+	id := []byte(c.config.ID)
+	response := make([]byte, 0, nonceSize+1+len(id)+macSize)
+	response = append(response, clientNonce...)
+	response = append(response, byte(len(id)))
+	response = append(response, id...)
+	response = append(response, sign(c.config.Key, "client", serverNonce, clientNonce, id)...)
+	if _, err := c.Conn.Write(response); err != nil {
+		return fmt.Errorf("psk handshake: %w", err)
+	}
+	serverMAC := make([]byte, macSize)
+	if _, err := io.ReadFull(c.Conn, serverMAC); err != nil {
+		// The server closes the connection when it rejects the key.
+		return fmt.Errorf("%w: %w", ErrAuthFailed, err)
+	}
+	if !hmac.Equal(serverMAC, sign(c.config.Key, "server", clientNonce, serverNonce, id)) {
+		return fmt.Errorf("%w: the server does not know the key", ErrAuthFailed)
+	}
+	c.id = c.config.ID
+	return nil
+}
+
+func sign(key []byte, role string, nonce1, nonce2, id []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(role))
+	mac.Write(nonce1)
+	mac.Write(nonce2)
+	mac.Write(id)
+	return mac.Sum(nil)
+}
+
+type listener struct {
+	net.Listener
+	config *Config
+}
+
+// Accept returns the connection before the handshake, so that a slow client does not hold up the others.
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return Server(conn, l.config), nil
+}
+
+// WrapListen wraps the listener function of a ForwardInput, the accepted connections are *Conn.
+func WrapListen(listen func(ctx context.Context, network string, address string) (net.Listener, error), config *Config) func(ctx context.Context, network string, address string) (net.Listener, error) {
+	return func(ctx context.Context, network string, address string) (net.Listener, error) {
+		l, err := listen(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return &listener{Listener: l, config: config}, nil
+	}
+}
+
+// WrapDial wraps the dialer function of a ForwardOutput, the handshake is done before the connection is returned.
+func WrapDial(dial func(ctx context.Context, network string, address string) (net.Conn, error), config *Config) func(ctx context.Context, network string, address string) (net.Conn, error) {
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		pskConn := Client(conn, config)
+		if err := pskConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return pskConn, nil
+	}
+}
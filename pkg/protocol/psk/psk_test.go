@@ -0,0 +1,209 @@
+package psk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// handshake runs both sides over a pipe, a side that fails closes its end like handleConn does.
+func handshake(t *testing.T, serverConfig, clientConfig *Config) (server, client *Conn, serverErr, clientErr error) {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+	server, client = Server(serverConn, serverConfig), Client(clientConn, clientConfig)
+	done := make(chan error, 1)
+	go func() {
+		err := server.HandshakeContext(context.Background())
+		if err != nil {
+			_ = serverConn.Close()
+		}
+		done <- err
+	}()
+	clientErr = client.HandshakeContext(context.Background())
+	if clientErr != nil {
+		_ = clientConn.Close()
+	}
+	select {
+	case serverErr = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server handshake did not return")
+	}
+	return server, client, serverErr, clientErr
+}
+
+func Test_handshake(t *testing.T) {
+	server, client, serverErr, clientErr := handshake(t, &Config{Key: []byte("secret")}, &Config{Key: []byte("secret"), ID: "alice"})
+	if serverErr != nil || clientErr != nil {
+		t.Fatalf("handshake failed, server: %v, client: %v", serverErr, clientErr)
+	}
+	if server.ID() != "alice" || client.ID() != "alice" {
+		t.Errorf("ID() = %q and %q, want alice", server.ID(), client.ID())
+	}
+	go func() {
+		_, _ = client.Write([]byte("hello"))
+	}()
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("read %q, %v after the handshake", buf, err)
+	}
+}
+
+func Test_handshakeWrongKey(t *testing.T) {
+	tests := []struct {
+		name         string
+		serverConfig *Config
+		clientConfig *Config
+	}{
+		{"client key", &Config{Key: []byte("secret")}, &Config{Key: []byte("guess")}},
+		{"server key", &Config{Key: []byte("guess")}, &Config{Key: []byte("secret")}},
+		{"no server key", &Config{}, &Config{Key: []byte("secret")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _, serverErr, clientErr := handshake(t, tt.serverConfig, tt.clientConfig)
+			if !errors.Is(serverErr, ErrAuthFailed) {
+				t.Errorf("server error = %v, want ErrAuthFailed", serverErr)
+			}
+			if !errors.Is(clientErr, ErrAuthFailed) {
+				t.Errorf("client error = %v, want ErrAuthFailed", clientErr)
+			}
+			if server.ID() != "" {
+				t.Errorf("ID() = %q after a failed handshake", server.ID())
+			}
+			if _, err := server.Read(make([]byte, 1)); !errors.Is(err, ErrAuthFailed) {
+				t.Errorf("Read() after a failed handshake = %v", err)
+			}
+		})
+	}
+}
+
+func Test_handshakeKeys(t *testing.T) {
+	keys := map[string][]byte{"alice": []byte("alice-key"), "bob": []byte("bob-key")}
+	serverConfig := &Config{Keys: func(id string) ([]byte, bool) {
+		key, ok := keys[id]
+		return key, ok
+	}}
+	tests := []struct {
+		id     string
+		key    string
+		wantOK bool
+	}{
+		{"alice", "alice-key", true},
+		{"bob", "bob-key", true},
+		{"bob", "alice-key", false},
+		{"carol", "alice-key", false},
+		{"", "alice-key", false},
+	}
+	for _, tt := range tests {
+		server, _, serverErr, clientErr := handshake(t, serverConfig, &Config{Key: []byte(tt.key), ID: tt.id})
+		if tt.wantOK {
+			if serverErr != nil || clientErr != nil || server.ID() != tt.id {
+				t.Errorf("%s with %s: server: %v, client: %v, ID() = %q", tt.id, tt.key, serverErr, clientErr, server.ID())
+			}
+			continue
+		}
+		if !errors.Is(serverErr, ErrAuthFailed) || !errors.Is(clientErr, ErrAuthFailed) {
+			t.Errorf("%q with %s: server: %v, client: %v, want ErrAuthFailed", tt.id, tt.key, serverErr, clientErr)
+		}
+	}
+}
+
+func Test_handshakeLongID(t *testing.T) {
+	_, _, serverErr, clientErr := handshake(t, &Config{Key: []byte("secret")}, &Config{Key: []byte("secret"), ID: strings.Repeat("a", 256)})
+	if clientErr == nil || !strings.Contains(clientErr.Error(), "255") {
+		t.Errorf("client error = %v, want the id length error", clientErr)
+	}
+	if serverErr == nil {
+		t.Error("server handshake succeeded without a client")
+	}
+
+	server, _, serverErr, clientErr := handshake(t, &Config{Key: []byte("secret")}, &Config{Key: []byte("secret"), ID: strings.Repeat("a", 255)})
+	if serverErr != nil || clientErr != nil || len(server.ID()) != 255 {
+		t.Errorf("255 byte id: server: %v, client: %v", serverErr, clientErr)
+	}
+}
+
+func Test_handshakeContextDeadline(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	// The client reads the hello and never answers.
+	go func() {
+		_, _ = io.Copy(io.Discard, clientConn)
+	}()
+	server := Server(serverConn, &Config{Key: []byte("secret")})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := server.HandshakeContext(ctx)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("HandshakeContext() = %v, want a deadline error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("HandshakeContext() returned after %s, the context deadline was ignored", elapsed)
+	}
+
+	// A cancelled context interrupts the handshake too.
+	serverConn2, clientConn2 := net.Pipe()
+	defer serverConn2.Close()
+	defer clientConn2.Close()
+	go func() {
+		_, _ = io.Copy(io.Discard, clientConn2)
+	}()
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel2)
+	if err := Server(serverConn2, &Config{Key: []byte("secret")}).HandshakeContext(ctx2); err == nil {
+		t.Error("HandshakeContext() succeeded after the context was cancelled")
+	}
+}
+
+func Test_wrapListenDial(t *testing.T) {
+	config := &Config{Key: []byte("secret"), ID: "alice"}
+	l, err := WrapListen(func(ctx context.Context, network, address string) (net.Listener, error) {
+		return net.Listen(network, address)
+	}, config)(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	dial := WrapDial((&net.Dialer{}).DialContext, config)
+	conn, err := dial(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, []byte("ping")) {
+		t.Errorf("echo = %q, %v", buf, err)
+	}
+
+	bad := WrapDial((&net.Dialer{}).DialContext, &Config{Key: []byte("guess")})
+	if _, err := bad(context.Background(), "tcp", l.Addr().String()); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("dial with a wrong key = %v, want ErrAuthFailed", err)
+	}
+}
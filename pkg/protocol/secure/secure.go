@@ -0,0 +1,620 @@
+// Package secure encrypts a stream between two mpipe instances.
+//
+// Both sides generate an ephemeral X25519 key for each connection, the keys of the records are derived
+// from the shared secrets of the handshake with HKDF-SHA256:
+//
+//	client -> server: "MSEC" version flags(1) client-ephemeral(32) [client-static(32)]
+//	server -> client: "MSEC" version flags(1) server-ephemeral(32) [server-static(32)]
+//	server -> client: finished record
+//	client -> server: finished record
+//
+// The secret mixes the ephemeral-ephemeral exchange, the exchanges with the static keys that are present
+// and the pre-shared key. A side that does not know the PSK or the private key of its static key can't
+// produce the finished record, so the handshake fails.
+//
+// A record is length(2) chacha20poly1305(type(1) payload). The nonce is the count of the records sent
+// with the key, it is never sent, so that a replayed, reordered or dropped record fails to decrypt.
+// The keys are replaced by a one-way ratchet every RekeyBytes or RekeyInterval, a close record marks
+// the end of the stream so that a truncation is detected.
+package secure
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	version = 1
+	keySize = 32
+
+	flagStatic = 1
+
+	recordData     = 0
+	recordFinished = 1
+	recordRekey    = 2
+	recordClose    = 3
+
+	maxPayload    = 16 * 1024
+	maxCiphertext = 1 + maxPayload + chacha20poly1305.Overhead
+
+	defaultTimeout       = 10 * time.Second
+	defaultRekeyBytes    = 1 << 30
+	defaultRekeyInterval = 15 * time.Minute
+	closeTimeout         = 5 * time.Second
+)
+
+var (
+	magic = []byte("MSEC")
+
+	ErrAuthFailed = errors.New("secure handshake authentication failed")
+	// ErrTruncated is returned by Read when the stream ends without a close record.
+	ErrTruncated = errors.New("secure stream truncated")
+)
+
+type Config struct {
+	// PSK is mixed into the key exchange, both sides must have the same one.
+	PSK []byte
+	// PrivateKey is the static X25519 key of this side, see GenerateKey.
+	// The server proves it owns it, a client that has one sends its public key, see Conn.ID.
+	PrivateKey []byte
+	// PeerPublicKey pins the static key of the server on the client.
+	PeerPublicKey []byte
+	// AuthorizedKeys limits the clients to the ones with these static keys on the server, empty allows any client.
+	AuthorizedKeys [][]byte
+	// RekeyBytes and RekeyInterval decide how often the keys of a direction are replaced, default 1 GiB and 15m.
+	RekeyBytes    int64
+	RekeyInterval time.Duration
+	// Timeout limits the handshake, default 10s.
+	Timeout time.Duration
+}
+
+func (c *Config) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return defaultTimeout
+	}
+	return c.Timeout
+}
+
+func (c *Config) rekeyBytes() int64 {
+	if c.RekeyBytes <= 0 {
+		return defaultRekeyBytes
+	}
+	return c.RekeyBytes
+}
+
+func (c *Config) rekeyInterval() time.Duration {
+	if c.RekeyInterval <= 0 {
+		return defaultRekeyInterval
+	}
+	return c.RekeyInterval
+}
+
+// Validate checks that the config authenticates the peer, the server needs a PSK or a private key
+// and the client a PSK or the public key of the server.
+func (c *Config) Validate(isClient bool) error {
+	for _, key := range append([][]byte{c.PrivateKey, c.PeerPublicKey}, c.AuthorizedKeys...) {
+		if key != nil && len(key) != keySize {
+			return fmt.Errorf("secure keys are %d bytes, got %d", keySize, len(key))
+		}
+	}
+	if len(c.PSK) > 0 {
+		return nil
+	}
+	if isClient && c.PeerPublicKey == nil {
+		return fmt.Errorf("secure client needs a PSK or the public key of the server")
+	}
+	if !isClient && c.PrivateKey == nil {
+		return fmt.Errorf("secure server needs a PSK or a private key")
+	}
+	return nil
+}
+
+// GenerateKey returns a new static X25519 key pair.
+func GenerateKey() (privateKey, publicKey []byte, err error) {
+	privateKey = make([]byte, keySize)
+	if _, err := rand.Read(privateKey); err != nil {
+		return nil, nil, err
+	}
+	publicKey, err = PublicKey(privateKey)
+	return privateKey, publicKey, err
+}
+
+// PublicKey returns the public key of the private key.
+func PublicKey(privateKey []byte) ([]byte, error) {
+	return curve25519.X25519(privateKey, curve25519.Basepoint)
+}
+
+// EncodeKey and ParseKey convert the keys to and from base64, the form used in the key files.
+func EncodeKey(key []byte) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func ParseKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace([]byte(s))))
+	if err != nil || len(key) != keySize {
+		return nil, fmt.Errorf("invalid secure key %q, want %d bytes in base64", s, keySize)
+	}
+	return key, nil
+}
+
+// halfConn is the state of one direction of the stream.
+type halfConn struct {
+	aead      cipher.AEAD
+	key       []byte
+	seq       uint64
+	bytes     int64
+	rekeyedAt time.Time
+}
+
+func (h *halfConn) setKey(key []byte) error {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return err
+	}
+	h.aead, h.key, h.seq, h.bytes, h.rekeyedAt = aead, key, 0, 0, time.Now()
+	return nil
+}
+
+// ratchet replaces the key with one derived from it, the old key can't be recovered from the new one.
+func (h *halfConn) ratchet() error {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, h.key, []byte("mpipe secure rekey")), key); err != nil {
+		return err
+	}
+	clear(h.key)
+	return h.setKey(key)
+}
+
+func (h *halfConn) nonce() ([]byte, error) {
+	if h.seq == ^uint64(0) {
+		return nil, fmt.Errorf("secure record counter exhausted")
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[4:], h.seq)
+	h.seq++
+	return nonce, nil
+}
+
+// Conn is a stream that runs the handshake before the first Read or Write.
+type Conn struct {
+	net.Conn
+	config   *Config
+	isClient bool
+
+	handshakeOnce sync.Once
+	handshakeErr  error
+	handshakeDone atomic.Bool
+	id            string
+
+	// The errors are sticky, a failed record leaves the stream out of step with the nonces of the peer.
+	readMu  sync.Mutex
+	in      halfConn
+	pending []byte
+	readErr error
+
+	writeMu     sync.Mutex
+	out         halfConn
+	writeErr    error
+	writeClosed bool
+}
+
+// Server returns the server side of the handshake, see Conn.HandshakeContext.
+func Server(conn net.Conn, config *Config) *Conn {
+	return &Conn{Conn: conn, config: config}
+}
+
+// Client returns the client side of the handshake, see Conn.HandshakeContext.
+func Client(conn net.Conn, config *Config) *Conn {
+	return &Conn{Conn: conn, config: config, isClient: true}
+}
+
+// ID returns the base64 static public key of the client, it is empty if the client has none.
+func (c *Conn) ID() string {
+	return c.id
+}
+
+// HandshakeContext runs the handshake if it has not run yet, the error of the first run is returned to all the callers.
+func (c *Conn) HandshakeContext(ctx context.Context) error {
+	c.handshakeOnce.Do(func() {
+		c.handshakeErr = c.handshake(ctx)
+		c.handshakeDone.Store(c.handshakeErr == nil)
+	})
+	return c.handshakeErr
+}
+
+func (c *Conn) handshake(ctx context.Context) error {
+	if err := c.config.Validate(c.isClient); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(c.config.timeout())
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = c.Conn.SetDeadline(deadline)
+	// A deadline in the past interrupts the blocked reads when the context is done.
+	stop := context.AfterFunc(ctx, func() {
+		_ = c.Conn.SetDeadline(time.Now())
+	})
+	defer stop()
+	if err := c.exchange(); err != nil {
+		return err
+	}
+	return c.Conn.SetDeadline(time.Time{})
+}
+
+// hello is the handshake message of one side.
+type hello struct {
+	raw       []byte
+	ephemeral []byte
+	static    []byte
+}
+
+func writeHello(w io.Writer, ephemeral, static []byte) (*hello, error) {
+	raw := append(slices.Clone(magic), version, 0)
+	raw = append(raw, ephemeral...)
+	if static != nil {
+		raw[len(magic)+1] |= flagStatic
+		raw = append(raw, static...)
+	}
+	if _, err := w.Write(raw); err != nil {
+		return nil, fmt.Errorf("secure handshake: %w", err)
+	}
+	return &hello{raw: raw, ephemeral: ephemeral, static: static}, nil
+}
+
+func readHello(r io.Reader) (*hello, error) {
+	raw := make([]byte, len(magic)+2+keySize)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, fmt.Errorf("secure handshake: %w", err)
+	}
+	if !bytes.Equal(raw[:len(magic)], magic) || raw[len(magic)] != version {
+		return nil, fmt.Errorf("secure handshake: the peer does not speak secure version %d", version)
+	}
+	h := &hello{ephemeral: raw[len(magic)+2:]}
+	if raw[len(magic)+1]&flagStatic != 0 {
+		h.static = make([]byte, keySize)
+		if _, err := io.ReadFull(r, h.static); err != nil {
+			return nil, fmt.Errorf("secure handshake: %w", err)
+		}
+		raw = append(raw, h.static...)
+	}
+	h.raw = raw
+	return h, nil
+}
+
+func (c *Conn) exchange() error {
+	ephemeral := make([]byte, keySize)
+	if _, err := rand.Read(ephemeral); err != nil {
+		return err
+	}
+	ephemeralPub, err := PublicKey(ephemeral)
+	if err != nil {
+		return err
+	}
+	var staticPub []byte
+	if c.config.PrivateKey != nil {
+		if staticPub, err = PublicKey(c.config.PrivateKey); err != nil {
+			return err
+		}
+	}
+
+	var clientHello, serverHello *hello
+	if c.isClient {
+		if clientHello, err = writeHello(c.Conn, ephemeralPub, staticPub); err != nil {
+			return err
+		}
+		if serverHello, err = readHello(c.Conn); err != nil {
+			return err
+		}
+		if c.config.PeerPublicKey != nil && !hmac.Equal(serverHello.static, c.config.PeerPublicKey) {
+			return fmt.Errorf("%w: unexpected server key", ErrAuthFailed)
+		}
+	} else {
+		if clientHello, err = readHello(c.Conn); err != nil {
+			return err
+		}
+		if len(c.config.AuthorizedKeys) > 0 && !slices.ContainsFunc(c.config.AuthorizedKeys, func(key []byte) bool {
+			return clientHello.static != nil && hmac.Equal(key, clientHello.static)
+		}) {
+			return fmt.Errorf("%w: unauthorized client key", ErrAuthFailed)
+		}
+		if serverHello, err = writeHello(c.Conn, ephemeralPub, staticPub); err != nil {
+			return err
+		}
+	}
+
+	// ee, es and se, the exchanges with the static keys only when the hellos carry them.
+	local, remote := clientHello, serverHello
+	if !c.isClient {
+		local, remote = serverHello, clientHello
+	}
+	var secret []byte
+	dh := func(private, public []byte) error {
+		shared, err := curve25519.X25519(private, public)
+		if err != nil {
+			return fmt.Errorf("secure handshake: %w", err)
+		}
+		secret = append(secret, shared...)
+		return nil
+	}
+	if err := dh(ephemeral, remote.ephemeral); err != nil {
+		return err
+	}
+	// es is the client ephemeral with the server static, se the client static with the server ephemeral.
+	for _, pair := range []struct{ owner, other *hello }{{serverHello, clientHello}, {clientHello, serverHello}} {
+		if pair.owner.static == nil {
+			continue
+		}
+		if pair.owner == local {
+			err = dh(c.config.PrivateKey, pair.other.ephemeral)
+		} else {
+			err = dh(ephemeral, pair.owner.static)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	secret = append(secret, c.config.PSK...)
+	transcript := sha256.New()
+	transcript.Write([]byte("mpipe secure v1"))
+	transcript.Write(clientHello.raw)
+	transcript.Write(serverHello.raw)
+	keys := make([]byte, 2*keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, transcript.Sum(nil), []byte("mpipe secure keys")), keys); err != nil {
+		return err
+	}
+	clear(secret)
+	clientKey, serverKey := keys[:keySize], keys[keySize:]
+	if !c.isClient {
+		clientKey, serverKey = serverKey, clientKey
+	}
+	if err := c.out.setKey(clientKey); err != nil {
+		return err
+	}
+	if err := c.in.setKey(serverKey); err != nil {
+		return err
+	}
+
+	// The finished records confirm that both sides derived the same keys, the server goes first.
+	if !c.isClient {
+		if err := c.writeRecord(recordFinished, nil); err != nil {
+			return fmt.Errorf("secure handshake: %w", err)
+		}
+	}
+	typ, _, err := c.readRecord()
+	if err != nil || typ != recordFinished {
+		return fmt.Errorf("%w: %w", ErrAuthFailed, errOr(err, "unexpected record"))
+	}
+	if c.isClient {
+		if err := c.writeRecord(recordFinished, nil); err != nil {
+			return fmt.Errorf("secure handshake: %w", err)
+		}
+	} else if clientHello.static != nil {
+		c.id = EncodeKey(clientHello.static)
+	}
+	return nil
+}
+
+func errOr(err error, message string) error {
+	if err != nil {
+		return err
+	}
+	return errors.New(message)
+}
+
+// writeRecord seals and writes one record, the caller holds writeMu or runs the handshake.
+func (c *Conn) writeRecord(typ byte, payload []byte) error {
+	nonce, err := c.out.nonce()
+	if err != nil {
+		return err
+	}
+	record := make([]byte, 2, 2+1+len(payload)+chacha20poly1305.Overhead)
+	binary.BigEndian.PutUint16(record, uint16(1+len(payload)+chacha20poly1305.Overhead))
+	plaintext := append([]byte{typ}, payload...)
+	record = c.out.aead.Seal(record, nonce, plaintext, record[:2])
+	_, err = c.Conn.Write(record)
+	return err
+}
+
+// readRecord reads and opens one record, the caller holds readMu or runs the handshake.
+func (c *Conn) readRecord() (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.Conn, header); err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, nil, ErrTruncated
+		}
+		return 0, nil, err
+	}
+	size := int(binary.BigEndian.Uint16(header))
+	if size < 1+chacha20poly1305.Overhead || size > maxCiphertext {
+		return 0, nil, fmt.Errorf("invalid secure record size %d", size)
+	}
+	ciphertext := make([]byte, size)
+	if _, err := io.ReadFull(c.Conn, ciphertext); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, nil, ErrTruncated
+		}
+		return 0, nil, err
+	}
+	nonce, err := c.in.nonce()
+	if err != nil {
+		return 0, nil, err
+	}
+	plaintext, err := c.in.aead.Open(ciphertext[:0], nonce, ciphertext, header)
+	if err != nil {
+		return 0, nil, fmt.Errorf("secure record rejected: %w", err)
+	}
+	return plaintext[0], plaintext[1:], nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if err := c.HandshakeContext(context.Background()); err != nil {
+		return 0, err
+	}
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for len(c.pending) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		typ, payload, err := c.readRecord()
+		if err != nil {
+			c.readErr = err
+			return 0, err
+		}
+		switch typ {
+		case recordData:
+			c.pending = payload
+		case recordRekey:
+			if err := c.in.ratchet(); err != nil {
+				c.readErr = err
+			}
+		case recordClose:
+			c.readErr = io.EOF
+		default:
+			c.readErr = fmt.Errorf("unexpected secure record type %d", typ)
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.HandshakeContext(context.Background()); err != nil {
+		return 0, err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.writeClosed {
+		return 0, net.ErrClosed
+	}
+	if c.writeErr != nil {
+		return 0, c.writeErr
+	}
+	written := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), maxPayload)]
+		if err := c.writeData(chunk); err != nil {
+			c.writeErr = err
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+// writeData writes a data record, after the rekey record if the key is due for replacement.
+func (c *Conn) writeData(chunk []byte) error {
+	if c.out.bytes >= c.config.rekeyBytes() || time.Since(c.out.rekeyedAt) >= c.config.rekeyInterval() {
+		if err := c.writeRecord(recordRekey, nil); err != nil {
+			return err
+		}
+		if err := c.out.ratchet(); err != nil {
+			return err
+		}
+	}
+	if err := c.writeRecord(recordData, chunk); err != nil {
+		return err
+	}
+	c.out.bytes += int64(len(chunk))
+	return nil
+}
+
+// closeWrite sends the close record once, the caller holds writeMu.
+func (c *Conn) closeWrite() error {
+	if c.writeClosed || c.writeErr != nil || !c.handshakeDone.Load() {
+		return nil
+	}
+	c.writeClosed = true
+	return c.writeRecord(recordClose, nil)
+}
+
+// CloseWrite ends the stream of this side, the underlying connection is half-closed if it supports it.
+func (c *Conn) CloseWrite() error {
+	if err := c.HandshakeContext(context.Background()); err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.closeWrite(); err != nil {
+		return err
+	}
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// Close sends the close record if the stream is still open, like the close_notify of TLS.
+func (c *Conn) Close() error {
+	if c.writeMu.TryLock() {
+		_ = c.Conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+		_ = c.closeWrite()
+		c.writeMu.Unlock()
+	}
+	return c.Conn.Close()
+}
+
+type listener struct {
+	net.Listener
+	config *Config
+}
+
+// Accept returns the connection before the handshake, so that a slow client does not hold up the others.
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return Server(conn, l.config), nil
+}
+
+// WrapListen wraps the listener function of a ForwardInput, the accepted connections are *Conn.
+func WrapListen(listen func(ctx context.Context, network string, address string) (net.Listener, error), config *Config) func(ctx context.Context, network string, address string) (net.Listener, error) {
+	return func(ctx context.Context, network string, address string) (net.Listener, error) {
+		if err := config.Validate(false); err != nil {
+			return nil, err
+		}
+		l, err := listen(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return &listener{Listener: l, config: config}, nil
+	}
+}
+
+// WrapDial wraps the dialer function of a ForwardOutput, the handshake is done before the connection is returned.
+func WrapDial(dial func(ctx context.Context, network string, address string) (net.Conn, error), config *Config) func(ctx context.Context, network string, address string) (net.Conn, error) {
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		secureConn := Client(conn, config)
+		if err := secureConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return secureConn, nil
+	}
+}
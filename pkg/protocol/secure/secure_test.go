@@ -0,0 +1,343 @@
+package secure
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// handshake runs both sides over a pipe, a side that fails closes its end like handleConn does.
+func handshake(t *testing.T, serverConfig, clientConfig *Config) (server, client *Conn, serverErr, clientErr error) {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+	server, client = Server(serverConn, serverConfig), Client(clientConn, clientConfig)
+	done := make(chan error, 1)
+	go func() {
+		err := server.HandshakeContext(context.Background())
+		if err != nil {
+			_ = serverConn.Close()
+		}
+		done <- err
+	}()
+	clientErr = client.HandshakeContext(context.Background())
+	if clientErr != nil {
+		_ = clientConn.Close()
+	}
+	select {
+	case serverErr = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server handshake did not return")
+	}
+	return server, client, serverErr, clientErr
+}
+
+func Test_handshake(t *testing.T) {
+	psk := []byte("0123456789abcdef")
+	serverKey, serverPub, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, clientPub, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		serverConfig Config
+		clientConfig Config
+		wantID       string
+	}{
+		{"psk", Config{PSK: psk}, Config{PSK: psk}, ""},
+		{"static key", Config{PrivateKey: serverKey}, Config{PeerPublicKey: serverPub}, ""},
+		{"psk and unpinned server key", Config{PSK: psk, PrivateKey: serverKey}, Config{PSK: psk}, ""},
+		{"client key", Config{PrivateKey: serverKey}, Config{PrivateKey: clientKey, PeerPublicKey: serverPub}, EncodeKey(clientPub)},
+		{"authorized keys", Config{PrivateKey: serverKey, AuthorizedKeys: [][]byte{serverPub, clientPub}}, Config{PrivateKey: clientKey, PeerPublicKey: serverPub}, EncodeKey(clientPub)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client, serverErr, clientErr := handshake(t, &tt.serverConfig, &tt.clientConfig)
+			if serverErr != nil || clientErr != nil {
+				t.Fatalf("handshake failed, server: %v, client: %v", serverErr, clientErr)
+			}
+			if server.ID() != tt.wantID {
+				t.Errorf("ID() = %q, want %q", server.ID(), tt.wantID)
+			}
+			go func() {
+				_, _ = client.Write([]byte("hello"))
+			}()
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "hello" {
+				t.Errorf("read %q, %v after the handshake", buf, err)
+			}
+		})
+	}
+}
+
+func Test_handshakeFailure(t *testing.T) {
+	psk := []byte("0123456789abcdef")
+	serverKey, serverPub, _ := GenerateKey()
+	clientKey, _, _ := GenerateKey()
+	_, otherPub, _ := GenerateKey()
+	tests := []struct {
+		name         string
+		serverConfig Config
+		clientConfig Config
+	}{
+		{"wrong psk", Config{PSK: psk}, Config{PSK: []byte("fedcba9876543210")}},
+		{"psk and wrong server key", Config{PSK: psk, PrivateKey: serverKey}, Config{PSK: psk, PeerPublicKey: otherPub}},
+		{"pinned key", Config{PrivateKey: serverKey}, Config{PeerPublicKey: otherPub}},
+		{"unknown client key", Config{PrivateKey: serverKey, AuthorizedKeys: [][]byte{otherPub}}, Config{PrivateKey: clientKey, PeerPublicKey: serverPub}},
+		{"no client key", Config{PrivateKey: serverKey, AuthorizedKeys: [][]byte{otherPub}}, Config{PeerPublicKey: serverPub}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _, serverErr, clientErr := handshake(t, &tt.serverConfig, &tt.clientConfig)
+			if serverErr == nil || clientErr == nil {
+				t.Fatalf("handshake succeeded, server: %v, client: %v", serverErr, clientErr)
+			}
+			if !errors.Is(serverErr, ErrAuthFailed) && !errors.Is(clientErr, ErrAuthFailed) {
+				t.Errorf("server: %v, client: %v, want ErrAuthFailed on one side", serverErr, clientErr)
+			}
+			if _, err := server.Read(make([]byte, 1)); err == nil {
+				t.Error("Read() after a failed handshake succeeded")
+			}
+		})
+	}
+
+	if err := Server(nil, &Config{}).HandshakeContext(context.Background()); err == nil {
+		t.Error("handshake of a server without a PSK or a private key succeeded")
+	}
+	if err := Client(nil, &Config{PSK: psk, PeerPublicKey: []byte("short")}).HandshakeContext(context.Background()); err == nil {
+		t.Error("handshake with a short key succeeded")
+	}
+}
+
+// streamConn replaces the connection under a Conn after the handshake, the records are written to w and read from r.
+type streamConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+// splitRecords returns the records of the stream, each with its length header.
+func splitRecords(t *testing.T, stream []byte) [][]byte {
+	t.Helper()
+	var records [][]byte
+	for len(stream) > 0 {
+		size := 2 + int(binary.BigEndian.Uint16(stream))
+		if size > len(stream) {
+			t.Fatalf("partial record in the stream")
+		}
+		records = append(records, stream[:size])
+		stream = stream[size:]
+	}
+	return records
+}
+
+// records returns the records the client writes for the payloads, the server is ready to read whatever is fed to it.
+func records(t *testing.T, config *Config, payloads ...string) (server *Conn, records [][]byte) {
+	t.Helper()
+	server, client, serverErr, clientErr := handshake(t, config, config)
+	if serverErr != nil || clientErr != nil {
+		t.Fatalf("handshake failed, server: %v, client: %v", serverErr, clientErr)
+	}
+	var stream bytes.Buffer
+	client.Conn = &streamConn{Conn: client.Conn, w: &stream}
+	for _, payload := range payloads {
+		if _, err := client.Write([]byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return server, splitRecords(t, stream.Bytes())
+}
+
+func feed(server *Conn, records ...[]byte) {
+	server.Conn = &streamConn{Conn: server.Conn, r: bytes.NewReader(bytes.Join(records, nil))}
+}
+
+func Test_records(t *testing.T) {
+	config := &Config{PSK: []byte("0123456789abcdef")}
+
+	t.Run("in order", func(t *testing.T) {
+		server, recs := records(t, config, "one", "two")
+		feed(server, recs...)
+		got, err := io.ReadAll(server)
+		if string(got) != "onetwo" || !errors.Is(err, ErrTruncated) {
+			t.Errorf("ReadAll() = %q, %v, want onetwo and ErrTruncated", got, err)
+		}
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		server, recs := records(t, config, "one")
+		tampered := bytes.Clone(recs[0])
+		tampered[3] ^= 1
+		feed(server, tampered)
+		if n, err := server.Read(make([]byte, 16)); err == nil {
+			t.Errorf("Read() of a tampered record = %d bytes", n)
+		}
+		// The error is sticky, the stream is out of step.
+		if _, err := server.Read(make([]byte, 16)); err == nil {
+			t.Error("Read() after a rejected record succeeded")
+		}
+	})
+
+	t.Run("replayed", func(t *testing.T) {
+		server, recs := records(t, config, "one")
+		feed(server, recs[0], recs[0])
+		buf := make([]byte, 16)
+		if n, err := server.Read(buf); err != nil || string(buf[:n]) != "one" {
+			t.Fatalf("Read() = %q, %v", buf[:n], err)
+		}
+		if n, err := server.Read(buf); err == nil {
+			t.Errorf("Read() of a replayed record = %q", buf[:n])
+		}
+	})
+
+	t.Run("reordered", func(t *testing.T) {
+		server, recs := records(t, config, "one", "two")
+		feed(server, recs[1], recs[0])
+		buf := make([]byte, 16)
+		if n, err := server.Read(buf); err == nil {
+			t.Errorf("Read() of a reordered record = %q", buf[:n])
+		}
+	})
+
+	t.Run("truncated record", func(t *testing.T) {
+		server, recs := records(t, config, "one")
+		feed(server, recs[0][:len(recs[0])-1])
+		if _, err := server.Read(make([]byte, 16)); !errors.Is(err, ErrTruncated) {
+			t.Errorf("Read() = %v, want ErrTruncated", err)
+		}
+	})
+
+	t.Run("close record", func(t *testing.T) {
+		server, client, serverErr, clientErr := handshake(t, config, config)
+		if serverErr != nil || clientErr != nil {
+			t.Fatalf("handshake failed, server: %v, client: %v", serverErr, clientErr)
+		}
+		var stream bytes.Buffer
+		client.Conn = &streamConn{Conn: client.Conn, w: &stream}
+		_, _ = client.Write([]byte("one"))
+		if err := client.CloseWrite(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Write([]byte("two")); err == nil {
+			t.Error("Write() after CloseWrite() succeeded")
+		}
+		feed(server, stream.Bytes())
+		got, err := io.ReadAll(server)
+		if string(got) != "one" || err != nil {
+			t.Errorf("ReadAll() = %q, %v, want one and a clean EOF", got, err)
+		}
+	})
+}
+
+func Test_rekey(t *testing.T) {
+	config := &Config{PSK: []byte("0123456789abcdef"), RekeyBytes: 10}
+	payloads := []string{"0123456789", "abcdefghij", "klmnopqrst", "uvwxyz"}
+	server, recs := records(t, config, payloads...)
+	// Every write after the first is preceded by a rekey record.
+	if want := 2*len(payloads) - 1; len(recs) != want {
+		t.Errorf("%d records, want %d with the rekey records", len(recs), want)
+	}
+	feed(server, recs...)
+	got, err := io.ReadAll(server)
+	if want := "0123456789abcdefghijklmnopqrstuvwxyz"; string(got) != want || !errors.Is(err, ErrTruncated) {
+		t.Errorf("ReadAll() = %q, %v, want %q", got, err, want)
+	}
+
+	// A rekey record that is dropped leaves the server on the old key.
+	server, recs = records(t, config, payloads[:2]...)
+	feed(server, recs[0], recs[2])
+	buf := make([]byte, 16)
+	if n, err := server.Read(buf); err != nil || string(buf[:n]) != payloads[0] {
+		t.Fatalf("Read() = %q, %v", buf[:n], err)
+	}
+	if n, err := server.Read(buf); err == nil {
+		t.Errorf("Read() without the rekey record = %q", buf[:n])
+	}
+}
+
+func Test_largeWrite(t *testing.T) {
+	config := &Config{PSK: []byte("0123456789abcdef"), RekeyBytes: 50000}
+	server, client, serverErr, clientErr := handshake(t, config, config)
+	if serverErr != nil || clientErr != nil {
+		t.Fatalf("handshake failed, server: %v, client: %v", serverErr, clientErr)
+	}
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	go func() {
+		_, _ = client.Write(data)
+		_ = client.Close()
+	}()
+	got, err := io.ReadAll(server)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("ReadAll() = %d bytes, %v, want %d bytes", len(got), err, len(data))
+	}
+}
+
+func Test_wrapListenDial(t *testing.T) {
+	serverKey, serverPub, _ := GenerateKey()
+	l, err := WrapListen(func(ctx context.Context, network, address string) (net.Listener, error) {
+		return net.Listen(network, address)
+	}, &Config{PrivateKey: serverKey})(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+				_ = conn.(*Conn).CloseWrite()
+			}()
+		}
+	}()
+	conn, err := WrapDial((&net.Dialer{}).DialContext, &Config{PeerPublicKey: serverPub})(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(*Conn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(conn); err != nil || string(got) != "ping" {
+		t.Errorf("echo = %q, %v", got, err)
+	}
+
+	_, otherPub, _ := GenerateKey()
+	if _, err := WrapDial((&net.Dialer{}).DialContext, &Config{PeerPublicKey: otherPub})(context.Background(), "tcp", l.Addr().String()); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("dial with a wrong pin = %v, want ErrAuthFailed", err)
+	}
+	if _, err := WrapListen(nil, &Config{})(context.Background(), "tcp", "127.0.0.1:0"); err == nil {
+		t.Error("WrapListen() without a PSK or a private key succeeded")
+	}
+}
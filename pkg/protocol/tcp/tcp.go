@@ -1 +1,136 @@
+// Package tcp frames the messages written to a TCP stream, so that the datagrams of a UDP tunnel
+// keep their boundaries between two mpipe, udp -> framed -> udp.
+//
+// Each Write is sent as a frame:
+//
+//	length(2, big endian) payload(length)
+//
+// A Read never returns the data of two frames, a frame larger than the buffer is returned by the following Reads.
+// An empty frame is read as 0 bytes with a nil error, like an empty datagram.
 package tcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	headerSize = 2
+	// MaxFrameSize is the largest payload of a frame, it holds any UDP datagram.
+	MaxFrameSize = 1<<16 - 1
+)
+
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// Conn is a TCP stream whose Reads and Writes are frames.
+type Conn struct {
+	net.Conn
+	br *bufio.Reader
+
+	readMu sync.Mutex
+	// remaining is the unread payload of the current frame, inFrame is false before its header is read.
+	remaining int
+	inFrame   bool
+
+	writeMu sync.Mutex
+}
+
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{Conn: conn, br: bufio.NewReader(conn)}
+}
+
+// NetConn returns the underlying connection.
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if !c.inFrame {
+		var header [headerSize]byte
+		if _, err := io.ReadFull(c.br, header[:]); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return 0, fmt.Errorf("truncated frame header: %w", err)
+			}
+			return 0, err
+		}
+		c.remaining = int(binary.BigEndian.Uint16(header[:]))
+		c.inFrame = true
+	}
+	if c.remaining == 0 {
+		c.inFrame = false
+		return 0, nil
+	}
+	if len(b) > c.remaining {
+		b = b[:c.remaining]
+	}
+	// The frame may arrive in pieces, a datagram must not be split because the buffer was not filled by the first one.
+	n, err := io.ReadFull(c.br, b)
+	c.remaining -= n
+	c.inFrame = c.remaining > 0
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		err = fmt.Errorf("truncated frame: %w", io.ErrUnexpectedEOF)
+	}
+	return n, err
+}
+
+// Write sends b as one frame, b must not be larger than MaxFrameSize. An empty b is sent as an empty frame.
+func (c *Conn) Write(b []byte) (int, error) {
+	if len(b) > MaxFrameSize {
+		return 0, fmt.Errorf("%w: %d bytes, the limit is %d", ErrFrameTooLarge, len(b), MaxFrameSize)
+	}
+	var header [headerSize]byte
+	binary.BigEndian.PutUint16(header[:], uint16(len(b)))
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	// net.Buffers writes the header and the payload with a single writev on a *net.TCPConn.
+	buffers := net.Buffers{header[:], b}
+	n, err := buffers.WriteTo(c.Conn)
+	if n < headerSize {
+		return 0, err
+	}
+	return int(n) - headerSize, err
+}
+
+// CloseWrite half-closes the underlying connection if it supports it, the peer reads EOF after the last frame.
+func (c *Conn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return nil
+}
+
+type listener struct {
+	net.Listener
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn), nil
+}
+
+// NewListener returns a listener whose connections are the framed connections of l.
+func NewListener(l net.Listener) net.Listener {
+	return &listener{Listener: l}
+}
+
+// WrapDial wraps the dialer function of a ForwardOutput.
+func WrapDial(dial func(ctx context.Context, network string, address string) (net.Conn, error)) func(ctx context.Context, network string, address string) (net.Conn, error) {
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return NewConn(conn), nil
+	}
+}
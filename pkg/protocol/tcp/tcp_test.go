@@ -0,0 +1,177 @@
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipe returns a framed connection and the raw stream that feeds it.
+func pipe(t *testing.T) (*Conn, net.Conn) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	_ = a.SetDeadline(time.Now().Add(5 * time.Second))
+	_ = b.SetDeadline(time.Now().Add(5 * time.Second))
+	return NewConn(a), b
+}
+
+// writeRaw writes the stream in pieces of size bytes and closes it.
+func writeRaw(raw net.Conn, stream []byte, size int) {
+	go func() {
+		defer raw.Close()
+		for len(stream) > 0 {
+			n := min(size, len(stream))
+			if _, err := raw.Write(stream[:n]); err != nil {
+				return
+			}
+			stream = stream[n:]
+		}
+	}()
+}
+
+func Test_frameBoundaries(t *testing.T) {
+	for _, size := range []int{1, 3, 1 << 10} {
+		conn, raw := pipe(t)
+		stream := []byte{0, 5, 'h', 'e', 'l', 'l', 'o', 0, 0, 0, 3, 'a', 'b', 'c'}
+		writeRaw(raw, stream, size)
+		var got []string
+		buf := make([]byte, 64)
+		for {
+			n, err := conn.Read(buf)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("pieces of %d: Read() = %v", size, err)
+			}
+			got = append(got, string(buf[:n]))
+		}
+		// The partial reads of the underlying stream are joined into whole frames.
+		if want := []string{"hello", "", "abc"}; !equal(got, want) {
+			t.Errorf("pieces of %d: frames %q, want %q", size, got, want)
+		}
+	}
+
+	// A frame larger than the buffer takes several Reads, which never reach into the next frame.
+	conn, raw := pipe(t)
+	writeRaw(raw, []byte{0, 5, 'h', 'e', 'l', 'l', 'o', 0, 2, 'h', 'i'}, 64)
+	var got []string
+	buf := make([]byte, 2)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		got = append(got, string(buf[:n]))
+	}
+	if want := []string{"he", "ll", "o", "hi"}; !equal(got, want) {
+		t.Errorf("frames %q, want %q", got, want)
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func Test_truncated(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream []byte
+	}{
+		{"header", []byte{0}},
+		{"payload", []byte{0, 5, 'h', 'e'}},
+	}
+	for _, tt := range tests {
+		conn, raw := pipe(t)
+		writeRaw(raw, tt.stream, 1)
+		_, err := io.ReadAll(conn)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("%s: ReadAll() = %v, want io.ErrUnexpectedEOF", tt.name, err)
+		}
+	}
+}
+
+func Test_write(t *testing.T) {
+	conn, raw := pipe(t)
+	received := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(raw)
+		received <- data
+	}()
+	for _, payload := range [][]byte{[]byte("hello"), nil, make([]byte, MaxFrameSize)} {
+		if n, err := conn.Write(payload); err != nil || n != len(payload) {
+			t.Fatalf("Write(%d bytes) = %d, %v", len(payload), n, err)
+		}
+	}
+	if n, err := conn.Write(make([]byte, MaxFrameSize+1)); !errors.Is(err, ErrFrameTooLarge) || n != 0 {
+		t.Errorf("Write(%d bytes) = %d, %v, want ErrFrameTooLarge", MaxFrameSize+1, n, err)
+	}
+	_ = conn.Close()
+	data := <-received
+	want := append([]byte{0, 5, 'h', 'e', 'l', 'l', 'o', 0, 0, 0xff, 0xff}, make([]byte, MaxFrameSize)...)
+	if !bytes.Equal(data, want) {
+		t.Errorf("stream of %d bytes, want %d bytes", len(data), len(want))
+	}
+}
+
+func Test_listenerWrapDial(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(tcpListener)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, MaxFrameSize)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				_ = conn.(*Conn).CloseWrite()
+				return
+			}
+			_, _ = conn.Write(buf[:n])
+		}
+	}()
+	conn, err := WrapDial((&net.Dialer{}).DialContext)(context.Background(), "tcp", tcpListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16)
+	for _, message := range []string{"one", "", "three"} {
+		if _, err := conn.Write([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := conn.Read(buf); err != nil || string(buf[:n]) != message {
+			t.Errorf("echo %q, %v, want %q", buf[:n], err, message)
+		}
+	}
+	if err := conn.(*Conn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Errorf("Read() after the half-close = %v, want EOF", err)
+	}
+}
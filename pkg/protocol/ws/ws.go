@@ -1 +1,493 @@
+// Package ws carries a stream or datagrams in the binary messages of a WebSocket (RFC 6455),
+// so that a tunnel can cross the proxies and the load balancers that only let HTTP through.
+//
+// Each Write is sent as one message and a Read never returns the data of two messages,
+// so the datagrams of a UDP tunnel keep their boundaries.
 package ws
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+
+	closeNormal        = 1000
+	closeProtocolError = 1002
+	closeTooBig        = 1009
+
+	maxControlPayload = 125
+	maxFramePayload   = 16 << 20
+
+	defaultTimeout = 10 * time.Second
+	closeTimeout   = 5 * time.Second
+
+	acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+var ErrHandshake = errors.New("websocket handshake failed")
+
+type Config struct {
+	// Path of the WebSocket endpoint, default /.
+	Path string
+	// Host is the Host header sent by the client, default the dialed address.
+	Host string
+	// Header is sent by the client with the upgrade request.
+	// The server requires each of them to be present with the same value, for example a token.
+	Header http.Header
+	// Timeout limits the handshake, default 10s.
+	Timeout time.Duration
+}
+
+func (c *Config) path() string {
+	if c == nil || c.Path == "" {
+		return "/"
+	}
+	if !strings.HasPrefix(c.Path, "/") {
+		return "/" + c.Path
+	}
+	return c.Path
+}
+
+func (c *Config) timeout() time.Duration {
+	if c == nil || c.Timeout <= 0 {
+		return defaultTimeout
+	}
+	return c.Timeout
+}
+
+// Conn is a WebSocket that runs the upgrade handshake before the first Read or Write.
+type Conn struct {
+	net.Conn
+	config   *Config
+	isClient bool
+	// host is the Host header of the client.
+	host string
+	br   *bufio.Reader
+
+	handshakeOnce sync.Once
+	handshakeErr  error
+	// upgraded is set once the handshake succeeded, a connection closed before it gets no close frame.
+	upgraded atomic.Bool
+
+	readMu sync.Mutex
+	// remaining is the unread payload of the current data frame, mask and maskPos unmask it.
+	remaining int64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+	readErr   error
+
+	writeMu    sync.Mutex
+	closeSent  bool
+	writeError error
+}
+
+// Server returns the server side of the handshake, see Conn.HandshakeContext.
+func Server(conn net.Conn, config *Config) *Conn {
+	return &Conn{Conn: conn, config: config, br: bufio.NewReader(conn)}
+}
+
+// Client returns the client side of the handshake, host is the Host header if the config has none.
+func Client(conn net.Conn, config *Config, host string) *Conn {
+	if config != nil && config.Host != "" {
+		host = config.Host
+	}
+	return &Conn{Conn: conn, config: config, isClient: true, host: host, br: bufio.NewReader(conn)}
+}
+
+// NetConn returns the underlying connection.
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// HandshakeContext runs the handshake if it has not run yet, the error of the first run is returned to all the callers.
+func (c *Conn) HandshakeContext(ctx context.Context) error {
+	c.handshakeOnce.Do(func() {
+		c.handshakeErr = c.handshake(ctx)
+	})
+	return c.handshakeErr
+}
+
+func (c *Conn) handshake(ctx context.Context) error {
+	deadline := time.Now().Add(c.config.timeout())
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = c.Conn.SetDeadline(deadline)
+	// A deadline in the past interrupts the blocked reads when the context is done.
+	stop := context.AfterFunc(ctx, func() {
+		_ = c.Conn.SetDeadline(time.Now())
+	})
+	defer stop()
+	var err error
+	if c.isClient {
+		err = c.clientHandshake()
+	} else {
+		err = c.serverHandshake()
+	}
+	if err != nil {
+		return err
+	}
+	c.upgraded.Store(true)
+	return c.Conn.SetDeadline(time.Time{})
+}
+
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func headerHasToken(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *Conn) clientHandshake() error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: c.config.path()},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       c.host,
+	}
+	if c.config != nil {
+		for name, values := range c.config.Header {
+			req.Header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(c.Conn); err != nil {
+		return fmt.Errorf("%w: %w", ErrHandshake, err)
+	}
+	resp, err := http.ReadResponse(c.br, req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrHandshake, err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("%w: %s", ErrHandshake, resp.Status)
+	}
+	if !headerHasToken(resp.Header, "Upgrade", "websocket") || resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return fmt.Errorf("%w: invalid upgrade response", ErrHandshake)
+	}
+	return nil
+}
+
+func (c *Conn) serverHandshake() error {
+	req, err := http.ReadRequest(c.br)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrHandshake, err)
+	}
+	_ = req.Body.Close()
+	reject := func(status int, reason string) error {
+		fmt.Fprintf(c.Conn, "HTTP/1.1 %d %s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+			status, http.StatusText(status), len(reason), reason)
+		return fmt.Errorf("%w: %s %s: %s", ErrHandshake, req.Method, req.URL.Path, reason)
+	}
+	if req.URL.Path != c.config.path() {
+		return reject(http.StatusNotFound, "not found")
+	}
+	if req.Method != http.MethodGet || !headerHasToken(req.Header, "Upgrade", "websocket") || !headerHasToken(req.Header, "Connection", "upgrade") {
+		return reject(http.StatusUpgradeRequired, "websocket upgrade required")
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		return reject(http.StatusBadRequest, "unsupported websocket version")
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 {
+		return reject(http.StatusBadRequest, "invalid websocket key")
+	}
+	if c.config != nil {
+		for name, values := range c.config.Header {
+			if len(values) > 0 && subtle.ConstantTimeCompare([]byte(req.Header.Get(name)), []byte(values[0])) != 1 {
+				return reject(http.StatusForbidden, "forbidden")
+			}
+		}
+	}
+	_, err = fmt.Fprintf(c.Conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", acceptKey(key))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrHandshake, err)
+	}
+	return nil
+}
+
+// writeFrame writes one final frame, the caller holds writeMu. The frames of the client are masked.
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	header := make([]byte, 2, 14)
+	header[0] = 0x80 | opcode
+	switch size := len(payload); {
+	case size <= 125:
+		header[1] = byte(size)
+	case size <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(size))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(size))
+	}
+	frame := header
+	if c.isClient {
+		frame[1] |= 0x80
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range payload {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.HandshakeContext(context.Background()); err != nil {
+		return 0, err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return 0, net.ErrClosed
+	}
+	if c.writeError != nil {
+		return 0, c.writeError
+	}
+	if err := c.writeFrame(opBinary, b); err != nil {
+		c.writeError = err
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// sendClose writes the close frame once.
+func (c *Conn) sendClose(code uint16) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent || c.writeError != nil {
+		return nil
+	}
+	c.closeSent = true
+	return c.writeFrame(opClose, binary.BigEndian.AppendUint16(nil, code))
+}
+
+// readFrameHeader reads the header of the next frame, the caller holds readMu.
+func (c *Conn) readFrameHeader() (fin bool, opcode byte, size int64, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.br, header[:]); err != nil {
+		return
+	}
+	fin, opcode = header[0]&0x80 != 0, header[0]&0x0f
+	if header[0]&0x70 != 0 {
+		return fin, opcode, 0, c.protocolError(closeProtocolError, "reserved bits set")
+	}
+	c.masked = header[1]&0x80 != 0
+	if c.masked == c.isClient {
+		return fin, opcode, 0, c.protocolError(closeProtocolError, "wrong frame masking")
+	}
+	size = int64(header[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		size = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		size = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+	if size < 0 || size > maxFramePayload {
+		return fin, opcode, 0, c.protocolError(closeTooBig, "frame too big")
+	}
+	if c.masked {
+		if _, err = io.ReadFull(c.br, c.mask[:]); err != nil {
+			return
+		}
+	}
+	c.maskPos = 0
+	return fin, opcode, size, nil
+}
+
+func (c *Conn) protocolError(code uint16, reason string) error {
+	_ = c.sendClose(code)
+	return fmt.Errorf("websocket protocol error: %s", reason)
+}
+
+func (c *Conn) unmask(b []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range b {
+		b[i] ^= c.mask[c.maskPos%4]
+		c.maskPos++
+	}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if err := c.HandshakeContext(context.Background()); err != nil {
+		return 0, err
+	}
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for c.remaining == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if err := c.nextDataFrame(); err != nil {
+			c.readErr = err
+			return 0, err
+		}
+	}
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.br.Read(b)
+	c.unmask(b[:n])
+	c.remaining -= int64(n)
+	if err != nil {
+		c.readErr = err
+	}
+	return n, err
+}
+
+// nextDataFrame skips to a data frame with a payload and answers the control frames on the way.
+func (c *Conn) nextDataFrame() error {
+	for {
+		_, opcode, size, err := c.readFrameHeader()
+		if err != nil {
+			return err
+		}
+		switch opcode {
+		case opContinuation, opText, opBinary:
+			if size > 0 {
+				c.remaining = size
+				return nil
+			}
+			continue
+		}
+		if size > maxControlPayload {
+			return c.protocolError(closeProtocolError, "control frame too big")
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return err
+		}
+		c.unmask(payload)
+		switch opcode {
+		case opPing:
+			c.writeMu.Lock()
+			if !c.closeSent {
+				err = c.writeFrame(opPong, payload)
+			}
+			c.writeMu.Unlock()
+			if err != nil {
+				return err
+			}
+		case opPong:
+		case opClose:
+			// The close frame of this side is sent by CloseWrite or Close, once the tunnel is done writing.
+			return io.EOF
+		default:
+			return c.protocolError(closeProtocolError, fmt.Sprintf("unknown opcode %d", opcode))
+		}
+	}
+}
+
+// CloseWrite sends the close frame, the peer reads EOF. The data of the peer can still be read until its close frame.
+func (c *Conn) CloseWrite() error {
+	if err := c.HandshakeContext(context.Background()); err != nil {
+		return err
+	}
+	return c.sendClose(closeNormal)
+}
+
+// Close sends the close frame if it was not sent yet and closes the connection.
+func (c *Conn) Close() error {
+	if c.upgraded.Load() && c.writeMu.TryLock() {
+		c.writeMu.Unlock()
+		_ = c.Conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+		_ = c.sendClose(closeNormal)
+	}
+	return c.Conn.Close()
+}
+
+type listener struct {
+	net.Listener
+	config *Config
+}
+
+// Accept returns the connection before the handshake, so that a slow client does not hold up the others.
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return Server(conn, l.config), nil
+}
+
+// NewListener returns a listener whose connections are the WebSockets upgraded from the connections of l.
+func NewListener(l net.Listener, config *Config) net.Listener {
+	return &listener{Listener: l, config: config}
+}
+
+// WrapDial wraps the dialer function of a ForwardOutput, the handshake is done before the connection is returned.
+func WrapDial(dial func(ctx context.Context, network string, address string) (net.Conn, error), config *Config) func(ctx context.Context, network string, address string) (net.Conn, error) {
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		wsConn := Client(conn, config, address)
+		if err := wsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return wsConn, nil
+	}
+}
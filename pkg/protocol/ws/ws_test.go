@@ -0,0 +1,415 @@
+package ws
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_acceptKey(t *testing.T) {
+	// The example of RFC 6455 section 1.3.
+	if got := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("acceptKey() = %q", got)
+	}
+}
+
+func Test_serverHandshake(t *testing.T) {
+	config := &Config{Path: "/tunnel", Header: http.Header{"X-Token": {"secret"}}}
+	valid := "GET /tunnel HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\nX-Token: secret\r\n\r\n"
+	tests := []struct {
+		name       string
+		request    string
+		wantStatus int
+	}{
+		{"upgrade", valid, http.StatusSwitchingProtocols},
+		{"wrong path", strings.Replace(valid, "/tunnel", "/other", 1), http.StatusNotFound},
+		{"missing header", strings.Replace(valid, "X-Token: secret\r\n", "", 1), http.StatusForbidden},
+		{"wrong header", strings.Replace(valid, "X-Token: secret", "X-Token: guess", 1), http.StatusForbidden},
+		{"not an upgrade", strings.Replace(strings.Replace(valid, "Upgrade: websocket\r\n", "", 1), ", Upgrade", "", 1), http.StatusUpgradeRequired},
+		{"post", strings.Replace(valid, "GET", "POST", 1), http.StatusUpgradeRequired},
+		{"old version", strings.Replace(valid, "Version: 13", "Version: 8", 1), http.StatusBadRequest},
+		{"invalid key", strings.Replace(valid, "dGhlIHNhbXBsZSBub25jZQ==", "short", 1), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConn, clientConn := net.Pipe()
+			defer serverConn.Close()
+			defer clientConn.Close()
+			_ = clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+			done := make(chan error, 1)
+			go func() {
+				err := Server(serverConn, config).HandshakeContext(context.Background())
+				_ = serverConn.Close()
+				done <- err
+			}()
+			go func() {
+				_, _ = io.WriteString(clientConn, tt.request)
+			}()
+			resp, err := http.ReadResponse(bufio.NewReader(clientConn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			err = <-done
+			if tt.wantStatus == http.StatusSwitchingProtocols {
+				if err != nil {
+					t.Errorf("HandshakeContext() = %v", err)
+				}
+				if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+					t.Errorf("Sec-WebSocket-Accept = %q", got)
+				}
+			} else if !errors.Is(err, ErrHandshake) {
+				t.Errorf("HandshakeContext() = %v, want ErrHandshake", err)
+			}
+		})
+	}
+}
+
+func Test_clientHandshake(t *testing.T) {
+	tests := []struct {
+		name     string
+		response func(key string) string
+		wantErr  bool
+	}{
+		{"upgrade", func(key string) string {
+			return "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+		}, false},
+		{"wrong accept", func(key string) string {
+			return "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + acceptKey("other") + "\r\n\r\n"
+		}, true},
+		{"rejected", func(string) string {
+			return "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConn, clientConn := net.Pipe()
+			defer serverConn.Close()
+			defer clientConn.Close()
+			requests := make(chan *http.Request, 1)
+			go func() {
+				req, err := http.ReadRequest(bufio.NewReader(serverConn))
+				if err != nil {
+					close(requests)
+					return
+				}
+				requests <- req
+				_, _ = io.WriteString(serverConn, tt.response(req.Header.Get("Sec-WebSocket-Key")))
+			}()
+			config := &Config{Path: "tunnel", Header: http.Header{"X-Token": {"secret"}}}
+			err := Client(clientConn, config, "example.com:80").HandshakeContext(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("HandshakeContext() = %v, wantErr %v", err, tt.wantErr)
+			}
+			req := <-requests
+			if req == nil {
+				t.Fatal("no upgrade request")
+			}
+			if req.URL.Path != "/tunnel" || req.Host != "example.com:80" || req.Header.Get("X-Token") != "secret" {
+				t.Errorf("request %s, host %s, headers %v", req.URL.Path, req.Host, req.Header)
+			}
+		})
+	}
+}
+
+// pair returns the two sides of an upgraded WebSocket over a pipe.
+func pair(t *testing.T) (server, client *Conn) {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+	_ = serverConn.SetDeadline(time.Now().Add(5 * time.Second))
+	_ = clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	server, client = Server(serverConn, nil), Client(clientConn, nil, "example.com")
+	done := make(chan error, 1)
+	go func() {
+		done <- server.HandshakeContext(context.Background())
+	}()
+	if err := client.HandshakeContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// The handshake cleared the deadlines.
+	_ = serverConn.SetDeadline(time.Now().Add(5 * time.Second))
+	_ = clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	return server, client
+}
+
+// frame encodes one frame as the peer would, the frames of a client are masked.
+func frame(fin bool, opcode byte, payload []byte, masked bool) []byte {
+	b := []byte{opcode, 0}
+	if fin {
+		b[0] |= 0x80
+	}
+	switch size := len(payload); {
+	case size <= 125:
+		b[1] = byte(size)
+	case size <= 0xffff:
+		b[1] = 126
+		b = binary.BigEndian.AppendUint16(b, uint16(size))
+	default:
+		b[1] = 127
+		b = binary.BigEndian.AppendUint64(b, uint64(size))
+	}
+	if !masked {
+		return append(b, payload...)
+	}
+	b[1] |= 0x80
+	mask := []byte{1, 2, 3, 4}
+	b = append(b, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+type rawFrame struct {
+	opcode  byte
+	masked  bool
+	length  byte
+	payload []byte
+}
+
+// readFrame reads one frame written by the other side, after the handshake.
+func readFrame(r io.Reader) (rawFrame, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return rawFrame{}, err
+	}
+	f := rawFrame{opcode: header[0] & 0x0f, masked: header[1]&0x80 != 0, length: header[1] & 0x7f}
+	size := uint64(f.length)
+	switch f.length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return f, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return f, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	var mask [4]byte
+	if f.masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return f, err
+		}
+	}
+	f.payload = make([]byte, size)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return f, err
+	}
+	if f.masked {
+		for i := range f.payload {
+			f.payload[i] ^= mask[i%4]
+		}
+	}
+	return f, nil
+}
+
+// frames reads the frames written by the other side in the background.
+func frames(r io.Reader) <-chan rawFrame {
+	ch := make(chan rawFrame, 16)
+	go func() {
+		defer close(ch)
+		for {
+			f, err := readFrame(r)
+			if err != nil {
+				return
+			}
+			ch <- f
+		}
+	}()
+	return ch
+}
+
+func nextFrame(t *testing.T, ch <-chan rawFrame) rawFrame {
+	t.Helper()
+	select {
+	case f, ok := <-ch:
+		if !ok {
+			t.Fatal("no frame")
+		}
+		return f
+	case <-time.After(5 * time.Second):
+		t.Fatal("no frame")
+	}
+	return rawFrame{}
+}
+
+func Test_masking(t *testing.T) {
+	server, client := pair(t)
+	written := frames(client.br)
+	go func() {
+		_, _ = client.Conn.Write(frame(true, opBinary, []byte("unmasked"), false))
+	}()
+	if _, err := server.Read(make([]byte, 16)); err == nil {
+		t.Error("the server accepted an unmasked frame")
+	}
+	if f := nextFrame(t, written); f.opcode != opClose || binary.BigEndian.Uint16(f.payload) != closeProtocolError || f.masked {
+		t.Errorf("server sent %+v, want an unmasked close frame with 1002", f)
+	}
+
+	server, client = pair(t)
+	go func() {
+		_, _ = server.Conn.Write(frame(true, opBinary, []byte("masked"), true))
+	}()
+	go func() {
+		_, _ = io.Copy(io.Discard, server.br)
+	}()
+	if _, err := client.Read(make([]byte, 16)); err == nil {
+		t.Error("the client accepted a masked frame")
+	}
+
+	// The frames of the client are masked, the ones of the server are not.
+	server, client = pair(t)
+	written = frames(server.br)
+	go func() {
+		_, _ = client.Write([]byte("hello"))
+	}()
+	if f := nextFrame(t, written); !f.masked || f.opcode != opBinary || string(f.payload) != "hello" {
+		t.Errorf("client sent %+v", f)
+	}
+}
+
+func Test_fragmentedMessage(t *testing.T) {
+	server, client := pair(t)
+	written := frames(client.br)
+	go func() {
+		var b []byte
+		b = append(b, frame(false, opBinary, []byte("hel"), true)...)
+		b = append(b, frame(true, opPing, []byte("ping"), true)...)
+		b = append(b, frame(false, opContinuation, nil, true)...)
+		b = append(b, frame(true, opContinuation, []byte("lo"), true)...)
+		_, _ = client.Conn.Write(b)
+	}()
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("read %q, %v", buf, err)
+	}
+	if f := nextFrame(t, written); f.opcode != opPong || string(f.payload) != "ping" {
+		t.Errorf("server answered the ping with %+v", f)
+	}
+}
+
+func Test_closeFrame(t *testing.T) {
+	server, client := pair(t)
+	written := frames(client.br)
+	go func() {
+		b := frame(true, opBinary, []byte("last"), true)
+		b = append(b, frame(true, opClose, binary.BigEndian.AppendUint16(nil, closeNormal), true)...)
+		_, _ = client.Conn.Write(b)
+	}()
+	got, err := io.ReadAll(server)
+	if err != nil || string(got) != "last" {
+		t.Errorf("ReadAll() = %q, %v", got, err)
+	}
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() after the close frame = %v, want EOF", err)
+	}
+	// The server still writes until it closes its side.
+	go func() {
+		_, _ = server.Write([]byte("reply"))
+		_ = server.CloseWrite()
+	}()
+	if f := nextFrame(t, written); f.opcode != opBinary || string(f.payload) != "reply" {
+		t.Errorf("server sent %+v, want the reply", f)
+	}
+	if f := nextFrame(t, written); f.opcode != opClose || binary.BigEndian.Uint16(f.payload) != closeNormal {
+		t.Errorf("server sent %+v, want a close frame with 1000", f)
+	}
+	if _, err := server.Write([]byte("late")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Write() after CloseWrite() = %v, want net.ErrClosed", err)
+	}
+}
+
+func Test_largeMessage(t *testing.T) {
+	server, client := pair(t)
+	data := make([]byte, 70000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	written := frames(client.br)
+	go func() {
+		_, _ = server.Write(data)
+	}()
+	if f := nextFrame(t, written); f.length != 127 || !bytes.Equal(f.payload, data) {
+		t.Errorf("frame with length %d and %d bytes, want the 64-bit length and %d bytes", f.length, len(f.payload), len(data))
+	}
+
+	server, client = pair(t)
+	go func() {
+		_, _ = client.Write(data)
+	}()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(server, got); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("server read %v", err)
+	}
+}
+
+func Test_listenerWrapDial(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{Path: "/tunnel", Header: http.Header{"X-Token": {"secret"}}}
+	l := NewListener(tcpListener, config)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+				_ = conn.(*Conn).CloseWrite()
+			}()
+		}
+	}()
+	conn, err := WrapDial((&net.Dialer{}).DialContext, config)(context.Background(), "tcp", tcpListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, message := range []string{"one", "two"} {
+		if _, err := conn.Write([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 16)
+		// Each message comes back on its own.
+		if n, err := conn.Read(buf); err != nil || string(buf[:n]) != message {
+			t.Errorf("read %q, %v, want %q", buf[:n], err, message)
+		}
+	}
+	if err := conn.(*Conn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() after the close = %v, want EOF", err)
+	}
+
+	if _, err := WrapDial((&net.Dialer{}).DialContext, &Config{Path: "/tunnel"})(context.Background(), "tcp", tcpListener.Addr().String()); !errors.Is(err, ErrHandshake) {
+		t.Errorf("dial without the header = %v, want ErrHandshake", err)
+	}
+}